@@ -14,54 +14,333 @@ type Stats struct {
 	Hits       uint64 `json:"hits"`
 	Misses     uint64 `json:"misses"`
 	Evictions  uint64 `json:"evictions"`
+	Rejections uint64 `json:"rejections"`
 	Expired    uint64 `json:"expired"`
+	// times the cache was cleared because Redis invalidated all keys, e.g. on FLUSHDB or FLUSHALL
+	Flushes    uint64 `json:"flushes"`
 	NumEntries int    `json:"num_entries"`
+	// current and peak size of keys and values in the cache. with multiple shards the peak is the sum of the shards'
+	// peaks, an upper bound of the actual peak
+	Bytes     int64 `json:"bytes"`
+	PeakBytes int64 `json:"peak_bytes"`
 }
 
 type cacheEntry struct {
-	data    []byte
+	data []byte
+	// non-string value, like a hash, data is then nil. for strings it's the value decoded by GetValue, if kept
+	value   interface{}
 	expires time.Time
+	// size of key and data in bytes
+	size int64
+	// how long loading data took, used for early refreshes
+	delta time.Duration
 }
 
+// cache is split into shards by key hash so that operations on keys in different shards don't contend on the same lock
 type cache struct {
+	shards []*cacheShard
+	mask   uint32
+	// loads of missing keys in progress
+	loads loadGroup
+}
+
+// creates a cache limited to maxEntries entries and/or maxBytes bytes, zero means no limit but one limit must be set.
+// the limits are split evenly between numShards shards, rounded up to a power of two, so an entry larger than
+// maxBytes/numShards is never cached. newPolicy creates the eviction policy of each shard given its max entries, nil
+// means crude random eviction
+func newCache(maxEntries int, maxBytes int64, numShards int, newPolicy func(maxEntries int) EvictionPolicy) *cache {
+	if maxEntries <= 0 && maxBytes <= 0 {
+		panic("max entries and max bytes must not both be 0")
+	}
+
+	n := 1
+	for n < numShards {
+		n <<= 1
+	}
+
+	c := &cache{
+		shards: make([]*cacheShard, n),
+		mask:   uint32(n - 1),
+	}
+
+	shardEntries := (maxEntries + n - 1) / n
+	shardBytes := (maxBytes + int64(n) - 1) / int64(n)
+	for i := range c.shards {
+		var policy EvictionPolicy
+		if newPolicy != nil {
+			policy = newPolicy(shardEntries)
+		}
+
+		c.shards[i] = newCacheShard(shardEntries, shardBytes, policy)
+	}
+
+	dlog("cache.new: %p n=%d b=%d s=%d\n", c, maxEntries, maxBytes, n)
+	return c
+}
+
+// fnv-1a, inlined to avoid allocating
+func (c *cache) shard(key string) *cacheShard {
+	if c.mask == 0 {
+		return c.shards[0]
+	}
+
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+
+	return c.shards[h&c.mask]
+}
+
+// makes the cache count into the counters of a pool as well
+func (c *cache) setCounters(cnt *counters) {
+	for _, s := range c.shards {
+		s.counters = cnt
+	}
+}
+
+func (c *cache) delete(keys ...string) {
+	if len(c.shards) == 1 {
+		c.shards[0].delete(keys...)
+		return
+	}
+
+	for _, k := range keys {
+		c.shard(k).delete(k)
+	}
+}
+
+func (c *cache) set(key string, value []byte, expires int) {
+	c.shard(key).set(key, value, expires)
+}
+
+// replaces the entry of key with the in-progress sentinel and returns the replaced entry, so that a value merged with
+// it isn't cached if the key is invalidated meanwhile
+func (c *cache) swapSentinel(key string) (cacheEntry, bool) {
+	return c.shard(key).swapSentinel(key)
+}
+
+// replaces the in-progress sentinel of key with a non-string value of size bytes, see replaceSentinel
+func (c *cache) replaceSentinelValue(key string, value interface{}, size int, expires int) bool {
+	return c.shard(key).replaceSentinelValue(key, value, size, expires)
+}
+
+// replaces the in-progress sentinel of key with value, returns false if the sentinel is gone, meaning the key has been
+// invalidated while it was fetched
+func (c *cache) replaceSentinel(key string, value []byte, expires int) bool {
+	return c.shard(key).replaceSentinel(key, value, expires)
+}
+
+// deletes key if it still holds the in-progress sentinel
+func (c *cache) deleteSentinel(key string) {
+	c.shard(key).deleteSentinel(key)
+}
+
+// returns the decoded value of key if its data is still data
+func (c *cache) decoded(key string, data []byte) interface{} {
+	return c.shard(key).decoded(key, data)
+}
+
+// sets the decoded value of key if its data is still data, it's been invalidated otherwise
+func (c *cache) setDecoded(key string, data []byte, value interface{}) {
+	c.shard(key).setDecoded(key, data, value)
+}
+
+// records how long loading the value of key took
+func (c *cache) setDelta(key string, d time.Duration) {
+	c.shard(key).setDelta(key, d)
+}
+
+func (c *cache) getEntry(key string) (cacheEntry, bool) {
+	return c.shard(key).getEntry(key)
+}
+
+func (c *cache) get(key string) []byte {
+	ce, _ := c.getEntry(key)
+	return ce.data
+}
+
+func (c *cache) getm(keys ...string) []cacheEntry {
+	results := make([]cacheEntry, 0, len(keys))
+	for _, k := range keys {
+		ce, _ := c.getEntry(k)
+		results = append(results, ce)
+	}
+
+	return results
+}
+
+func (c *cache) evictExpired() {
+	for _, s := range c.shards {
+		s.evictExpired()
+	}
+}
+
+func (c *cache) stats() Stats {
+	var st Stats
+	for _, s := range c.shards {
+		ss := s.stats()
+		st.Hits += ss.Hits
+		st.Misses += ss.Misses
+		st.Evictions += ss.Evictions
+		st.Rejections += ss.Rejections
+		st.Expired += ss.Expired
+		st.Flushes += ss.Flushes
+		st.NumEntries += ss.NumEntries
+		st.Bytes += ss.Bytes
+		st.PeakBytes += ss.PeakBytes
+	}
+
+	return st
+}
+
+func (c *cache) flush() {
+	dlog("cache.flush: %p\n", c)
+
+	for _, s := range c.shards {
+		s.flush()
+	}
+}
+
+// deletes all keys because Redis invalidated them all, unlike flush the stats aren't reset
+func (c *cache) clear() {
+	dlog("cache.clear: %p\n", c)
+
+	for _, s := range c.shards {
+		s.clear()
+	}
+
+	c.shards[0].countFlush()
+	c.shards[0].counters.addCache(counterFlushes, 1)
+}
+
+// reports whether the cache holds no entries, including in-progress ones
+func (c *cache) empty() bool {
+	for _, s := range c.shards {
+		s.Lock()
+		n := len(s.entries)
+		s.Unlock()
+
+		if n > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// deletes the keys fn returns true for
+func (c *cache) deleteFunc(fn func(key string) bool) {
+	for _, s := range c.shards {
+		s.deleteFunc(fn)
+	}
+}
+
+// deletes keys, nil keys mean all keys as in invalidation messages
+func (c *cache) invalidate(keys []string) {
+	if keys == nil {
+		c.clear()
+		return
+	}
+
+	c.delete(keys...)
+}
+
+// cacheShard is a segment of the cache with its own lock, limits, eviction policy and counters
+type cacheShard struct {
 	sync.Mutex
 	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	peakBytes  int64
 	hits       uint64
 	misses     uint64
 	evictions  uint64
+	rejections uint64
 	expired    uint64
+	flushes    uint64
 	entries    map[string]cacheEntry
+	// nil means crude random eviction
+	policy EvictionPolicy
+	// counters of the pool the cache belongs to, nil if none
+	counters *counters
 }
 
 const initialCacheSize = 128
 const evictSizeFactor = 0.05
 
-func newCache(maxEntries int) *cache {
-	if maxEntries <= 0 {
-		panic("max entries must not be 0")
-	}
-
-	c := &cache{
+func newCacheShard(maxEntries int, maxBytes int64, policy EvictionPolicy) *cacheShard {
+	return &cacheShard{
 		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
 		entries:    make(map[string]cacheEntry, initialCacheSize),
+		policy:     policy,
 	}
-
-	dlog("cache.new: %p n=%d\n", c, maxEntries)
-	return c
 }
 
-func (c *cache) delete(keys ...string) {
+func (c *cacheShard) delete(keys ...string) {
 	dlog("cache.delete: %p k=%s\n", c, keys)
 
 	c.Lock()
 	defer c.Unlock()
 	for _, k := range keys {
-		delete(c.entries, k)
+		c.remove(k)
+	}
+}
+
+func (c *cacheShard) deleteFunc(fn func(key string) bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	for k := range c.entries {
+		if fn(k) {
+			c.remove(k)
+		}
 	}
 }
 
 // lock is held
-func (c *cache) evictSize() int {
+func (c *cacheShard) remove(key string) {
+	if _, ok := c.entries[key]; !ok {
+		return
+	}
+
+	if c.policy != nil {
+		c.policy.Remove(key)
+	}
+
+	c.deleteEntry(key)
+}
+
+// deletes the entry without notifying the eviction policy
+// lock is held
+func (c *cacheShard) deleteEntry(key string) {
+	c.bytes -= c.entries[key].size
+	delete(c.entries, key)
+}
+
+// lock is held
+func (c *cacheShard) overLimit() bool {
+	return (c.maxEntries > 0 && len(c.entries) > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+// reports whether an entry of size bytes can't be added without evicting keys first
+// lock is held
+func (c *cacheShard) isFull(size int64) bool {
+	return (c.maxEntries > 0 && len(c.entries) >= c.maxEntries) || (c.maxBytes > 0 && c.bytes+size > c.maxBytes)
+}
+
+// records a lookup of key with the eviction policy
+// lock is held
+func (c *cacheShard) access(key string) {
+	if c.policy != nil {
+		c.policy.Access(key)
+	}
+}
+
+// lock is held
+func (c *cacheShard) evictSize() int {
 	s := int(math.Ceil(evictSizeFactor * float64(len(c.entries))))
 	if s == 0 {
 		s = 1
@@ -70,14 +349,39 @@ func (c *cache) evictSize() int {
 	return s
 }
 
+// evicts keys chosen by the eviction policy until the cache is within its limit, newKey is the key just added
+// lock is held
+func (c *cacheShard) evictKeys(newKey string) {
+	for c.overLimit() {
+		k, ok := c.policy.Evict()
+		if !ok {
+			break
+		}
+
+		c.deleteEntry(k)
+		if k == newKey {
+			dlog("cache.reject: %p k=%s\n", c, k)
+			c.rejections++
+			c.counters.addCache(counterRejections, 1)
+			continue
+		}
+
+		dlog("cache.evict: %p k=%s\n", c, k)
+		c.evictions++
+		c.counters.addCache(counterEvictions, 1)
+	}
+}
+
 // crude eviction if the cache is full, deletes a percentage of the keys from a random offset
 // lock is held
-// todo(jhamren): make this smarter, like LRU
-func (c *cache) evictKeys() {
+func (c *cacheShard) evictRandom() {
 	size := c.evictSize()
 
-	rand.Seed(nowFunc().UnixNano())
-	start := rand.Intn(len(c.entries) - size)
+	start := 0
+	if n := len(c.entries) - size; n > 0 {
+		rand.Seed(nowFunc().UnixNano())
+		start = rand.Intn(n)
+	}
 
 	dlog("cache.evict: %p st=%d si=%d l=%ds\n", c, start, size, len(c.entries))
 
@@ -90,8 +394,9 @@ func (c *cache) evictKeys() {
 
 		dlog("cache.evict: %p k=%s\n", c, k)
 
-		delete(c.entries, k)
+		c.deleteEntry(k)
 		c.evictions++
+		c.counters.addCache(counterEvictions, 1)
 
 		size--
 		if size == 0 {
@@ -102,74 +407,163 @@ func (c *cache) evictKeys() {
 	}
 }
 
-func (c *cache) set(key string, value []byte, expires int) {
+func (c *cacheShard) set(key string, value []byte, expires int) {
 	dlog("cache.set: %p k=%s v=%s ex=%d\n", c, key, value, expires)
 
 	c.Lock()
 	defer c.Unlock()
 
-	num := len(c.entries)
-	if num >= c.maxEntries {
-		c.evictKeys()
+	c.setLocked(key, cacheEntry{data: value, size: int64(len(key) + len(value))}, expires)
+}
+
+func (c *cacheShard) replaceSentinel(key string, value []byte, expires int) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.hasSentinel(key) {
+		return false
+	}
+
+	dlog("cache.set: %p k=%s v=%s ex=%d\n", c, key, value, expires)
+	c.setLocked(key, cacheEntry{data: value, size: int64(len(key) + len(value))}, expires)
+	return true
+}
+
+func (c *cacheShard) swapSentinel(key string) (cacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	old, ok := c.entries[key]
+	sentinel := []byte(cacheInProgressSentinel)
+	c.setLocked(key, cacheEntry{data: sentinel, size: int64(len(key) + len(sentinel))}, 30)
+	return old, ok
+}
+
+func (c *cacheShard) replaceSentinelValue(key string, value interface{}, size int, expires int) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.hasSentinel(key) {
+		return false
+	}
+
+	dlog("cache.set: %p k=%s v=%T ex=%d\n", c, key, value, expires)
+	c.setLocked(key, cacheEntry{value: value, size: int64(len(key) + size)}, expires)
+	return true
+}
+
+func (c *cacheShard) deleteSentinel(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.hasSentinel(key) {
+		dlog("cache.delete: %p k=%s\n", c, key)
+		c.remove(key)
+	}
+}
+
+func (c *cacheShard) setDelta(key string, d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	if ce, ok := c.entries[key]; ok {
+		ce.delta = d
+		c.entries[key] = ce
+	}
+}
+
+func (c *cacheShard) decoded(key string, data []byte) interface{} {
+	c.Lock()
+	defer c.Unlock()
+
+	if ce, ok := c.entries[key]; ok && sameBytes(ce.data, data) {
+		return ce.value
+	}
+
+	return nil
+}
+
+func (c *cacheShard) setDecoded(key string, data []byte, value interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	if ce, ok := c.entries[key]; ok && sameBytes(ce.data, data) {
+		ce.value = value
+		c.entries[key] = ce
+	}
+}
+
+// reports whether a and b are the same slice, not just equal
+func sameBytes(a, b []byte) bool {
+	return len(a) > 0 && len(a) == len(b) && &a[0] == &b[0]
+}
+
+// lock is held
+func (c *cacheShard) hasSentinel(key string) bool {
+	ce, ok := c.entries[key]
+	return ok && string(ce.data) == cacheInProgressSentinel
+}
+
+// lock is held
+func (c *cacheShard) setLocked(key string, ce cacheEntry, expires int) {
+	// an entry larger than the whole budget is never cached
+	if c.maxBytes > 0 && ce.size > c.maxBytes {
+		dlog("cache.reject: %p k=%s s=%d\n", c, key, ce.size)
+		c.remove(key)
+		c.rejections++
+		c.counters.addCache(counterRejections, 1)
+		return
 	}
 
-	ce := cacheEntry{
-		data: value,
+	if c.policy == nil {
+		for len(c.entries) > 0 && c.isFull(ce.size) {
+			c.evictRandom()
+		}
 	}
 
 	if expires > NoExpire {
 		ce.expires = nowFunc().Add(time.Second * time.Duration(expires))
 	}
 
+	old, exists := c.entries[key]
 	c.entries[key] = ce
+	c.bytes += ce.size - old.size
+
+	if c.policy != nil {
+		if !exists {
+			c.policy.Add(key)
+		}
+
+		c.evictKeys(key)
+	}
+
+	if c.bytes > c.peakBytes {
+		c.peakBytes = c.bytes
+	}
 }
 
-func (c *cache) getEntry(key string) (cacheEntry, bool) {
+func (c *cacheShard) getEntry(key string) (cacheEntry, bool) {
 	c.Lock()
 	ce, ok := c.entries[key]
+	c.access(key)
 	c.Unlock()
 
 	if ok {
 		dlog("cache.get.hit: %p k=%s\n", c, key)
 
 		atomic.AddUint64(&c.hits, 1)
+		c.counters.addCache(counterHits, 1)
 		return ce, ok
 	}
 
 	dlog("cache.get.miss: %p k=%s\n", c, key)
 	atomic.AddUint64(&c.misses, 1)
+	c.counters.addCache(counterMisses, 1)
 
 	return cacheEntry{}, ok
 }
 
-func (c *cache) get(key string) []byte {
-	ce, _ := c.getEntry(key)
-	return ce.data
-}
-
-func (c *cache) getm(keys ...string) []cacheEntry {
-	results := make([]cacheEntry, 0, len(keys))
-
-	c.Lock()
-	defer c.Unlock()
-
-	for _, k := range keys {
-		e, ok := c.entries[k]
-		if ok {
-			atomic.AddUint64(&c.hits, 1)
-			dlog("cache.getm.hit: %p k=%s\n", c, keys)
-		} else {
-			atomic.AddUint64(&c.misses, 1)
-			dlog("cache.getm.miss: %p k=%s\n", c, keys)
-		}
-
-		results = append(results, e)
-	}
-
-	return results
-}
-
-func (c *cache) evictExpired() {
+func (c *cacheShard) evictExpired() {
 	var keys []string
 
 	now := nowFunc()
@@ -185,13 +579,16 @@ func (c *cache) evictExpired() {
 		dlog("cache.expire: %p k=%s\n", c, keys)
 
 		atomic.AddUint64(&c.expired, uint64(len(keys)))
+		c.counters.addCache(counterExpired, uint64(len(keys)))
 		c.delete(keys...)
 	}
 }
 
-func (c *cache) stats() Stats {
+func (c *cacheShard) stats() Stats {
 	c.Lock()
 	num := len(c.entries)
+	bytes := c.bytes
+	peak := c.peakBytes
 	c.Unlock()
 
 	return Stats{
@@ -199,19 +596,44 @@ func (c *cache) stats() Stats {
 		Misses:     atomic.LoadUint64(&c.misses),
 		Expired:    atomic.LoadUint64(&c.expired),
 		Evictions:  atomic.LoadUint64(&c.evictions),
+		Rejections: atomic.LoadUint64(&c.rejections),
+		Flushes:    atomic.LoadUint64(&c.flushes),
 		NumEntries: num,
+		Bytes:      bytes,
+		PeakBytes:  peak,
 	}
 }
 
-func (c *cache) flush() {
+func (c *cacheShard) flush() {
 	c.Lock()
 	defer c.Unlock()
 
-	dlog("cache.flush: %p\n", c)
+	// the counters are read without the lock
+	atomic.StoreUint64(&c.hits, 0)
+	atomic.StoreUint64(&c.misses, 0)
+	atomic.StoreUint64(&c.expired, 0)
+	atomic.StoreUint64(&c.evictions, 0)
+	atomic.StoreUint64(&c.rejections, 0)
+	atomic.StoreUint64(&c.flushes, 0)
+	c.bytes = 0
+	c.peakBytes = 0
+	c.entries = map[string]cacheEntry{}
+	if c.policy != nil {
+		c.policy.Reset()
+	}
+}
+
+func (c *cacheShard) clear() {
+	c.Lock()
+	defer c.Unlock()
 
-	c.hits = 0
-	c.misses = 0
-	c.expired = 0
-	c.evictions = 0
+	c.bytes = 0
 	c.entries = map[string]cacheEntry{}
+	if c.policy != nil {
+		c.policy.Reset()
+	}
+}
+
+func (c *cacheShard) countFlush() {
+	atomic.AddUint64(&c.flushes, 1)
 }
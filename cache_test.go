@@ -3,32 +3,123 @@ package csc
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestCache_evict(t *testing.T) {
-	c := newCache(10)
+	c := newCache(10, 0, 1, nil)
 	for i := 0; i < 100; i++ {
 		c.set(fmt.Sprintf("key:%d", i), []byte("fooobar"), 60)
 	}
 
-	if c.evictions == 0 {
-		t.Fatalf("evictions: %d", c.evictions)
+	if c.stats().Evictions == 0 {
+		t.Fatalf("evictions: %d", c.stats().Evictions)
 	}
 
-	c2 := newCache(100)
+	c2 := newCache(100, 0, 1, nil)
 	for i := 0; i < 101; i++ {
 		c2.set(fmt.Sprintf("key:%d", i), []byte("fooobar"), 60)
 	}
 
-	if int(c2.evictions) != c2.evictSize() {
-		t.Fatalf("evictions: %d, evict size: %d", c2.evictions, c2.evictSize())
+	if int(c2.stats().Evictions) != c2.shards[0].evictSize() {
+		t.Fatalf("evictions: %d, evict size: %d", c2.stats().Evictions, c2.shards[0].evictSize())
+	}
+}
+
+func TestCache_evictLRU(t *testing.T) {
+	c := newCache(10, 0, 1, func(int) EvictionPolicy { return NewLRUPolicy() })
+	for i := 0; i < 10; i++ {
+		c.set(fmt.Sprintf("key:%d", i), []byte("fooobar"), 60)
+	}
+
+	// promote key:0 by a get and key:1 by a getm, key:2 is then the least recently used
+	c.get("key:0")
+	c.getm("key:1")
+
+	c.set("key:10", []byte("fooobar"), 60)
+	if c.stats().Evictions != 1 {
+		t.Fatalf("evictions: %d", c.stats().Evictions)
+	}
+
+	if _, ok := c.getEntry("key:2"); ok {
+		t.Fatal("key:2 not evicted")
+	}
+
+	for _, k := range []string{"key:0", "key:1", "key:10"} {
+		if _, ok := c.getEntry(k); !ok {
+			t.Fatalf("%s evicted", k)
+		}
+	}
+
+	// overwriting an existing key doesn't evict
+	c.set("key:3", []byte("barfoo"), 60)
+	if c.stats().Evictions != 1 {
+		t.Fatalf("evictions: %d", c.stats().Evictions)
+	}
+
+	if c.stats().NumEntries != 10 {
+		t.Fatalf("entries: %d", c.stats().NumEntries)
+	}
+
+	c.delete("key:3")
+	if n := len(c.shards[0].policy.(*lruPolicy).elems); n != 9 {
+		t.Fatalf("lru: %d", n)
+	}
+
+	c.flush()
+	if n := c.shards[0].policy.(*lruPolicy).ll.Len(); n != 0 {
+		t.Fatalf("lru: %d", n)
+	}
+}
+
+func TestCache_maxBytes(t *testing.T) {
+	policies := map[string]func(int) EvictionPolicy{
+		"random": nil,
+		"lru":    func(int) EvictionPolicy { return NewLRUPolicy() },
+	}
+
+	for name, policy := range policies {
+		// each entry is 5 + 10 bytes
+		c := newCache(0, 100, 1, policy)
+		for i := 0; i < 100; i++ {
+			c.set(fmt.Sprintf("key:%d", i%10), []byte("0123456789"), 60)
+		}
+
+		stats := c.stats()
+		if stats.Bytes > 100 || stats.Bytes != int64(stats.NumEntries*15) {
+			t.Fatalf("%s: bytes: %d, entries: %d", name, stats.Bytes, stats.NumEntries)
+		}
+
+		if stats.PeakBytes > 100 || stats.PeakBytes < 90 {
+			t.Fatalf("%s: peak bytes: %d", name, stats.PeakBytes)
+		}
+
+		if stats.Evictions == 0 {
+			t.Fatalf("%s: evictions: %d", name, stats.Evictions)
+		}
+
+		// values larger than the budget are never cached
+		c.set("key:large", make([]byte, 200), 60)
+		if _, ok := c.getEntry("key:large"); ok {
+			t.Fatalf("%s: large value cached", name)
+		}
+
+		c.delete("key:1", "key:2", "key:3", "key:4", "key:5", "key:6", "key:7", "key:8", "key:9")
+		if b := c.stats().Bytes; b != int64(c.stats().NumEntries*15) {
+			t.Fatalf("%s: bytes: %d", name, b)
+		}
+
+		c.flush()
+		if b := c.stats().Bytes; b != 0 {
+			t.Fatalf("%s: bytes: %d", name, b)
+		}
 	}
 }
 
 func TestCache_expired(t *testing.T) {
-	c := newCache(10)
+	c := newCache(10, 0, 1, nil)
 
 	pastNowFunc := func() time.Time {
 		return time.Now().Add(-time.Hour)
@@ -42,13 +133,13 @@ func TestCache_expired(t *testing.T) {
 	nowFunc = time.Now
 	c.evictExpired()
 
-	if c.expired != 10 {
-		t.Fatalf("expired: %d", c.expired)
+	if c.stats().Expired != 10 {
+		t.Fatalf("expired: %d", c.stats().Expired)
 	}
 }
 
 func TestCache_getset(t *testing.T) {
-	c := newCache(1000)
+	c := newCache(1000, 0, 1, nil)
 
 	key := "somekey"
 	value := "value123"
@@ -90,7 +181,7 @@ func TestCache_getset(t *testing.T) {
 }
 
 func TestCache_flush(t *testing.T) {
-	c := newCache(100)
+	c := newCache(100, 0, 1, nil)
 
 	value := "value123"
 	bvalue := []byte(value)
@@ -115,8 +206,37 @@ func TestCache_flush(t *testing.T) {
 	}
 }
 
+func TestCache_clear(t *testing.T) {
+	cnt := &counters{}
+	c := newCache(100, 0, 1, nil)
+	c.setCounters(cnt)
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		c.set(key, []byte("value"), 3600)
+		c.get(key)
+	}
+
+	c.invalidate(nil)
+
+	st := c.stats()
+	if st.NumEntries != 0 || st.Bytes != 0 {
+		t.Fatalf("cache not cleared: %+v", st)
+	}
+
+	// unlike flush, clearing keeps the stats
+	if st.Hits != 10 || st.Flushes != 1 || cnt.cacheCounter(counterFlushes) != 1 {
+		t.Fatalf("stats: %+v", st)
+	}
+
+	c.invalidate([]string{"key:0"})
+	if c.stats().Flushes != 1 {
+		t.FailNow()
+	}
+}
+
 func TestCache_delete(t *testing.T) {
-	c := newCache(100)
+	c := newCache(100, 0, 1, nil)
 
 	value := "value123"
 	bvalue := []byte(value)
@@ -140,3 +260,92 @@ func TestCache_delete(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestCache_shards(t *testing.T) {
+	c := newCache(1000, 0, 10, func(int) EvictionPolicy { return NewLRUPolicy() })
+	if len(c.shards) != 16 {
+		t.Fatalf("shards: %d", len(c.shards))
+	}
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 1000; i++ {
+				k := fmt.Sprintf("key:%d:%d", g, i)
+				c.set(k, []byte("foobar"), 60)
+				c.get(k)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	stats := c.stats()
+	if stats.NumEntries > 16*63 || stats.NumEntries < 900 {
+		t.Fatalf("entries: %d", stats.NumEntries)
+	}
+
+	if int(stats.Evictions) != 8000-stats.NumEntries {
+		t.Fatalf("evictions: %d, entries: %d", stats.Evictions, stats.NumEntries)
+	}
+
+	used := 0
+	for _, s := range c.shards {
+		if len(s.entries) > 0 {
+			used++
+		}
+	}
+
+	if used != 16 {
+		t.Fatalf("used shards: %d", used)
+	}
+
+	c.set("foo", []byte("bar"), 60)
+	c.delete("foo")
+	if _, ok := c.getEntry("foo"); ok {
+		t.Fatal("foo not deleted")
+	}
+
+	c.flush()
+	if n := c.stats().NumEntries; n != 0 {
+		t.Fatalf("entries: %d", n)
+	}
+}
+
+// compares a single lock, like before sharding, with sharded caches under concurrent reads with 10% writes
+func BenchmarkCache_parallel(b *testing.B) {
+	const numKeys = 10000
+
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+	}
+
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := newCache(numKeys, 0, shards, func(int) EvictionPolicy { return NewLRUPolicy() })
+			for _, k := range keys {
+				c.set(k, []byte("foobar"), 3600)
+			}
+
+			var seed uint32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// start each goroutine at a different key
+				i := int(atomic.AddUint32(&seed, 1)) * 1000
+				for pb.Next() {
+					k := keys[(i*7919)%numKeys]
+					if i%10 == 0 {
+						c.set(k, []byte("foobar"), 3600)
+					} else {
+						c.getEntry(k)
+					}
+
+					i++
+				}
+			})
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package csc
 
 import (
+	"context"
 	"errors"
 	"log"
 	"os"
@@ -36,16 +37,89 @@ type Client struct {
 	conn   redis.Conn
 	closed uint32
 	cache  *cache
-	iconn  redis.Conn
+	// the shared invalidation connection the client is registered with, nil in broadcasting and RESP3 mode
+	invalidator *invalidator
+	// stops the expiry watcher of the client's own cache, nil if the cache is the pool's
+	stopExpiry context.CancelFunc
+	// address of the server the client tracks keys on, set by TrackingPool
+	addr string
 }
 
+// CacheHint selects whether a read is cached, overriding the default of the tracking mode
+type CacheHint int
+
+const (
+	// CacheDefault caches unless the tracking mode is OPTIN
+	CacheDefault CacheHint = iota
+	// CacheYes caches, in OPTIN mode the read is tracked with CLIENT CACHING yes
+	CacheYes
+	// CacheNo doesn't cache, in OPTOUT mode the read isn't tracked thanks to CLIENT CACHING no
+	CacheNo
+)
+
 type Entry struct {
 	Data     []byte
 	Expires  time.Time
 	LocalHit bool
+	// the entry is within the last PoolOptions.StaleTTL seconds before Expires, GetOrLoad is refreshing it
+	Stale bool
+	// how long loading the value took, if it was loaded by this process
+	delta time.Duration
+	// the bytes of the value as held by the local cache, compressed with CompressionOptions.CacheCompressed
+	cached []byte
+}
+
+// do runs a command on the data connection, honouring the cancellation and deadline of ctx.
+// redigo closes the connection if ctx is done while waiting for the reply, a tracking client is then marked as closed
+// so it's discarded instead of put back into the pool
+func (c *Client) do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	defer func() {
+		c.pool.counts().roundTrips.observe(time.Since(start))
+	}()
+
+	if ctx.Done() == nil {
+		rpl, err := c.conn.Do(cmd, args...)
+		if err != nil {
+			c.checkConn()
+		}
+
+		return rpl, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	rpl, err := redis.DoContext(c.conn, ctx, cmd, args...)
+	if err != nil {
+		if cerr := contextError(ctx); cerr != nil {
+			dlog("client.do.canceled: %p c=%s err=%s\n", c, cmd, err.Error())
+			c.setClosed()
+			return nil, cerr
+		}
+
+		c.checkConn()
+	}
+
+	return rpl, err
 }
 
-func (c *Client) getEntry(key string) (Entry, error) {
+// returns the error of ctx if it's done. redigo uses the deadline as read timeout, which may expire before ctx
+// reports that it's done
+func contextError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if dl, ok := ctx.Deadline(); ok && !time.Now().Before(dl) {
+		return context.DeadlineExceeded
+	}
+
+	return nil
+}
+
+func (c *Client) getEntry(ctx context.Context, key string, hint CacheHint) (Entry, error) {
 	var empty Entry
 
 	if c.isClosed() {
@@ -55,57 +129,182 @@ func (c *Client) getEntry(key string) (Entry, error) {
 	key = c.prefixKey(key)
 	dlog("client.get: %p k=%s\n", c, key)
 
-	if ce, ok := c.cache.getEntry(key); ok && ce.data != nil && string(ce.data) != cacheInProgressSentinel {
-		return Entry{
-			Data:     ce.data,
-			Expires:  ce.expires,
-			LocalHit: true,
-		}, nil
+	if e, ok := c.localEntry(key); ok {
+		return e, nil
 	}
 
+	cache, caching := c.caching(key, hint)
 	cleanup := func() {
-		c.cache.delete(key)
-		c.conn.Do("DEL", key)
+		if !cache {
+			return
+		}
+
+		c.cache.deleteSentinel(key)
+
+		// the connection is unusable if the request was canceled
+		if contextError(ctx) == nil {
+			c.conn.Do("DEL", key)
+		}
+	}
+
+	if cache {
+		c.cache.set(key, []byte(cacheInProgressSentinel), 30)
 	}
 
-	c.cache.set(key, []byte(cacheInProgressSentinel), 30)
+	// CLIENT CACHING only applies to the next command, or transaction, so the TTL read is tracked like the GET
+	if caching != "" {
+		c.conn.Send("CLIENT", "CACHING", caching)
+	}
 
-	rpl, err := c.conn.Do("GET", key)
+	c.conn.Send("MULTI")
+	c.conn.Send("GET", key)
+	c.conn.Send("TTL", key)
+	replies, err := redis.Values(c.do(ctx, "EXEC"))
 	if err != nil {
 		cleanup()
 		return empty, err
 	}
 
-	data, err := redis.Bytes(rpl, err)
+	raw, err := redis.Bytes(replies[0], nil)
+	if err == redis.ErrNil {
+		// the key is missing, deleting it remotely could race with a concurrent set
+		if cache {
+			c.cache.deleteSentinel(key)
+		}
+
+		return empty, err
+	}
+
 	if err != nil {
 		cleanup()
 		return empty, err
 	}
 
-	expire, err := redis.Int(c.conn.Do("TTL", key))
+	// the value may have been written before compression was enabled, it's left alone in Redis
+	data, cached, err := c.decodeValue(raw)
+	if err != nil {
+		if cache {
+			c.cache.deleteSentinel(key)
+		}
+
+		return empty, err
+	}
+
+	expire, err := redis.Int(replies[1], nil)
 	if err != nil {
 		cleanup()
 		return empty, err
 	}
 
 	// only set to cache if we see the sentinel, if not, the key has been invalidated during processing
-	if string(c.cache.get(key)) == cacheInProgressSentinel {
-		c.cache.set(key, data, expire)
+	if cache {
+		c.cache.replaceSentinel(key, cached, expire)
 	}
 
+	expires := nowFunc().Add(time.Second * time.Duration(expire))
 	return Entry{
 		Data:     data,
-		Expires:  nowFunc().Add(time.Second * time.Duration(expire)),
+		Expires:  expires,
 		LocalHit: false,
+		Stale:    expire > NoExpire && c.isStale(expires),
+		cached:   cached,
 	}, nil
 }
 
+// reports whether a read of key, which is prefixed, with hint is cached locally and the CLIENT CACHING argument to
+// send before it, if any. in OPTIN mode only reads hinted with CacheYes are tracked and cached, in OPTOUT mode all
+// but those hinted with CacheNo. in the default mode the server tracks all reads so CacheNo only keeps the value out
+// of the local cache. broadcasting and cluster pools only cache the keys they're invalidated for
+func (c *Client) caching(key string, hint CacheHint) (bool, string) {
+	if bp, ok := c.pool.(*BroadcastingPool); ok {
+		return hint != CacheNo && !bp.isOutOfSync() && bp.tracks(key), ""
+	}
+
+	if cp, ok := c.pool.(*ClusterPool); ok {
+		return hint != CacheNo && cp.caches(key), ""
+	}
+
+	if _, ok := c.pool.(*TrackingPool); !ok {
+		return hint != CacheNo, ""
+	}
+
+	switch c.pool.Options().TrackingMode {
+	case TrackingOptIn:
+		if hint == CacheYes {
+			return true, "yes"
+		}
+
+		return false, ""
+	case TrackingOptOut:
+		if hint == CacheNo {
+			return false, "no"
+		}
+
+		return true, ""
+	default:
+		return hint != CacheNo, ""
+	}
+}
+
+// returns the locally cached entry of the prefixed key, false on a miss
+func (c *Client) localEntry(key string) (Entry, bool) {
+	ce, ok := c.cache.getEntry(key)
+	if !ok || ce.data == nil || string(ce.data) == cacheInProgressSentinel {
+		return Entry{}, false
+	}
+
+	data, err := c.cachedValue(ce.data)
+	if err != nil {
+		return Entry{}, false
+	}
+
+	return Entry{
+		Data:     data,
+		Expires:  ce.expires,
+		LocalHit: true,
+		Stale:    !ce.expires.IsZero() && c.isStale(ce.expires),
+		delta:    ce.delta,
+		cached:   ce.data,
+	}, true
+}
+
+// returns when a value expiring at expires goes stale
+func (c *Client) staleAt(expires time.Time) time.Time {
+	return expires.Add(-time.Second * time.Duration(c.pool.Options().StaleTTL))
+}
+
+func (c *Client) isStale(expires time.Time) bool {
+	return c.pool.Options().StaleTTL > 0 && !nowFunc().Before(c.staleAt(expires))
+}
+
 func (c *Client) GetEntry(key string) (Entry, error) {
-	return c.getEntry(key)
+	return c.getEntry(context.Background(), key, CacheDefault)
+}
+
+// GetEntryContext is like GetEntry but returns ctx's error if it's done before Redis replies
+func (c *Client) GetEntryContext(ctx context.Context, key string) (Entry, error) {
+	return c.getEntry(ctx, key, CacheDefault)
+}
+
+// GetEntryWithHint is like GetEntryContext but hint selects whether the value is cached and, in OPTIN and OPTOUT
+// tracking modes, tracked by the server
+func (c *Client) GetEntryWithHint(ctx context.Context, key string, hint CacheHint) (Entry, error) {
+	return c.getEntry(ctx, key, hint)
 }
 
 func (c *Client) Get(key string) ([]byte, error) {
-	e, err := c.getEntry(key)
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get but returns ctx's error if it's done before Redis replies
+func (c *Client) GetContext(ctx context.Context, key string) ([]byte, error) {
+	return c.GetWithHint(ctx, key, CacheDefault)
+}
+
+// GetWithHint is like GetContext but hint selects whether the value is cached and, in OPTIN and OPTOUT tracking
+// modes, tracked by the server
+func (c *Client) GetWithHint(ctx context.Context, key string, hint CacheHint) ([]byte, error) {
+	e, err := c.getEntry(ctx, key, hint)
 	if err != nil {
 		return nil, err
 	}
@@ -114,26 +313,36 @@ func (c *Client) Get(key string) ([]byte, error) {
 }
 
 func (c *Client) GetEntries(keys []string) ([]Entry, error) {
+	return c.GetEntriesContext(context.Background(), keys)
+}
+
+// GetEntriesContext is like GetEntries but returns ctx's error if it's done before Redis replies
+func (c *Client) GetEntriesContext(ctx context.Context, keys []string) ([]Entry, error) {
+	return c.GetEntriesWithHint(ctx, keys, CacheDefault)
+}
+
+// GetEntriesWithHint is like GetEntriesContext but hint selects whether the values are cached and, in OPTIN and
+// OPTOUT tracking modes, tracked by the server
+func (c *Client) GetEntriesWithHint(ctx context.Context, keys []string, hint CacheHint) ([]Entry, error) {
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+
 	dlog("client.getentries: %p k=%s\n", c, keys)
 	entries := make([]Entry, len(keys))
 
 	// fetch all that's in local cache and keep track of the missing ones
 	idxMap := make(map[string]int)
 	missing := make([]string, 0, len(keys))
-	results := c.cache.getm(keys...)
-	for i, ce := range results {
-		if ce.data == nil {
-			k := keys[i]
-			idxMap[k] = i
-			missing = append(missing, k)
+	for i, k := range keys {
+		k = c.prefixKey(k)
+		if e, ok := c.localEntry(k); ok {
+			entries[i] = e
 			continue
 		}
 
-		entries[i] = Entry{
-			Data:     ce.data,
-			Expires:  ce.expires,
-			LocalHit: true,
-		}
+		idxMap[k] = i
+		missing = append(missing, k)
 	}
 
 	if len(missing) == 0 {
@@ -142,17 +351,38 @@ func (c *Client) GetEntries(keys []string) ([]Entry, error) {
 
 	dlog("client.getentries.missing: %p k=%s\n", c, missing)
 
-	// fetch the missing keys in a single MGET
-	for _, k := range missing {
-		c.cache.set(k, []byte(cacheInProgressSentinel), 30)
+	// fetch the missing keys in a single MGET, the keys to cache are marked as in progress
+	var caching string
+	cached := make([]bool, len(missing))
+	sentinels := make([]string, 0, len(missing))
+	for i, k := range missing {
+		cached[i], caching = c.caching(k, hint)
+		if cached[i] {
+			c.cache.set(k, []byte(cacheInProgressSentinel), 30)
+			sentinels = append(sentinels, k)
+		}
 	}
 
 	cleanup := func() {
-		c.cache.delete(missing...)
-		c.conn.Do("DEL", redis.Args{}.AddFlat(missing)...)
+		if len(sentinels) == 0 {
+			return
+		}
+
+		for _, k := range sentinels {
+			c.cache.deleteSentinel(k)
+		}
+
+		// the connection is unusable if the request was canceled
+		if contextError(ctx) == nil {
+			c.conn.Do("DEL", redis.Args{}.AddFlat(sentinels)...)
+		}
 	}
 
-	rpl, err := c.conn.Do("MGET", redis.Args{}.AddFlat(missing)...)
+	if caching != "" {
+		c.conn.Send("CLIENT", "CACHING", caching)
+	}
+
+	rpl, err := c.do(ctx, "MGET", redis.Args{}.AddFlat(missing)...)
 	if err != nil {
 		cleanup()
 		return nil, err
@@ -164,36 +394,56 @@ func (c *Client) GetEntries(keys []string) ([]Entry, error) {
 		return nil, err
 	}
 
+	// CLIENT CACHING only applies to the next command, or transaction, so it's sent again for the TTL reads to be
+	// tracked like the MGET
+	if caching != "" {
+		c.conn.Send("CLIENT", "CACHING", caching)
+	}
+
 	c.conn.Send("MULTI")
 	for _, k := range missing {
 		c.conn.Send("TTL", k)
 	}
 
-	ttls, err := redis.Ints(c.conn.Do("EXEC"))
+	ttls, err := redis.Ints(c.do(ctx, "EXEC"))
 	if err != nil {
 		cleanup()
 		return nil, err
 	}
 
 	for i, k := range missing {
-		d := mres[i]
 		ttl := ttls[i]
+		d, cd, err := c.decodeValue(mres[i])
+		if err != nil {
+			// like in getEntry the value is left alone in Redis, only the sentinels of the remaining keys are deleted
+			for j := i; j < len(missing); j++ {
+				if cached[j] {
+					c.cache.deleteSentinel(missing[j])
+				}
+			}
+
+			return nil, err
+		}
 
 		if d == nil {
-			c.cache.delete(k)
+			if cached[i] {
+				c.cache.deleteSentinel(k)
+			}
+
 			continue
 		}
 
 		// only set to cache if we see the sentinel, if not, the key has been invalidated during processing
-		if string(c.cache.get(k)) == cacheInProgressSentinel {
-			c.cache.set(k, d, ttl)
+		if cached[i] {
+			c.cache.replaceSentinel(k, cd, ttl)
 		}
 
-		idx := idxMap[k]
-		entries[idx] = Entry{
+		expires := nowFunc().Add(time.Second * time.Duration(ttl))
+		entries[idxMap[k]] = Entry{
 			Data:     d,
-			Expires:  nowFunc().Add(time.Second * time.Duration(ttl)),
+			Expires:  expires,
 			LocalHit: false,
+			Stale:    ttl > NoExpire && c.isStale(expires),
 		}
 	}
 
@@ -201,6 +451,11 @@ func (c *Client) GetEntries(keys []string) ([]Entry, error) {
 }
 
 func (c *Client) Set(key string, value []byte, expires int) error {
+	return c.SetContext(context.Background(), key, value, expires)
+}
+
+// SetContext is like Set but returns ctx's error if it's done before Redis replies
+func (c *Client) SetContext(ctx context.Context, key string, value []byte, expires int) error {
 	if c.isClosed() {
 		return ErrClosed
 	}
@@ -208,14 +463,26 @@ func (c *Client) Set(key string, value []byte, expires int) error {
 	key = c.prefixKey(key)
 	dlog("client.set: %p k=%s v=%s\n", c, key, value)
 
-	if _, err := c.conn.Do("SETEX", key, expires, value); err != nil {
+	value, err := c.encodeValue(value)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.do(ctx, "SETEX", key, expires, value); err != nil {
 		return err
 	}
 
+	// the server doesn't invalidate keys for the client setting them with NOLOOP
+	c.cache.delete(key)
 	return nil
 }
 
 func (c *Client) Delete(keys ...string) error {
+	return c.DeleteContext(context.Background(), keys...)
+}
+
+// DeleteContext is like Delete but returns ctx's error if it's done before Redis replies
+func (c *Client) DeleteContext(ctx context.Context, keys ...string) error {
 	if c.isClosed() {
 		return ErrClosed
 	}
@@ -230,7 +497,7 @@ func (c *Client) Delete(keys ...string) error {
 	}
 
 	dlog("client.delete: %p k=%s\n", c, keys)
-	if _, err := c.conn.Do("DEL", redis.Args{}.AddFlat(keys)...); err != nil {
+	if _, err := c.do(ctx, "DEL", redis.Args{}.AddFlat(keys)...); err != nil {
 		return err
 	}
 
@@ -246,6 +513,22 @@ func (c *Client) Stats() Stats {
 	return c.cache.stats()
 }
 
+// closes the client if its connection failed. the server stops tracking the keys read on it, so the local cache of a
+// tracking client would miss their invalidations
+func (c *Client) checkConn() {
+	if err := c.conn.Err(); err != nil {
+		dlog("client.conn.failed: %p err=%s\n", c, err.Error())
+		c.setClosed()
+	}
+}
+
+// evicts the expired keys of the client's own cache in the background until stopExpiry is called
+func (c *Client) watchExpiry() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopExpiry = cancel
+	go expireWatcher(ctx, c.cache)
+}
+
 func (c *Client) setClosed() {
 	atomic.StoreUint32(&c.closed, 1)
 }
@@ -258,20 +541,8 @@ func (c *Client) Conn() redis.Conn {
 	return c.conn
 }
 
+// Close puts the client back into the pool, which discards it if it's closed, e.g. because it's out-of-sync
 func (c *Client) Close() error {
-	// if the client is closed/done, close the connections, otherwise put it back into the pool
-	if c.isClosed() {
-		if err := c.conn.Close(); err != nil {
-			return err
-		}
-
-		if err := c.iconn.Close(); err != nil {
-			return err
-		}
-
-		return nil
-	}
-
 	c.pool.put(c)
 	return nil
 }
@@ -1,15 +1,21 @@
 package csc
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"testing"
 	"time"
+
+	"github.com/gomodule/redigo/redis"
 )
 
 func TestClient(t *testing.T) {
 	key := "foo"
 
-	pool := NewTrackingPool(PoolOptions{RedisAddress: ":6379", MaxEntries: 10000})
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 10000})
 	c, err := pool.Get()
 	if err != nil {
 		t.Fatalf("failed to get client from pool: %v", err)
@@ -37,7 +43,7 @@ func TestClient_Set(t *testing.T) {
 	key := "foo"
 	value := "123456"
 
-	pool := NewTrackingPool(PoolOptions{RedisAddress: ":6379", MaxEntries: 10000})
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 10000})
 	c1, err := pool.Get()
 	if err != nil {
 		t.Fatalf("failed to get client from pool: %v", err)
@@ -86,11 +92,39 @@ func TestClient_Set(t *testing.T) {
 	time.Sleep(time.Millisecond * 100)
 }
 
+// sets key and waits for the pool to be invalidated by the write, which would otherwise drop the value cached by a
+// following read
+func broadcastSet(t *testing.T, pool interface{ Subscribe(func(Event)) func() }, c *Client, key string, value []byte) {
+	events := make(chan Event, 100)
+	unsubscribe := pool.Subscribe(func(e Event) {
+		events <- e
+	})
+	defer unsubscribe()
+
+	if err := c.Set(key, value, 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-events:
+			for _, k := range e.Keys {
+				if k == c.prefixKey(key) {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatalf("%s not invalidated", key)
+		}
+	}
+}
+
 func TestBroadcastingClient(t *testing.T) {
 	key := "foo"
 	value := "123456"
 
-	pool, _ := NewDefaultBroadcastingPool(PoolOptions{MaxEntries: 100, RedisAddress: ":6379"})
+	pool, _ := NewDefaultBroadcastingPool(PoolOptions{MaxEntries: 100, RedisAddress: redisAddress})
 
 	time.Sleep(time.Millisecond * 100)
 
@@ -103,9 +137,7 @@ func TestBroadcastingClient(t *testing.T) {
 		t.Fatalf("failed to get client from pool: %v", err)
 	}
 
-	if err := c1.Set(key, []byte(value), 60); err != nil {
-		t.Fatalf("failed to set: %v", err)
-	}
+	broadcastSet(t, pool, c1, key, []byte(value))
 
 	c2, err := pool.Get()
 	if err != nil {
@@ -150,7 +182,7 @@ func TestBroadcastingClient_prefix(t *testing.T) {
 	key := "foo"
 	value := "123456"
 
-	pool, _ := NewDefaultBroadcastingPool(PoolOptions{KeyPrefix: "__csc:", MaxEntries: 100, RedisAddress: ":6379"})
+	pool, _ := NewDefaultBroadcastingPool(PoolOptions{KeyPrefix: "__csc:", MaxEntries: 100, RedisAddress: redisAddress})
 
 	time.Sleep(time.Millisecond * 100)
 
@@ -163,9 +195,7 @@ func TestBroadcastingClient_prefix(t *testing.T) {
 		t.Fatalf("failed to get client from pool: %v", err)
 	}
 
-	if err := c1.Set(key, []byte(value), 60); err != nil {
-		t.Fatalf("failed to set: %v", err)
-	}
+	broadcastSet(t, pool, c1, key, []byte(value))
 
 	c2, err := pool.Get()
 	if err != nil {
@@ -210,7 +240,7 @@ func TestBroadcastingClient_GetEntries(t *testing.T) {
 	key := "foo"
 	value := "123456"
 
-	pool, _ := NewDefaultBroadcastingPool(PoolOptions{MaxEntries: 100, RedisAddress: ":6379"})
+	pool, _ := NewDefaultBroadcastingPool(PoolOptions{MaxEntries: 100, RedisAddress: redisAddress})
 
 	time.Sleep(time.Millisecond * 100)
 
@@ -251,3 +281,308 @@ func TestBroadcastingClient_GetEntries(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// a server that accepts connections but never replies
+func silentServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	return ln
+}
+
+func TestClient_GetContext(t *testing.T) {
+	ln := silentServer(t)
+	defer ln.Close()
+
+	conn, err := redis.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	pool := NewTrackingPool(PoolOptions{MaxEntries: 100})
+	c := &Client{pool: pool, conn: conn, cache: pool.options.newCache(nil)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// a done context fails before touching the connection
+	if _, err := c.GetContext(ctx, "foo"); err != context.Canceled {
+		t.Fatalf("err: %v", err)
+	}
+
+	if c.isClosed() {
+		t.Fatal("client closed")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if _, err := c.GetContext(ctx, "foo"); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+
+	// the sentinel is cleaned up and the client, whose connection is now unusable, is closed
+	if _, ok := c.cache.getEntry("foo"); ok {
+		t.Fatal("sentinel left in cache")
+	}
+
+	if !c.isClosed() {
+		t.Fatal("client not closed")
+	}
+
+	if _, err := c.Get("foo"); err != ErrClosed {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestClient_trackingModes(t *testing.T) {
+	key := "trackingmode"
+
+	for _, mode := range []TrackingMode{TrackingOptIn, TrackingOptOut} {
+		pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100, TrackingMode: mode})
+		c1, err := pool.Get()
+		if err != nil {
+			t.Fatalf("failed to get client from pool: %v", err)
+		}
+
+		c2, err := pool.Get()
+		if err != nil {
+			t.Fatalf("failed to get client from pool: %v", err)
+		}
+
+		if err := c2.Set(key, []byte("1"), 60); err != nil {
+			t.Fatalf("failed to set: %v", err)
+		}
+
+		// OPTIN caches only reads hinted with CacheYes, OPTOUT all but those hinted with CacheNo
+		if _, err := c1.Get(key); err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+
+		if n := c1.Stats().NumEntries; (n == 1) != (mode == TrackingOptOut) {
+			t.Fatalf("mode %d: entries: %d", mode, n)
+		}
+
+		c1.Flush()
+		if _, err := c1.GetWithHint(context.Background(), key, CacheNo); err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+
+		if n := c1.Stats().NumEntries; n != 0 {
+			t.Fatalf("mode %d: entries: %d", mode, n)
+		}
+
+		if _, err := c1.GetWithHint(context.Background(), key, CacheYes); err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+
+		if n := c1.Stats().NumEntries; n != 1 {
+			t.Fatalf("mode %d: entries: %d", mode, n)
+		}
+
+		// the cached read is tracked
+		if err := c2.Set(key, []byte("2"), 60); err != nil {
+			t.Fatalf("failed to set: %v", err)
+		}
+
+		for i := 0; i < 100 && c1.Stats().NumEntries != 0; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		if v, err := c1.GetWithHint(context.Background(), key, CacheYes); err != nil || string(v) != "2" {
+			t.Fatalf("mode %d: v: %s, err: %v", mode, v, err)
+		}
+
+		c2.Delete(key)
+		pool.Close()
+	}
+}
+
+func TestClient_optInHints(t *testing.T) {
+	keys := []string{"optin:mget:1", "optin:mget:2"}
+	loaded := "optin:load"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100, TrackingMode: TrackingOptIn})
+	defer pool.Close()
+
+	c1, _ := pool.Get()
+	defer c1.Close()
+	c2, _ := pool.Get()
+	defer c2.Close()
+	defer c2.Delete(append(keys, loaded)...)
+
+	for _, k := range append(keys, loaded) {
+		c2.Set(k, []byte("1"), 60)
+	}
+
+	ctx := context.Background()
+	if _, err := c1.GetEntries(keys); err != nil {
+		t.Fatalf("failed to get entries: %v", err)
+	}
+
+	if n := c1.Stats().NumEntries; n != 0 {
+		t.Fatalf("entries: %d", n)
+	}
+
+	// MGET and GetOrLoad hinted with CacheYes are cached and tracked
+	if _, err := c1.GetEntriesWithHint(ctx, keys, CacheYes); err != nil {
+		t.Fatalf("failed to get entries: %v", err)
+	}
+
+	v, err := c1.GetOrLoadWithHint(ctx, loaded, 60, func() ([]byte, error) { return nil, errors.New("loaded") }, CacheYes)
+	if err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	if n := c1.Stats().NumEntries; n != 3 {
+		t.Fatalf("entries: %d", n)
+	}
+
+	c2.Set(keys[0], []byte("2"), 60)
+	c2.Set(loaded, []byte("2"), 60)
+	waitInvalidated(c1, c1.prefixKey(keys[0]))
+	waitInvalidated(c1, c1.prefixKey(loaded))
+
+	if n := c1.Stats().NumEntries; n != 1 {
+		t.Fatalf("entries: %d", n)
+	}
+
+	es, err := c1.GetEntriesWithHint(ctx, keys, CacheYes)
+	if err != nil || string(es[0].Data) != "2" || es[0].LocalHit || !es[1].LocalHit {
+		t.Fatalf("entries: %+v, err: %v", es, err)
+	}
+}
+
+func TestClient_optOutCacheNo(t *testing.T) {
+	key, marker := "optout:cacheno", "optout:marker"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100, TrackingMode: TrackingOptOut})
+	defer pool.Close()
+
+	events := make(chan Event, 10)
+	pool.Subscribe(func(e Event) {
+		events <- e
+	})
+
+	c1, _ := pool.Get()
+	defer c1.Close()
+	c2, _ := pool.Get()
+	defer c2.Close()
+
+	c2.Set(key, []byte("1"), 60)
+	c2.Set(marker, []byte("1"), 60)
+
+	// neither the value nor the ttl of a read hinted with CacheNo is tracked
+	if _, err := c1.GetWithHint(context.Background(), key, CacheNo); err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+
+	if _, err := c1.Get(marker); err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+
+	c2.Set(key, []byte("2"), 60)
+	c2.Set(marker, []byte("2"), 60)
+
+	// invalidations arrive in order, the marker's comes after the key's would
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case e := <-events:
+			for _, k := range e.Keys {
+				if k == key {
+					t.Fatal("untracked read invalidated")
+				}
+
+				if k == marker {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatal("marker not invalidated")
+		}
+	}
+}
+
+func TestBroadcastingClient_trackPrefixes(t *testing.T) {
+	pool, err := NewDefaultBroadcastingPool(PoolOptions{
+		MaxEntries:    100,
+		RedisAddress:  redisAddress,
+		KeyPrefix:     "app:",
+		TrackPrefixes: []string{"app:user:", "app:cfg:"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	c, _ := pool.Get()
+	defer c.Close()
+
+	keys := []string{"user:1", "cfg:a", "other:1"}
+	for _, k := range keys[:2] {
+		broadcastSet(t, pool, c, k, []byte("1"))
+	}
+
+	// other:1 isn't under a tracked prefix, no invalidation is sent for it
+	if err := c.Set("other:1", []byte("1"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	// only keys under a tracked prefix are cached
+	entries, err := c.GetEntries(keys)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("entries: %v, err: %v", entries, err)
+	}
+
+	for _, e := range entries {
+		if string(e.Data) != "1" {
+			t.Fatalf("entry: %+v", e)
+		}
+	}
+
+	if _, err := c.Get("other:1"); err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+
+	if n := c.Stats().NumEntries; n != 2 {
+		t.Fatalf("entries: %d", n)
+	}
+
+	for _, k := range []string{"app:user:1", "app:cfg:a"} {
+		if _, ok := c.cache.getEntry(k); !ok {
+			t.Fatalf("%s not cached", k)
+		}
+	}
+
+	// tracked keys are invalidated
+	if err := c.Set("user:1", []byte("2"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, ok := c.cache.getEntry("app:user:1"); !ok {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if v, err := c.Get("user:1"); err != nil || string(v) != "2" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	c.Delete(keys...)
+}
@@ -0,0 +1,653 @@
+package csc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// number of hash slots of a Redis Cluster
+const numSlots = 16384
+
+const defaultClusterRefreshInterval = time.Second * 10
+
+var errNoClusterNode = errors.New("no cluster node serves the slot")
+
+// ClusterPool is a pool of clients of a Redis Cluster sharing a local cache, like a BroadcastingPool. Every master
+// tracks all keys, or those under TrackPrefixes, and redirects their invalidations to a subscribed connection of the
+// pool. Clients route commands by hash slot, follow MOVED and ASK redirections and split multi-key commands by slot.
+// The slots are refreshed periodically and on MOVED, the local entries of slots that changed node, or whose node
+// failed, are deleted.
+type ClusterPool struct {
+	options  PoolOptions
+	cache    *cache
+	counters counters
+	events   subscribers
+	closed   uint32
+	done     chan struct{}
+	// requests a refresh of the slots
+	refreshCh chan struct{}
+	// serializes refreshes
+	refreshMu sync.Mutex
+	// closed once a refresh started after it was created completed, guarded by mu
+	refreshed chan struct{}
+
+	mu    sync.RWMutex
+	nodes map[string]*clusterNode
+	slots [numSlots]*clusterNode
+}
+
+// clusterNode is a master of a cluster, its keys are out-of-sync once it failed
+type clusterNode struct {
+	addr string
+	// connections of clients
+	pool *redis.Pool
+	// the tracking connection redirecting invalidations to iconn
+	conn     redis.Conn
+	iconn    redis.Conn
+	received chan struct{}
+	// stops the health checks of conn, pinged is closed once they returned
+	stop   chan struct{}
+	pinged chan struct{}
+	failed uint32
+	closed uint32
+}
+
+// NewClusterPool discovers the slots of the cluster from ClusterAddresses, or RedisAddress, and enables tracking on
+// its masters. RedisDatabase must be 0.
+func NewClusterPool(opts PoolOptions) (*ClusterPool, error) {
+	if opts.RedisDatabase != 0 {
+		return nil, fmt.Errorf("redis cluster only has database 0, not %d", opts.RedisDatabase)
+	}
+
+	p := &ClusterPool{
+		options:   opts,
+		done:      make(chan struct{}),
+		refreshCh: make(chan struct{}, 1),
+		refreshed: make(chan struct{}),
+		nodes:     map[string]*clusterNode{},
+	}
+	p.cache = opts.newCache(&p.counters)
+
+	if err := p.refresh(); err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	go expireWatcher(context.Background(), p.cache)
+	go func() {
+		ticker := time.NewTicker(p.options.clusterRefreshInterval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+			case <-p.refreshCh:
+			}
+
+			if err := p.refresh(); err != nil {
+				Logger.Println("failed to refresh cluster slots:", err.Error())
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+func (p *ClusterPool) Get() (*Client, error) {
+	return p.GetContext(context.Background())
+}
+
+// GetContext returns a client, its connections are taken from the node pools when first used, waiting for them until
+// the context of the command is done
+func (p *ClusterPool) GetContext(ctx context.Context) (*Client, error) {
+	if p.isClosed() {
+		return nil, ErrClosed
+	}
+
+	c := &Client{
+		pool:  p,
+		conn:  &clusterConn{pool: p, conns: map[string]redis.Conn{}},
+		cache: p.cache,
+	}
+
+	return c, nil
+}
+
+func (p *ClusterPool) Close() error {
+	dlog("cpool.close: %p\n", p)
+
+	if atomic.SwapUint32(&p.closed, 1) == 1 {
+		return nil
+	}
+
+	close(p.done)
+
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+
+	p.mu.Lock()
+	nodes := p.nodes
+	p.nodes = map[string]*clusterNode{}
+	p.slots = [numSlots]*clusterNode{}
+	p.mu.Unlock()
+
+	for _, n := range nodes {
+		n.close()
+	}
+
+	p.cache.flush()
+	return nil
+}
+
+func (p *ClusterPool) isClosed() bool {
+	return atomic.LoadUint32(&p.closed) == 1
+}
+
+func (p *ClusterPool) put(c *Client) {
+	dlog("cpool.put: %p\n", p)
+
+	// returns the connections to the node pools
+	c.conn.Close()
+}
+
+func (p *ClusterPool) Flush() {
+	p.cache.flush()
+}
+
+func (p *ClusterPool) Options() *PoolOptions {
+	return &p.options
+}
+
+func (p *ClusterPool) counts() *counters {
+	return &p.counters
+}
+
+// Subscribe calls fn with the invalidation events of the pool until the returned function is called. fn is called
+// on the goroutines receiving invalidations, so it must be quick and mustn't block
+func (p *ClusterPool) Subscribe(fn func(Event)) func() {
+	return p.events.subscribe(fn)
+}
+
+func (p *ClusterPool) Stats() Stats {
+	return p.cache.stats()
+}
+
+// PoolStats returns the summed stats of the node pools, the tracking and invalidation connections aren't counted
+func (p *ClusterPool) PoolStats() PoolStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var st PoolStats
+	for _, n := range p.nodes {
+		ns := n.pool.Stats()
+		st.Active += ns.ActiveCount
+		st.Idle += ns.IdleCount
+		st.Waited += uint64(ns.WaitCount)
+		st.WaitDuration += ns.WaitDuration
+	}
+
+	return st
+}
+
+// reports whether key is cached, its node must be in sync
+func (p *ClusterPool) caches(key string) bool {
+	n := p.slotNode(keySlot(key))
+	return n != nil && !n.isFailed() && p.options.tracks(key)
+}
+
+func (p *ClusterPool) slotNode(slot int) *clusterNode {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.slots[slot]
+}
+
+// returns the node serving addr. if it's unknown, e.g. after a MOVED to a new master, a refresh of the slots is
+// requested and waited for until ctx is done
+func (p *ClusterPool) node(ctx context.Context, addr string) (*clusterNode, error) {
+	p.mu.RLock()
+	n := p.nodes[addr]
+	refreshed := p.refreshed
+	p.mu.RUnlock()
+
+	if n != nil {
+		return n, nil
+	}
+
+	p.requestRefresh()
+	select {
+	case <-refreshed:
+	case <-p.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if n := p.nodes[addr]; n != nil {
+		return n, nil
+	}
+
+	return nil, fmt.Errorf("unknown cluster node %s", addr)
+}
+
+// returns the address of any node, for commands without keys
+func (p *ClusterPool) anyAddr() (string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for addr := range p.nodes {
+		return addr, nil
+	}
+
+	return "", errNoClusterNode
+}
+
+// returns the address of the node serving slot
+func (p *ClusterPool) slotAddr(slot int) (string, error) {
+	if n := p.slotNode(slot); n != nil {
+		return n.addr, nil
+	}
+
+	return "", errNoClusterNode
+}
+
+// called when Redis replied MOVED, slot is served by addr from now on
+func (p *ClusterPool) moved(slot int, addr string) {
+	dlog("cpool.moved: %p s=%d a=%s\n", p, slot, addr)
+
+	p.mu.Lock()
+	if n := p.nodes[addr]; n != nil && p.slots[slot] != n {
+		p.slots[slot] = n
+		p.mu.Unlock()
+
+		p.deleteSlots(func(s int) bool { return s == slot })
+	} else {
+		p.mu.Unlock()
+	}
+
+	p.requestRefresh()
+}
+
+func (p *ClusterPool) requestRefresh() {
+	select {
+	case p.refreshCh <- struct{}{}:
+	default:
+	}
+}
+
+// deletes the local entries of the slots matching fn
+func (p *ClusterPool) deleteSlots(fn func(slot int) bool) {
+	p.cache.deleteFunc(func(key string) bool {
+		return fn(keySlot(key))
+	})
+}
+
+// reloads the slots with CLUSTER SLOTS, sets up tracking on new masters and replaces failed ones. the replaced nodes
+// are closed once refreshMu is released
+func (p *ClusterPool) refresh() error {
+	replaced, err := p.reload()
+	for _, n := range replaced {
+		n.close()
+	}
+
+	return err
+}
+
+// see refresh, returns the replaced nodes
+func (p *ClusterPool) reload() ([]*clusterNode, error) {
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+
+	// the nodes waited for by node are known once this refresh completed, even if it failed
+	p.mu.Lock()
+	refreshed := p.refreshed
+	p.refreshed = make(chan struct{})
+	p.mu.Unlock()
+	defer close(refreshed)
+
+	if p.isClosed() {
+		return nil, ErrClosed
+	}
+
+	ranges, err := p.fetchSlots()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.RLock()
+	oldNodes := p.nodes
+	oldSlots := p.slots
+	p.mu.RUnlock()
+
+	nodes := map[string]*clusterNode{}
+	var slots [numSlots]*clusterNode
+	for _, r := range ranges {
+		n, ok := nodes[r.addr]
+		if !ok {
+			if on := oldNodes[r.addr]; on != nil && !on.isFailed() {
+				n = on
+			} else {
+				n = p.dialNode(r.addr)
+				if on != nil && !n.isFailed() {
+					atomic.AddUint64(&p.counters.reconnects, 1)
+					p.events.emit(Event{Type: EventInSync})
+				}
+			}
+
+			nodes[r.addr] = n
+		}
+
+		for slot := r.start; slot <= r.end && slot < numSlots; slot++ {
+			slots[slot] = n
+		}
+	}
+
+	p.mu.Lock()
+	p.nodes = nodes
+	p.slots = slots
+	p.mu.Unlock()
+
+	// invalidations of the keys of slots served by another node may have been missed
+	var changed [numSlots]bool
+	numChanged := 0
+	for slot := range slots {
+		if slots[slot] != oldSlots[slot] && oldSlots[slot] != nil {
+			changed[slot] = true
+			numChanged++
+		}
+	}
+
+	if numChanged > 0 {
+		dlog("cpool.refresh.changed: %p n=%d\n", p, numChanged)
+		p.deleteSlots(func(slot int) bool { return changed[slot] })
+	}
+
+	var replaced []*clusterNode
+	for addr, on := range oldNodes {
+		if nodes[addr] != on {
+			replaced = append(replaced, on)
+		}
+	}
+
+	return replaced, nil
+}
+
+type slotRange struct {
+	start, end int
+	addr       string
+}
+
+// returns the slots of the masters, asking the known nodes and then the configured addresses
+func (p *ClusterPool) fetchSlots() ([]slotRange, error) {
+	p.mu.RLock()
+	addrs := make([]string, 0, len(p.nodes)+len(p.options.ClusterAddresses)+1)
+	for addr := range p.nodes {
+		addrs = append(addrs, addr)
+	}
+	p.mu.RUnlock()
+
+	addrs = append(addrs, p.options.ClusterAddresses...)
+	if p.options.RedisAddress != "" {
+		addrs = append(addrs, p.options.RedisAddress)
+	}
+
+	err := errNoClusterNode
+	for _, addr := range addrs {
+		var ranges []slotRange
+		if ranges, err = clusterSlots(addr); err == nil {
+			return ranges, nil
+		}
+
+		dlog("cpool.slots.fail: %p a=%s err=%s\n", p, addr, err.Error())
+	}
+
+	return nil, err
+}
+
+func clusterSlots(addr string) ([]slotRange, error) {
+	conn, err := redis.Dial("tcp", addr, redis.DialConnectTimeout(setupTimeout), redis.DialReadTimeout(setupTimeout),
+		redis.DialWriteTimeout(setupTimeout))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	reply, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	ranges := make([]slotRange, 0, len(reply))
+	for _, r := range reply {
+		values, err := redis.Values(r, nil)
+		if err != nil || len(values) < 3 {
+			return nil, fmt.Errorf("invalid cluster slots reply: %v", r)
+		}
+
+		start, err1 := redis.Int(values[0], nil)
+		end, err2 := redis.Int(values[1], nil)
+		master, err3 := redis.Values(values[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(master) < 2 {
+			return nil, fmt.Errorf("invalid cluster slots reply: %v", r)
+		}
+
+		// an empty host is the host the reply was received from
+		mhost, _ := redis.String(master[0], nil)
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster slots reply: %v", r)
+		}
+
+		if mhost == "" || mhost == "?" {
+			mhost = host
+		}
+
+		ranges = append(ranges, slotRange{start, end, net.JoinHostPort(mhost, strconv.Itoa(port))})
+	}
+
+	return ranges, nil
+}
+
+// creates a node and sets up its tracking, a node failing to do so is returned failed and replaced on the next
+// refresh
+func (p *ClusterPool) dialNode(addr string) *clusterNode {
+	opts := &p.options
+	n := &clusterNode{
+		addr: addr,
+		pool: &redis.Pool{
+			MaxIdle:     opts.MaxIdle,
+			MaxActive:   opts.MaxActive,
+			IdleTimeout: opts.IdleTimeout,
+			Wait:        opts.Wait,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr, redis.DialConnectTimeout(setupTimeout))
+			},
+			TestOnBorrow: func(c redis.Conn, t time.Time) error {
+				if time.Since(t) < time.Second {
+					return nil
+				}
+
+				_, err := c.Do("PING")
+				return err
+			},
+		},
+	}
+
+	if err := p.setupNode(n); err != nil {
+		Logger.Println("failed to set up tracking on cluster node", addr+":", err.Error())
+		atomic.StoreUint32(&n.failed, 1)
+	}
+
+	return n
+}
+
+// sets up the tracking of n on connections dialed outside of its pool, so that they don't count against MaxActive.
+// commands of the tracking connection time out, the invalidation connection only times out while it's set up
+func (p *ClusterPool) setupNode(n *clusterNode) error {
+	dlog("cpool.node.setup: %p a=%s\n", p, n.addr)
+
+	conn, err := redis.Dial("tcp", n.addr, redis.DialConnectTimeout(setupTimeout),
+		redis.DialReadTimeout(setupTimeout), redis.DialWriteTimeout(setupTimeout))
+	if err != nil {
+		return err
+	}
+
+	iconn, err := redis.Dial("tcp", n.addr, redis.DialConnectTimeout(setupTimeout), redis.DialWriteTimeout(setupTimeout))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	conn = p.options.wrapConn(conn, ConnTracking)
+	iconn = p.options.wrapConn(iconn, ConnInvalidation)
+	if err := enableBroadcastTracking(conn, iconn, p.options.trackPrefixes()); err != nil {
+		conn.Close()
+		iconn.Close()
+		return err
+	}
+
+	n.conn, n.iconn = conn, iconn
+
+	// ping the redirecting conn periodically as a healthcheck
+	n.stop = make(chan struct{})
+	n.pinged = make(chan struct{})
+	go func(conn redis.Conn) {
+		defer close(n.pinged)
+
+		ticker := time.NewTicker(p.options.healthCheckInterval())
+		defer ticker.Stop()
+
+		fails := 0
+		for {
+			if fails >= 5 {
+				Logger.Println("cluster node tracking connection failed, keys out-of-sync:", n.addr)
+				p.nodeFailed(n)
+				return
+			}
+
+			select {
+			case <-n.stop:
+				return
+			case <-ticker.C:
+			}
+
+			if _, err := conn.Do("PING"); err != nil {
+				fails++
+				dlog("cpool.node.pingfail: %p a=%s err=%s\n", p, n.addr, err.Error())
+				continue
+			}
+
+			fails = 0
+		}
+	}(n.conn)
+
+	received := make(chan struct{})
+	n.received = received
+	go func(conn redis.Conn) {
+		defer close(received)
+
+		// the connection fails once the node is closed
+		if err := receiveInvalidations(conn, p.invalidate); err != nil && !n.isClosed() {
+			Logger.Println("cluster node invalidation connection failed, keys out-of-sync:", n.addr)
+			p.nodeFailed(n)
+		}
+	}(n.iconn)
+
+	return nil
+}
+
+func (p *ClusterPool) invalidate(keys []string) {
+	dlog("cpool.invalidating: %p k=%s\n", p, keys)
+	atomic.AddUint64(&p.counters.invalidations, 1)
+	p.cache.invalidate(keys)
+	p.events.invalidated(keys)
+}
+
+// deletes the local entries of a failed node's slots, which aren't cached until the node is replaced
+func (p *ClusterPool) nodeFailed(n *clusterNode) {
+	if n.isClosed() || !atomic.CompareAndSwapUint32(&n.failed, 0, 1) {
+		return
+	}
+
+	atomic.AddUint64(&p.counters.outOfSync, 1)
+	p.events.emit(Event{Type: EventOutOfSync})
+
+	var owned [numSlots]bool
+	p.mu.RLock()
+	for slot, sn := range p.slots {
+		owned[slot] = sn == n
+	}
+	p.mu.RUnlock()
+
+	p.deleteSlots(func(slot int) bool { return owned[slot] })
+	p.requestRefresh()
+}
+
+func (n *clusterNode) isFailed() bool {
+	return atomic.LoadUint32(&n.failed) == 1
+}
+
+func (n *clusterNode) isClosed() bool {
+	return atomic.LoadUint32(&n.closed) == 1
+}
+
+// closes the connections of the node and waits for their goroutines to return, see
+// BroadcastingPool.closeConnections
+func (n *clusterNode) close() {
+	dlog("cpool.node.close: %p a=%s\n", n, n.addr)
+
+	atomic.StoreUint32(&n.closed, 1)
+	if n.stop != nil {
+		close(n.stop)
+		<-n.pinged
+
+		n.conn.Close()
+		n.iconn.Close()
+		<-n.received
+	}
+
+	n.pool.Close()
+}
+
+// returns the hash slot of key, only the part within the first {} is hashed if it's not empty
+func keySlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+
+	return int(crc16(key) % numSlots)
+}
+
+// CRC16 XMODEM, as used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
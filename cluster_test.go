@@ -0,0 +1,388 @@
+package csc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Jahaja/csc/redistest"
+	"github.com/gomodule/redigo/redis"
+)
+
+func newTestCluster(t *testing.T, opts PoolOptions) (*redistest.Cluster, *ClusterPool) {
+	t.Helper()
+
+	cluster, err := redistest.NewCluster(3)
+	if err != nil {
+		t.Fatalf("failed to start cluster: %v", err)
+	}
+
+	opts.ClusterAddresses = cluster.Addrs()[:1]
+	if opts.MaxEntries == 0 {
+		opts.MaxEntries = 100
+	}
+
+	pool, err := NewClusterPool(opts)
+	if err != nil {
+		cluster.Close()
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	return cluster, pool
+}
+
+// returns a key of a slot owned by the i:th server
+func clusterKey(cluster *redistest.Cluster, prefix string, i int) string {
+	for n := 0; ; n++ {
+		key := fmt.Sprintf("%s%d", prefix, n)
+		if cluster.Owner(redistest.Slot(key)) == i {
+			return key
+		}
+	}
+}
+
+// runs fn and waits for the pool to receive n invalidations of key, which would otherwise drop the values cached by
+// following reads
+func waitInvalidations(t *testing.T, pool *ClusterPool, key string, n int, fn func()) {
+	t.Helper()
+
+	events := make(chan Event, 100)
+	unsubscribe := pool.Subscribe(func(e Event) {
+		events <- e
+	})
+	defer unsubscribe()
+
+	fn()
+
+	timeout := time.After(time.Second)
+	for n > 0 {
+		select {
+		case e := <-events:
+			for _, k := range e.Keys {
+				if k == key {
+					n--
+				}
+			}
+		case <-timeout:
+			t.Fatalf("%s not invalidated", key)
+		}
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	for _, key := range []string{"123456789", "foo", "{user1000}.following", "{}foo", "foo{}{bar}", ""} {
+		if s := keySlot(key); s != redistest.Slot(key) {
+			t.Fatalf("key: %s, slot: %d", key, s)
+		}
+	}
+
+	if s := keySlot("123456789"); s != 12739 {
+		t.Fatalf("slot: %d", s)
+	}
+
+	if keySlot("{user1000}.following") != keySlot("{user1000}.followers") {
+		t.Fatal("hash tags differ")
+	}
+}
+
+func TestClusterPool(t *testing.T) {
+	cluster, pool := newTestCluster(t, PoolOptions{})
+	defer cluster.Close()
+	defer pool.Close()
+
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c.Close()
+
+	keys := make([]string, 3)
+	for i := range keys {
+		keys[i] = clusterKey(cluster, "cluster:", i)
+		broadcastSet(t, pool, c, keys[i], []byte(keys[i]))
+
+		// the key is stored by the server owning its slot
+		if v, ok := cluster.Server(i).Get(keys[i]); !ok || string(v) != keys[i] {
+			t.Fatalf("v: %s, ok: %v", v, ok)
+		}
+	}
+
+	entries, err := c.GetEntries(append(keys, "cluster:missing"))
+	if err != nil {
+		t.Fatalf("failed to get entries: %v", err)
+	}
+
+	for i, k := range keys {
+		if string(entries[i].Data) != k || entries[i].LocalHit || entries[i].Expires.IsZero() {
+			t.Fatalf("entry: %+v", entries[i])
+		}
+	}
+
+	if !entries[3].Miss() {
+		t.Fatalf("entry: %+v", entries[3])
+	}
+
+	for _, k := range keys {
+		if e, err := c.GetEntry(k); err != nil || !e.LocalHit {
+			t.Fatalf("e: %+v, err: %v", e, err)
+		}
+	}
+
+	// every master invalidates its keys
+	for i, k := range keys {
+		cluster.Server(i).Set(k, []byte("new"))
+		waitInvalidated(c, k)
+
+		if v, err := c.Get(k); err != nil || string(v) != "new" {
+			t.Fatalf("v: %s, err: %v", v, err)
+		}
+	}
+
+	if err := c.Delete(keys...); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+
+	for i, k := range keys {
+		if _, ok := cluster.Server(i).Get(k); ok {
+			t.Fatalf("not deleted: %s", k)
+		}
+
+		if _, err := c.Get(k); err != redis.ErrNil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestClusterPool_database(t *testing.T) {
+	cluster, err := redistest.NewCluster(3)
+	if err != nil {
+		t.Fatalf("failed to start cluster: %v", err)
+	}
+	defer cluster.Close()
+
+	pool, err := NewClusterPool(PoolOptions{ClusterAddresses: cluster.Addrs(), MaxEntries: 100, RedisDatabase: 1})
+	if err == nil {
+		pool.Close()
+		t.Fatal("database not rejected")
+	}
+}
+
+func TestClusterPool_maxActive(t *testing.T) {
+	// the tracking and invalidation connections aren't taken from the node pools
+	cluster, pool := newTestCluster(t, PoolOptions{MaxActive: 1, Wait: true})
+	defer cluster.Close()
+	defer pool.Close()
+
+	c, _ := pool.Get()
+	defer c.Close()
+
+	key := clusterKey(cluster, "maxactive:", 0)
+	broadcastSet(t, pool, c, key, []byte("1"))
+
+	if _, err := c.Get(key); err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+
+	if e, err := c.GetEntry(key); err != nil || !e.LocalHit {
+		t.Fatalf("e: %+v, err: %v", e, err)
+	}
+
+	if st := pool.PoolStats(); st.Active != 1 {
+		t.Fatalf("stats: %+v", st)
+	}
+}
+
+func TestClusterPool_moved(t *testing.T) {
+	cluster, pool := newTestCluster(t, PoolOptions{})
+	defer cluster.Close()
+	defer pool.Close()
+
+	c, _ := pool.Get()
+	defer c.Close()
+
+	key := clusterKey(cluster, "moved:", 0)
+	slot := redistest.Slot(key)
+	broadcastSet(t, pool, c, key, []byte("1"))
+
+	if _, err := c.Get(key); err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+
+	// resharding deletes the key from the previous owner and adds it to the new one, invalidating it on both
+	waitInvalidations(t, pool, key, 2, func() {
+		cluster.MoveSlot(slot, 1)
+	})
+
+	// the client follows MOVED, the entries of the slot are deleted so the redirected read isn't cached
+	for i := 0; i < 2; i++ {
+		if v, err := c.Get(key); err != nil || string(v) != "1" {
+			t.Fatalf("v: %s, err: %v", v, err)
+		}
+	}
+
+	if pool.slotNode(slot).addr != cluster.Server(1).Addr() {
+		t.Fatalf("slot not moved: %s", pool.slotNode(slot).addr)
+	}
+
+	if e, err := c.GetEntry(key); err != nil || !e.LocalHit {
+		t.Fatalf("e: %+v, err: %v", e, err)
+	}
+
+	cluster.Server(1).Set(key, []byte("2"))
+	waitInvalidated(c, key)
+	if v, err := c.Get(key); err != nil || string(v) != "2" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+}
+
+func TestClusterPool_refresh(t *testing.T) {
+	var faults faultConns
+	cluster, pool := newTestCluster(t, PoolOptions{
+		ClusterRefreshInterval: time.Millisecond * 10,
+		WrapConn:               faults.wrap,
+	})
+	defer cluster.Close()
+	defer pool.Close()
+
+	c, _ := pool.Get()
+	defer c.Close()
+
+	keys := []string{clusterKey(cluster, "refresh:", 0), clusterKey(cluster, "refresh:", 2)}
+	for _, k := range keys {
+		waitInvalidations(t, pool, k, 1, func() {
+			cluster.Set(k, []byte("1"))
+		})
+	}
+
+	if _, err := c.GetEntries(keys); err != nil {
+		t.Fatalf("failed to get entries: %v", err)
+	}
+
+	// the invalidations of the resharding are lost
+	for i := 0; i < 2; i++ {
+		pool.mu.RLock()
+		conn := pool.nodes[cluster.Server(i).Addr()].iconn.(*redistest.FaultConn)
+		pool.mu.RUnlock()
+		conn.FailReceive(redistest.Fault{Drop: true, Times: 1})
+	}
+
+	slot := redistest.Slot(keys[0])
+	cluster.MoveSlot(slot, 1)
+	for i := 0; i < 100 && pool.slotNode(slot).addr != cluster.Server(1).Addr(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// the entries of slots served by another node are deleted once the slots are refreshed
+	if _, ok := c.cache.getEntry(keys[0]); ok {
+		t.Fatal("entry not deleted")
+	}
+
+	if e, err := c.GetEntry(keys[1]); err != nil || !e.LocalHit {
+		t.Fatalf("e: %+v, err: %v", e, err)
+	}
+}
+
+func TestClusterPool_ask(t *testing.T) {
+	cluster, pool := newTestCluster(t, PoolOptions{})
+	defer cluster.Close()
+	defer pool.Close()
+
+	c, _ := pool.Get()
+	defer c.Close()
+
+	key := clusterKey(cluster, "ask:", 0)
+	slot := redistest.Slot(key)
+	cluster.MigrateSlot(slot, 2)
+
+	// keys missing on the owner of a migrating slot are redirected to the importing server with ASK
+	broadcastSet(t, pool, c, key, []byte("1"))
+
+	if _, ok := cluster.Server(2).Get(key); !ok {
+		t.Fatal("not set on the importing server")
+	}
+
+	if v, err := c.Get(key); err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	// ASK doesn't change the slots
+	if pool.slotNode(slot).addr != cluster.Server(0).Addr() {
+		t.Fatalf("slot moved: %s", pool.slotNode(slot).addr)
+	}
+
+	// the transaction releasing the lock is redirected as a whole
+	ctx := context.Background()
+	lockKey := "{" + key + "}:lock"
+	if ok, err := c.acquireLock(ctx, lockKey, "token", time.Second); !ok || err != nil {
+		t.Fatalf("ok: %v, err: %v", ok, err)
+	}
+
+	if _, ok := cluster.Server(2).Get(lockKey); !ok {
+		t.Fatal("lock not set on the importing server")
+	}
+
+	c.releaseLock(ctx, lockKey, "token")
+	if _, ok := cluster.Server(2).Get(lockKey); ok {
+		t.Fatal("lock not released")
+	}
+}
+
+func TestClusterPool_nodeFailed(t *testing.T) {
+	var faults faultConns
+	cluster, pool := newTestCluster(t, PoolOptions{
+		HealthCheckInterval: time.Millisecond * 10,
+		WrapConn:            faults.wrap,
+	})
+	defer cluster.Close()
+	defer pool.Close()
+
+	events := make(chan Event, 10)
+	pool.Subscribe(func(e Event) {
+		events <- e
+	})
+
+	c, _ := pool.Get()
+	defer c.Close()
+
+	keys := []string{clusterKey(cluster, "failed:", 0), clusterKey(cluster, "failed:", 1)}
+	for _, k := range keys {
+		waitInvalidations(t, pool, k, 1, func() {
+			cluster.Set(k, []byte("1"))
+		})
+	}
+
+	if _, err := c.GetEntries(keys); err != nil {
+		t.Fatalf("failed to get entries: %v", err)
+	}
+
+	// the tracking connection of the second node fails its health checks
+	node := pool.slotNode(redistest.Slot(keys[1]))
+	conn, ok := node.conn.(*redistest.FaultConn)
+	if !ok {
+		t.Fatal("connection not wrapped")
+	}
+
+	conn.FailCommand("PING", redistest.Fault{Err: errors.New("fault")})
+	waitEvent(t, events, EventOutOfSync)
+
+	// only the entries of the failed node are deleted
+	if _, ok := c.cache.getEntry(keys[1]); ok {
+		t.Fatal("entry of the failed node not deleted")
+	}
+
+	if _, ok := c.cache.getEntry(keys[0]); !ok {
+		t.Fatal("entry deleted")
+	}
+
+	// the node is replaced on the next refresh
+	waitEvent(t, events, EventInSync)
+	if v, err := c.Get(keys[1]); err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	if e, err := c.GetEntry(keys[1]); err != nil || !e.LocalHit {
+		t.Fatalf("e: %+v, err: %v", e, err)
+	}
+}
@@ -0,0 +1,593 @@
+package csc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// number of times a command is redirected before its MOVED or ASK error is returned
+const maxClusterRedirects = 5
+
+var errClusterReceive = errors.New("csc: Receive isn't supported by cluster connections")
+
+type clusterCommand struct {
+	name string
+	args []interface{}
+}
+
+// clusterPart is a sequence of commands sent to the node serving their slot
+type clusterPart struct {
+	// -1 for keyless commands, which are sent to the node used last
+	slot    int
+	cmds    []clusterCommand
+	replies []interface{}
+	// a MULTI ... EXEC block, ASKING then only precedes MULTI
+	tx     bool
+	addr   string
+	asking bool
+}
+
+// clusterUnit is a command, or transaction, of the caller, split into parts by slot
+type clusterUnit struct {
+	parts []*clusterPart
+	// returns the replies of the unit's commands from those of its parts
+	merge func() []interface{}
+}
+
+// clusterConn routes the commands of a client of a ClusterPool to the nodes by slot, borrowing a connection of each
+// node's pool on first use. Multi-key commands and transactions over keys of several slots are split into one command
+// or transaction per slot, which makes them non-atomic. Commands are buffered by Send and run by Do, redirections are
+// followed.
+type clusterConn struct {
+	pool    *ClusterPool
+	conns   map[string]redis.Conn
+	pending []clusterCommand
+	// address of the node used last, for keyless commands
+	last   string
+	closed bool
+}
+
+func (c *clusterConn) Close() error {
+	c.closed = true
+	c.pending = nil
+	for addr, conn := range c.conns {
+		conn.Close()
+		delete(c.conns, addr)
+	}
+
+	return nil
+}
+
+// Err returns nil unless the connection is closed, connections to nodes that failed are replaced
+func (c *clusterConn) Err() error {
+	if c.closed {
+		return ErrClosed
+	}
+
+	return nil
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	if c.closed {
+		return ErrClosed
+	}
+
+	c.pending = append(c.pending, clusterCommand{cmd, args})
+	return nil
+}
+
+// Flush does nothing, the commands are sent by Do
+func (c *clusterConn) Flush() error {
+	return c.Err()
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	return nil, errClusterReceive
+}
+
+func (c *clusterConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return nil, errClusterReceive
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+// DoWithTimeout is like Do, the timeout is applied to the whole run
+func (c *clusterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return c.DoContext(ctx, cmd, args...)
+}
+
+// DoContext runs the pending commands and cmd, if not empty. Like redigo it returns the replies of all of them if cmd
+// is empty, the reply of cmd and the first error reply otherwise
+func (c *clusterConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	cmds := c.pending
+	c.pending = nil
+	if cmd != "" {
+		cmds = append(cmds, clusterCommand{cmd, args})
+	}
+
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+
+	replies, err := c.run(ctx, cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd == "" {
+		return replies, nil
+	}
+
+	for _, r := range replies {
+		if rerr, ok := r.(error); ok {
+			return replies[len(replies)-1], rerr
+		}
+	}
+
+	return replies[len(replies)-1], nil
+}
+
+// runs cmds, following redirections, and returns a reply for each of them
+func (c *clusterConn) run(ctx context.Context, cmds []clusterCommand) ([]interface{}, error) {
+	units, err := splitCommands(cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []*clusterPart
+	for _, u := range units {
+		parts = append(parts, u.parts...)
+	}
+
+	for redirects := 0; len(parts) > 0 && redirects <= maxClusterRedirects; redirects++ {
+		if err := c.resolve(parts); err != nil {
+			return nil, err
+		}
+
+		if err := c.pipeline(ctx, parts); err != nil {
+			c.pool.requestRefresh()
+			return nil, err
+		}
+
+		parts = c.redirected(parts)
+	}
+
+	replies := make([]interface{}, 0, len(cmds))
+	for _, u := range units {
+		replies = append(replies, u.merge()...)
+	}
+
+	return replies, nil
+}
+
+// sets the address of the node of parts that aren't redirected
+func (c *clusterConn) resolve(parts []*clusterPart) error {
+	for _, part := range parts {
+		if part.addr != "" {
+			continue
+		}
+
+		var err error
+		switch {
+		case part.slot >= 0:
+			part.addr, err = c.pool.slotAddr(part.slot)
+		case c.last != "":
+			part.addr = c.last
+		default:
+			part.addr, err = c.pool.anyAddr()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// returns the parts whose replies redirect them to another node, with their address set to it
+func (c *clusterConn) redirected(parts []*clusterPart) []*clusterPart {
+	var redirected []*clusterPart
+	for _, part := range parts {
+		for _, r := range part.replies {
+			rerr, ok := r.(redis.Error)
+			if !ok {
+				continue
+			}
+
+			kind, slot, addr, ok := parseRedirect(rerr)
+			if !ok {
+				continue
+			}
+
+			dlog("cconn.redirect: %p e=%s\n", c, rerr.Error())
+			if kind == "MOVED" {
+				c.pool.moved(slot, addr)
+			}
+
+			part.addr = addr
+			part.asking = kind == "ASK"
+			redirected = append(redirected, part)
+			break
+		}
+	}
+
+	return redirected
+}
+
+// sends the commands of parts pipelined to their nodes and receives their replies. returns the first connection
+// error, the failed connections are dropped
+func (c *clusterConn) pipeline(ctx context.Context, parts []*clusterPart) error {
+	var addrs []string
+	byAddr := map[string][]*clusterPart{}
+	for _, part := range parts {
+		if _, ok := byAddr[part.addr]; !ok {
+			addrs = append(addrs, part.addr)
+		}
+
+		byAddr[part.addr] = append(byAddr[part.addr], part)
+		c.last = part.addr
+	}
+
+	var ferr error
+	sent := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if err := c.send(ctx, addr, byAddr[addr]); err != nil {
+			c.drop(addr)
+			if ferr == nil {
+				ferr = err
+			}
+
+			continue
+		}
+
+		sent = append(sent, addr)
+	}
+
+	for _, addr := range sent {
+		if err := c.receive(ctx, c.conns[addr], byAddr[addr]); err != nil {
+			c.drop(addr)
+			if ferr == nil {
+				ferr = err
+			}
+		}
+	}
+
+	return ferr
+}
+
+func (c *clusterConn) send(ctx context.Context, addr string, parts []*clusterPart) error {
+	conn, err := c.conn(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		for i, cmd := range part.cmds {
+			if part.asking && (!part.tx || i == 0) {
+				if err := conn.Send("ASKING"); err != nil {
+					return err
+				}
+			}
+
+			if err := conn.Send(cmd.name, cmd.args...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return conn.Flush()
+}
+
+func (c *clusterConn) receive(ctx context.Context, conn redis.Conn, parts []*clusterPart) error {
+	recv := func() (interface{}, error) {
+		if ctx.Done() == nil {
+			return conn.Receive()
+		}
+
+		return redis.ReceiveContext(conn, ctx)
+	}
+
+	for _, part := range parts {
+		part.replies = make([]interface{}, len(part.cmds))
+		for i := range part.cmds {
+			if part.asking && (!part.tx || i == 0) {
+				if _, err := recv(); err != nil && conn.Err() != nil {
+					return err
+				}
+			}
+
+			r, err := recv()
+			if err != nil {
+				if conn.Err() != nil {
+					return err
+				}
+
+				r = err
+			}
+
+			part.replies[i] = r
+		}
+	}
+
+	return nil
+}
+
+// returns the connection to the node at addr, borrowed from its pool, which waits until ctx is done if Wait is set
+func (c *clusterConn) conn(ctx context.Context, addr string) (redis.Conn, error) {
+	if conn, ok := c.conns[addr]; ok {
+		return conn, nil
+	}
+
+	n, err := c.pool.node(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := n.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn = c.pool.options.wrapConn(conn, ConnClient)
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+func (c *clusterConn) drop(addr string) {
+	if conn, ok := c.conns[addr]; ok {
+		dlog("cconn.drop: %p a=%s err=%v\n", c, addr, conn.Err())
+		conn.Close()
+		delete(c.conns, addr)
+	}
+}
+
+// returns the kind, MOVED or ASK, slot and address of a redirection error
+func parseRedirect(err redis.Error) (string, int, string, bool) {
+	fields := strings.Fields(err.Error())
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, "", false
+	}
+
+	slot, serr := strconv.Atoi(fields[1])
+	if serr != nil || slot < 0 || slot >= numSlots {
+		return "", 0, "", false
+	}
+
+	return fields[0], slot, fields[2], true
+}
+
+// splits cmds into units of parts by slot. keyless commands are sent to the node of the next command with keys
+func splitCommands(cmds []clusterCommand) ([]*clusterUnit, error) {
+	var units []*clusterUnit
+	for i := 0; i < len(cmds); i++ {
+		cmd := cmds[i]
+		switch strings.ToUpper(cmd.name) {
+		case "MULTI":
+			end := i + 1
+			for end < len(cmds) && !isTxEnd(cmds[end].name) {
+				end++
+			}
+
+			if end == len(cmds) {
+				return nil, errors.New("csc: MULTI without EXEC or DISCARD isn't supported by cluster connections")
+			}
+
+			units = append(units, splitTransaction(cmds[i:end+1]))
+			i = end
+		case "MGET", "DEL", "EXISTS", "UNLINK", "TOUCH", "WATCH":
+			units = append(units, splitKeys(cmd))
+		default:
+			units = append(units, singleUnit(cmd))
+		}
+	}
+
+	// keyless units follow the next unit with a slot
+	next := -1
+	for i := len(units) - 1; i >= 0; i-- {
+		for _, part := range units[i].parts {
+			if part.slot < 0 {
+				part.slot = next
+			} else {
+				next = part.slot
+			}
+		}
+	}
+
+	return units, nil
+}
+
+func isTxEnd(name string) bool {
+	name = strings.ToUpper(name)
+	return name == "EXEC" || name == "DISCARD"
+}
+
+func singleUnit(cmd clusterCommand) *clusterUnit {
+	part := &clusterPart{slot: commandSlot(cmd), cmds: []clusterCommand{cmd}}
+	return &clusterUnit{
+		parts: []*clusterPart{part},
+		merge: func() []interface{} { return part.replies },
+	}
+}
+
+// splits a multi-key command into one command per slot, their replies are merged in the order of the keys
+func splitKeys(cmd clusterCommand) *clusterUnit {
+	var parts []*clusterPart
+	// the parts and indexes of the keys
+	var index [][]int
+	slots := map[int]int{}
+	for i, arg := range cmd.args {
+		slot := keySlot(argString(arg))
+		pi, ok := slots[slot]
+		if !ok {
+			pi = len(parts)
+			slots[slot] = pi
+			parts = append(parts, &clusterPart{slot: slot, cmds: []clusterCommand{{name: cmd.name}}})
+			index = append(index, nil)
+		}
+
+		parts[pi].cmds[0].args = append(parts[pi].cmds[0].args, arg)
+		index[pi] = append(index[pi], i)
+	}
+
+	if len(parts) <= 1 {
+		return singleUnit(cmd)
+	}
+
+	merge := func() []interface{} {
+		var sum int64
+		values := make([]interface{}, len(cmd.args))
+		for pi, part := range parts {
+			switch r := part.replies[0].(type) {
+			case error:
+				return []interface{}{r}
+			case int64:
+				sum += r
+			case []interface{}:
+				if len(r) != len(index[pi]) {
+					return []interface{}{redis.Error(fmt.Sprintf("csc: unexpected reply of %s: %v", cmd.name, r))}
+				}
+
+				for i, v := range r {
+					values[index[pi][i]] = v
+				}
+			}
+		}
+
+		switch strings.ToUpper(cmd.name) {
+		case "MGET":
+			return []interface{}{values}
+		case "WATCH":
+			return []interface{}{"OK"}
+		default:
+			return []interface{}{sum}
+		}
+	}
+
+	return &clusterUnit{parts: parts, merge: merge}
+}
+
+// splits a MULTI ... EXEC or DISCARD block into one per slot, keyless commands go to the first one. EXEC replies are
+// merged in the order of the commands, a failed transaction fails all
+func splitTransaction(cmds []clusterCommand) *clusterUnit {
+	inner := cmds[1 : len(cmds)-1]
+	multi, end := cmds[0], cmds[len(cmds)-1]
+
+	var parts []*clusterPart
+	// the part of each inner command and its index in it
+	where := make([][2]int, len(inner))
+	slots := map[int]int{}
+	for i, cmd := range inner {
+		slot := commandSlot(cmd)
+		pi, ok := slots[slot]
+		if slot < 0 && len(parts) > 0 {
+			pi, ok = 0, true
+		}
+
+		if !ok {
+			pi = len(parts)
+			slots[slot] = pi
+			parts = append(parts, &clusterPart{slot: slot, tx: true, cmds: []clusterCommand{multi}})
+		}
+
+		parts[pi].cmds = append(parts[pi].cmds, cmd)
+		where[i] = [2]int{pi, len(parts[pi].cmds) - 1}
+	}
+
+	if len(parts) == 0 {
+		parts = append(parts, &clusterPart{slot: -1, tx: true, cmds: []clusterCommand{multi}})
+	}
+
+	// a keyless first part takes the slot of the next part
+	if parts[0].slot < 0 && len(parts) > 1 {
+		parts[0].slot = parts[1].slot
+	}
+
+	for _, part := range parts {
+		part.cmds = append(part.cmds, end)
+	}
+
+	merge := func() []interface{} {
+		replies := make([]interface{}, 0, len(cmds))
+		replies = append(replies, parts[0].replies[0])
+		for _, w := range where {
+			replies = append(replies, parts[w[0]].replies[w[1]])
+		}
+
+		if len(parts) == 1 {
+			return append(replies, parts[0].replies[len(parts[0].cmds)-1])
+		}
+
+		results := make([][]interface{}, len(parts))
+		for pi, part := range parts {
+			r := part.replies[len(part.cmds)-1]
+			values, ok := r.([]interface{})
+			if !ok {
+				// an error, a failed WATCH or the reply of DISCARD
+				return append(replies, r)
+			}
+
+			results[pi] = values
+		}
+
+		values := make([]interface{}, len(inner))
+		for i, w := range where {
+			if w[1]-1 < len(results[w[0]]) {
+				values[i] = results[w[0]][w[1]-1]
+			}
+		}
+
+		return append(replies, values)
+	}
+
+	return &clusterUnit{parts: parts, merge: merge}
+}
+
+// returns the slot of the keys of cmd, -1 if it has none
+func commandSlot(cmd clusterCommand) int {
+	switch strings.ToUpper(cmd.name) {
+	case "PING", "ECHO", "CLIENT", "ASKING", "UNWATCH", "INFO", "TIME", "DBSIZE", "FLUSHDB", "FLUSHALL", "SCRIPT",
+		"PUBLISH", "CLUSTER", "MULTI", "EXEC", "DISCARD", "SELECT", "HELLO":
+		return -1
+	case "EVAL", "EVALSHA":
+		if len(cmd.args) > 2 {
+			if n, err := strconv.Atoi(argString(cmd.args[1])); err == nil && n > 0 {
+				return keySlot(argString(cmd.args[2]))
+			}
+		}
+
+		return -1
+	}
+
+	if len(cmd.args) == 0 {
+		return -1
+	}
+
+	return keySlot(argString(cmd.args[0]))
+}
+
+func argString(arg interface{}) string {
+	switch a := arg.(type) {
+	case string:
+		return a
+	case []byte:
+		return string(a)
+	default:
+		return fmt.Sprint(a)
+	}
+}
@@ -0,0 +1,122 @@
+package csc
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+var errNotPointer = errors.New("value must be a non-nil pointer")
+
+// Codec encodes the values of GetValue and SetValue. Other formats, like msgpack or protobuf, are plugged in by
+// implementing it with their libraries
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+var (
+	// JSONCodec encodes values with encoding/json
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec encodes values with encoding/gob, which is more compact and faster to decode for Go only consumers
+	GobCodec Codec = gobCodec{}
+)
+
+// decodedValue is a value decoded by GetValue, kept in the local cache with the bytes it was decoded from. it's a
+// pointer so that cached values are comparable
+type decodedValue struct {
+	v reflect.Value
+}
+
+// GetValue gets key and decodes it into v, which must be a non-nil pointer, with the pool's codec. redis.ErrNil is
+// returned if the key is missing. With PoolOptions.CacheDecoded set local hits skip decoding
+func (c *Client) GetValue(key string, v interface{}) error {
+	return c.GetValueContext(context.Background(), key, v)
+}
+
+// GetValueContext is like GetValue but returns ctx's error if it's done before Redis replies
+func (c *Client) GetValueContext(ctx context.Context, key string, v interface{}) error {
+	return c.GetValueWithHint(ctx, key, v, CacheDefault)
+}
+
+// GetValueWithHint is like GetValueContext but hint selects whether the value is cached and, in OPTIN and OPTOUT
+// tracking modes, tracked by the server
+func (c *Client) GetValueWithHint(ctx context.Context, key string, v interface{}, hint CacheHint) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errNotPointer
+	}
+
+	e, err := c.getEntry(ctx, key, hint)
+	if err != nil {
+		return err
+	}
+
+	opts := c.pool.Options()
+	if !opts.CacheDecoded {
+		return opts.codec().Unmarshal(e.Data, v)
+	}
+
+	// the decoded value is kept along with the cached bytes, which are compressed with CacheCompressed
+	pkey := c.prefixKey(key)
+	if e.LocalHit {
+		if d, ok := c.cache.decoded(pkey, e.cached).(*decodedValue); ok && d.v.Type() == rv.Elem().Type() {
+			dlog("client.getvalue.decoded: %p k=%s\n", c, pkey)
+			rv.Elem().Set(d.v)
+			return nil
+		}
+	}
+
+	if err := opts.codec().Unmarshal(e.Data, v); err != nil {
+		return err
+	}
+
+	// a shallow copy, later decodes into v don't change it
+	d := reflect.New(rv.Elem().Type()).Elem()
+	d.Set(rv.Elem())
+	c.cache.setDecoded(pkey, e.cached, &decodedValue{v: d})
+	return nil
+}
+
+// SetValue encodes v with the pool's codec and sets it like Set
+func (c *Client) SetValue(key string, v interface{}, expires int) error {
+	return c.SetValueContext(context.Background(), key, v, expires)
+}
+
+// SetValueContext is like SetValue but returns ctx's error if it's done before Redis replies
+func (c *Client) SetValueContext(ctx context.Context, key string, v interface{}, expires int) error {
+	data, err := c.pool.Options().codec().Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.SetContext(ctx, key, data, expires)
+}
@@ -0,0 +1,72 @@
+package csc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type countingCodec struct {
+	Codec
+	decodes int
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	c.decodes++
+	return c.Codec.Unmarshal(data, v)
+}
+
+type user struct {
+	Name  string
+	Roles []string
+}
+
+func TestClient_values(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, GobCodec} {
+		key := "value"
+		cc := &countingCodec{Codec: codec}
+
+		pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100, Codec: cc, CacheDecoded: true})
+		c, err := pool.Get()
+		if err != nil {
+			t.Fatalf("failed to get client from pool: %v", err)
+		}
+
+		want := user{Name: "alice", Roles: []string{"admin"}}
+		if err := c.SetValue(key, want, 60); err != nil {
+			t.Fatalf("failed to set: %v", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			var u user
+			if err := c.GetValue(key, &u); err != nil || !reflect.DeepEqual(u, want) {
+				t.Fatalf("%T: u: %+v, err: %v", codec, u, err)
+			}
+		}
+
+		// decoded once on the miss, local hits copy the decoded value
+		if cc.decodes != 1 {
+			t.Fatalf("%T: decodes: %d", codec, cc.decodes)
+		}
+
+		// another type is decoded again
+		var m map[string]interface{}
+		if codec == JSONCodec {
+			if err := c.GetValue(key, &m); err != nil || m["Name"] != "alice" || cc.decodes != 2 {
+				t.Fatalf("m: %v, err: %v, decodes: %d", m, err, cc.decodes)
+			}
+		}
+
+		if err := c.GetValue(key, user{}); err != errNotPointer {
+			t.Fatalf("err: %v", err)
+		}
+
+		c.Delete(key)
+		if err := c.GetValue(key, &user{}); err != redis.ErrNil {
+			t.Fatalf("err: %v", err)
+		}
+
+		c.Close()
+	}
+}
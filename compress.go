@@ -0,0 +1,161 @@
+package csc
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io/ioutil"
+	"sync"
+)
+
+// values set with compression enabled that are compressed, or that would be mistaken for compressed values, start
+// with compressMagic followed by a format byte
+const compressMagic = "\xffcz"
+
+const (
+	compressFormatRaw byte = iota
+	compressFormatFlate
+)
+
+const defaultCompressMinSize = 1024
+
+var errCompressFormat = errors.New("unknown compression format")
+
+// CompressionOptions makes Set, SetValue and GetOrLoad compress large values with flate, Get and friends decompress
+// them transparently. All clients reading the keys must have compression enabled, values set without it are read
+// as is.
+type CompressionOptions struct {
+	// values of at least this many bytes are compressed, defaults to 1024
+	MinSize int
+	// flate compression level, 0 means flate.DefaultCompression
+	Level int
+	// keeps values compressed in the local cache, decompressing them on every local hit, which trades CPU for memory.
+	// MaxBytes then counts the compressed size
+	CacheCompressed bool
+}
+
+func (o *CompressionOptions) minSize() int {
+	if o.MinSize > 0 {
+		return o.MinSize
+	}
+
+	return defaultCompressMinSize
+}
+
+func (o *CompressionOptions) level() int {
+	if o.Level == 0 {
+		return flate.DefaultCompression
+	}
+
+	return o.Level
+}
+
+// flate writers are large, they're reused per compression level, from HuffmanOnly to BestCompression
+var flateWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+// compress returns data as it's set in Redis, compressed if it's large enough and compresses well
+func (o *CompressionOptions) compress(data []byte) ([]byte, error) {
+	if len(data) >= o.minSize() {
+		level := o.level()
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			return nil, errors.New("invalid compression level")
+		}
+
+		var buf bytes.Buffer
+		buf.WriteString(compressMagic)
+		buf.WriteByte(compressFormatFlate)
+
+		wp := &flateWriters[level-flate.HuffmanOnly]
+		w, _ := wp.Get().(*flate.Writer)
+		if w == nil {
+			var err error
+			if w, err = flate.NewWriter(&buf, level); err != nil {
+				return nil, err
+			}
+		} else {
+			w.Reset(&buf)
+		}
+
+		_, err := w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+
+		// don't keep buf alive while the writer is pooled
+		w.Reset(ioutil.Discard)
+		wp.Put(w)
+		if err != nil {
+			return nil, err
+		}
+
+		if buf.Len() < len(data) {
+			return buf.Bytes(), nil
+		}
+	}
+
+	if !bytes.HasPrefix(data, []byte(compressMagic)) {
+		return data, nil
+	}
+
+	// escaped so that it isn't mistaken for a compressed value
+	raw := make([]byte, 0, len(compressMagic)+1+len(data))
+	raw = append(raw, compressMagic...)
+	raw = append(raw, compressFormatRaw)
+	return append(raw, data...), nil
+}
+
+// decompress returns a value read from Redis as it was set
+func decompress(data []byte) ([]byte, error) {
+	if len(data) <= len(compressMagic) || !bytes.HasPrefix(data, []byte(compressMagic)) {
+		return data, nil
+	}
+
+	body := data[len(compressMagic)+1:]
+	switch data[len(compressMagic)] {
+	case compressFormatRaw:
+		return body, nil
+	case compressFormatFlate:
+		r := flate.NewReader(bytes.NewReader(body))
+		defer r.Close()
+
+		return ioutil.ReadAll(r)
+	}
+
+	return nil, errCompressFormat
+}
+
+// returns the value to set in Redis for data
+func (c *Client) encodeValue(data []byte) ([]byte, error) {
+	if co := c.pool.Options().Compression; co != nil {
+		return co.compress(data)
+	}
+
+	return data, nil
+}
+
+// returns the value read from Redis, raw, as it was set and the bytes to cache locally
+func (c *Client) decodeValue(raw []byte) (data []byte, cached []byte, err error) {
+	co := c.pool.Options().Compression
+	if co == nil {
+		return raw, raw, nil
+	}
+
+	if data, err = decompress(raw); err != nil {
+		return nil, nil, err
+	}
+
+	if co.CacheCompressed {
+		return data, raw, nil
+	}
+
+	return data, data, nil
+}
+
+// returns the value of locally cached bytes
+func (c *Client) cachedValue(cached []byte) ([]byte, error) {
+	if co := c.pool.Options().Compression; co != nil && co.CacheCompressed {
+		return decompress(cached)
+	}
+
+	return cached, nil
+}
@@ -0,0 +1,172 @@
+package csc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestCompress(t *testing.T) {
+	co := &CompressionOptions{MinSize: 16}
+	large := bytes.Repeat([]byte("fragment "), 100)
+	tests := []struct {
+		in         []byte
+		compressed bool
+	}{
+		{[]byte("small"), false},
+		{large, true},
+		// would be mistaken for a compressed value
+		{[]byte(compressMagic + "\x01abc"), false},
+		// doesn't compress well
+		{[]byte("0123456789abcdefghij"), false},
+	}
+
+	for _, tt := range tests {
+		out, err := co.compress(tt.in)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.in, err)
+		}
+
+		if compressed := len(out) < len(tt.in); compressed != tt.compressed {
+			t.Fatalf("%q: compressed: %t", tt.in, compressed)
+		}
+
+		data, err := decompress(out)
+		if err != nil || !bytes.Equal(data, tt.in) {
+			t.Fatalf("%q: data: %q, err: %v", tt.in, data, err)
+		}
+	}
+
+	if _, err := decompress([]byte(compressMagic + "\x09abc")); err != errCompressFormat {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestClient_compression(t *testing.T) {
+	key := "fragment"
+	value := bytes.Repeat([]byte("<li>item</li>"), 200)
+
+	for _, cacheCompressed := range []bool{false, true} {
+		pool := NewTrackingPool(PoolOptions{
+			RedisAddress: redisAddress,
+			MaxEntries:   100,
+			Compression:  &CompressionOptions{CacheCompressed: cacheCompressed},
+		})
+
+		c, err := pool.Get()
+		if err != nil {
+			t.Fatalf("failed to get client from pool: %v", err)
+		}
+
+		if err := c.Set(key, value, 60); err != nil {
+			t.Fatalf("failed to set: %v", err)
+		}
+
+		raw, err := redis.Bytes(c.Conn().Do("GET", key))
+		if err != nil || !bytes.HasPrefix(raw, []byte(compressMagic)) || len(raw) >= len(value) {
+			t.Fatalf("raw: %d bytes, err: %v", len(raw), err)
+		}
+
+		// a miss and a local hit
+		for i := 0; i < 2; i++ {
+			if v, err := c.Get(key); err != nil || !bytes.Equal(v, value) {
+				t.Fatalf("v: %d bytes, err: %v", len(v), err)
+			}
+		}
+
+		entries, err := c.GetEntries([]string{key})
+		if err != nil || !bytes.Equal(entries[0].Data, value) {
+			t.Fatalf("entries: %v, err: %v", entries, err)
+		}
+
+		if ce, _ := c.cache.getEntry(key); bytes.Equal(ce.data, raw) != cacheCompressed {
+			t.Fatalf("cached: %d bytes", len(ce.data))
+		}
+
+		c.Delete(key)
+		c.Close()
+	}
+}
+
+func TestClient_compressionDecoded(t *testing.T) {
+	key := "fragment:decoded"
+	cc := &countingCodec{Codec: JSONCodec}
+
+	pool := NewTrackingPool(PoolOptions{
+		RedisAddress: redisAddress,
+		MaxEntries:   100,
+		Codec:        cc,
+		CacheDecoded: true,
+		Compression:  &CompressionOptions{CacheCompressed: true},
+	})
+
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c.Close()
+
+	want := user{Name: "alice", Roles: []string{string(bytes.Repeat([]byte("admin "), 500))}}
+	if err := c.SetValue(key, want, 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		var u user
+		if err := c.GetValue(key, &u); err != nil || u.Name != want.Name || u.Roles[0] != want.Roles[0] {
+			t.Fatalf("name: %s, err: %v", u.Name, err)
+		}
+	}
+
+	// the decoded value is kept along with the compressed bytes
+	if cc.decodes != 1 {
+		t.Fatalf("decodes: %d", cc.decodes)
+	}
+
+	c.Delete(key)
+}
+
+func TestClient_compressionCorrupt(t *testing.T) {
+	bad, good := "fragment:corrupt", "fragment:good"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100, Compression: &CompressionOptions{}})
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c.Close()
+	defer c.Delete(bad, good)
+
+	if _, err := c.Conn().Do("SET", bad, compressMagic+"\x09abc"); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	if err := c.Set(good, []byte("1"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	// a value that can't be decoded isn't deleted from Redis
+	if _, err := c.Get(bad); err != errCompressFormat {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := c.GetEntries([]string{bad, good}); err != errCompressFormat {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := redis.Bytes(c.Conn().Do("GET", bad)); err != nil {
+		t.Fatalf("value deleted: %v", err)
+	}
+
+	// no sentinels are left behind
+	for _, k := range []string{bad, good} {
+		if _, ok := c.cache.getEntry(k); ok {
+			t.Fatalf("sentinel of %s left in cache", k)
+		}
+	}
+
+	if v, err := c.Get(good); err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+}
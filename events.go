@@ -0,0 +1,100 @@
+package csc
+
+import "sync"
+
+// EventType is the kind of an Event
+type EventType int
+
+const (
+	// EventInvalidate is sent for each invalidation message, with the invalidated keys
+	EventInvalidate EventType = iota
+	// EventFlush is sent when Redis invalidates all keys, e.g. because a database was flushed. for clients sharing an
+	// invalidation connection it's sent once per flush that cleared a cache
+	EventFlush
+	// EventOutOfSync is sent when invalidations may have been missed because a connection failed or, with sentinels,
+	// the master failed over. the affected clients of a tracking pool are discarded, a broadcasting pool flushes its
+	// cache and reconnects, a cluster pool deletes the entries of the failed node's slots and replaces it
+	EventOutOfSync
+	// EventInSync is sent when a broadcasting pool reconnected, a tracking pool replaced a failed invalidation
+	// connection or reconnected to a new master, or a cluster pool replaced a failed node
+	EventInSync
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventInvalidate:
+		return "invalidate"
+	case EventFlush:
+		return "flush"
+	case EventOutOfSync:
+		return "out-of-sync"
+	case EventInSync:
+		return "in-sync"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change of the local caches of a pool
+type Event struct {
+	Type EventType
+	// the invalidated keys of an EventInvalidate, including the KeyPrefix. they mustn't be modified
+	Keys []string
+}
+
+// subscribers are the callbacks receiving the events of a pool
+type subscribers struct {
+	mu   sync.Mutex
+	next int
+	fns  map[int]func(Event)
+}
+
+func (s *subscribers) subscribe(fn func(Event)) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fns == nil {
+		s.fns = map[int]func(Event){}
+	}
+
+	id := s.next
+	s.next++
+	s.fns[id] = fn
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.fns, id)
+	}
+}
+
+// emit calls the subscribers, outside of the lock so that they may unsubscribe
+func (s *subscribers) emit(e Event) {
+	s.mu.Lock()
+	if len(s.fns) == 0 {
+		s.mu.Unlock()
+		return
+	}
+
+	fns := make([]func(Event), 0, len(s.fns))
+	for _, fn := range s.fns {
+		fns = append(fns, fn)
+	}
+	s.mu.Unlock()
+
+	dlog("events.emit: %p t=%s k=%s\n", s, e.Type, e.Keys)
+	for _, fn := range fns {
+		fn(e)
+	}
+}
+
+// emits an EventInvalidate for keys, or an EventFlush if keys is nil, which means all keys are invalidated
+func (s *subscribers) invalidated(keys []string) {
+	if keys == nil {
+		s.emit(Event{Type: EventFlush})
+		return
+	}
+
+	s.emit(Event{Type: EventInvalidate, Keys: keys})
+}
@@ -0,0 +1,241 @@
+package csc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestSubscribers(t *testing.T) {
+	var s subscribers
+
+	var got []Event
+	var unsubscribe func()
+	unsubscribe = s.subscribe(func(e Event) {
+		got = append(got, e)
+		// subscribers may unsubscribe while handling an event
+		unsubscribe()
+	})
+
+	s.invalidated([]string{"a"})
+	s.invalidated(nil)
+
+	if len(got) != 1 || got[0].Type != EventInvalidate || got[0].Keys[0] != "a" {
+		t.Fatalf("events: %+v", got)
+	}
+}
+
+func TestTrackingPool_Subscribe(t *testing.T) {
+	key := "events"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100})
+	events := make(chan Event, 10)
+	unsubscribe := pool.Subscribe(func(e Event) {
+		events <- e
+	})
+
+	c1, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+
+	c2, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+
+	if err := c2.Set(key, []byte("1"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	if _, err := c1.Get(key); err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+
+	if err := c2.Set(key, []byte("2"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	next := func() Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+			return Event{}
+		}
+	}
+
+	if e := next(); e.Type != EventInvalidate || len(e.Keys) != 1 || e.Keys[0] != key {
+		t.Fatalf("event: %+v", e)
+	}
+
+	// a failed invalidation connection puts the clients out-of-sync, a new one is dialed for new clients
+	c1.invalidator.conn.Close()
+	if e := next(); e.Type != EventOutOfSync {
+		t.Fatalf("event: %+v", e)
+	}
+
+	c1.Close()
+	c2.Close()
+
+	c3, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+
+	if e := next(); e.Type != EventInSync {
+		t.Fatalf("event: %+v", e)
+	}
+
+	unsubscribe()
+	c3.Delete(key)
+	c3.Close()
+	pool.Close()
+
+	select {
+	case e := <-events:
+		t.Fatalf("event after unsubscribing: %+v", e)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestTrackingPool_flush(t *testing.T) {
+	for _, resp3 := range []bool{false, true} {
+		key := "events:flush"
+
+		pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100, RESP3: resp3})
+		events := make(chan Event, 10)
+		pool.Subscribe(func(e Event) {
+			events <- e
+		})
+
+		c, err := pool.Get()
+		if err != nil {
+			t.Fatalf("failed to get client from pool: %v", err)
+		}
+
+		if err := c.Set(key, []byte("1"), 60); err != nil {
+			t.Fatalf("failed to set: %v", err)
+		}
+
+		if _, err := c.Get(key); err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+
+		if c.cache.stats().NumEntries != 1 {
+			t.Fatalf("resp3=%v: key not cached", resp3)
+		}
+
+		conn, err := redis.Dial("tcp", redisAddress)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+
+		// Redis invalidates all keys with a null array
+		if _, err := conn.Do("FLUSHDB"); err != nil {
+			t.Fatalf("failed to flush: %v", err)
+		}
+		conn.Close()
+
+		select {
+		case e := <-events:
+			if e.Type != EventFlush || e.Keys != nil {
+				t.Fatalf("resp3=%v: event: %+v", resp3, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("resp3=%v: no event", resp3)
+		}
+
+		if st := c.cache.stats(); st.NumEntries != 0 || st.Flushes != 1 {
+			t.Fatalf("resp3=%v: cache not cleared: %+v", resp3, st)
+		}
+
+		if st := pool.Stats(); st.Flushes != 1 {
+			t.Fatalf("resp3=%v: stats: %+v", resp3, st)
+		}
+
+		c.Close()
+		pool.Close()
+	}
+}
+
+func TestTrackingPool_sharedFlush(t *testing.T) {
+	key, marker := "events:sharedflush", "events:sharedflush:marker"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100})
+	defer pool.Close()
+
+	events := make(chan Event, 10)
+	pool.Subscribe(func(e Event) {
+		events <- e
+	})
+
+	clients := make([]*Client, 3)
+	for i := range clients {
+		c, err := pool.Get()
+		if err != nil {
+			t.Fatalf("failed to get client from pool: %v", err)
+		}
+		defer c.Close()
+
+		clients[i] = c
+	}
+
+	clients[0].Set(key, []byte("1"), 60)
+	for _, c := range clients {
+		if _, err := c.Get(key); err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+	}
+
+	conn, err := redis.Dial("tcp", redisAddress)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Redis sends the flush to the shared invalidation connection once per client
+	if _, err := conn.Do("FLUSHDB"); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	// the marker's invalidation follows the flushes, its read is tracked but not cached
+	clients[1].Set(marker, []byte("1"), 60)
+	clients[0].GetWithHint(context.Background(), marker, CacheNo)
+	clients[1].Set(marker, []byte("2"), 60)
+
+	flushes := 0
+	timeout := time.After(time.Second * 5)
+	for done := false; !done; {
+		select {
+		case e := <-events:
+			if e.Type == EventFlush {
+				flushes++
+			}
+
+			done = e.Type == EventInvalidate && len(e.Keys) == 1 && e.Keys[0] == marker
+		case <-timeout:
+			t.Fatal("marker not invalidated")
+		}
+	}
+
+	if flushes != 1 {
+		t.Fatalf("flush events: %d", flushes)
+	}
+
+	// each cache is cleared and counted once
+	for _, c := range clients {
+		if st := c.cache.stats(); st.NumEntries != 0 || st.Flushes != 1 {
+			t.Fatalf("stats: %+v", st)
+		}
+	}
+
+	if st := pool.Stats(); st.Flushes != 3 {
+		t.Fatalf("stats: %+v", st)
+	}
+
+	clients[1].Delete(marker)
+}
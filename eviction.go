@@ -0,0 +1,477 @@
+package csc
+
+import (
+	"container/list"
+	"hash/fnv"
+)
+
+// EvictionPolicy keeps track of the keys in a cache and decides which one to evict when the cache is full.
+// All calls are serialized by the cache, so implementations don't need to be safe for concurrent use.
+type EvictionPolicy interface {
+	// Access records a lookup of key, it's called on cache misses as well as hits
+	Access(key string)
+	// Add records that key was inserted into the cache
+	Add(key string)
+	// Remove forgets key, it has been deleted, invalidated or expired
+	Remove(key string)
+	// Evict forgets and returns the key to evict next, false if there's no key to evict.
+	// Returning the key that was just added rejects it from the cache.
+	Evict() (string, bool)
+	// Reset forgets all keys
+	Reset()
+}
+
+// Eviction selects how keys are evicted when the cache is full
+type Eviction int
+
+const (
+	// EvictRandom deletes a percentage of the keys from a random offset
+	EvictRandom Eviction = iota
+	// EvictLRU deletes the least recently used key
+	EvictLRU
+	// EvictLFU deletes the least frequently used key
+	EvictLFU
+	// EvictTinyLFU uses W-TinyLFU, where new keys only replace keys accessed less frequently
+	EvictTinyLFU
+)
+
+type lruPolicy struct {
+	// keys ordered by recency of use, most recently used first
+	ll    *list.List
+	elems map[string]*list.Element
+}
+
+// NewLRUPolicy returns a policy that evicts the least recently used key
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{
+		ll:    list.New(),
+		elems: map[string]*list.Element{},
+	}
+}
+
+func (p *lruPolicy) Access(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.ll.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Add(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.ll.MoveToFront(e)
+		return
+	}
+
+	p.elems[key] = p.ll.PushFront(key)
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.ll.Remove(e)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy) Evict() (string, bool) {
+	e := p.ll.Back()
+	if e == nil {
+		return "", false
+	}
+
+	k := e.Value.(string)
+	p.ll.Remove(e)
+	delete(p.elems, k)
+	return k, true
+}
+
+func (p *lruPolicy) Reset() {
+	p.ll.Init()
+	p.elems = map[string]*list.Element{}
+}
+
+type lfuBucket struct {
+	freq int
+	// keys with this frequency, most recently used first
+	keys *list.List
+}
+
+type lfuEntry struct {
+	bucket *list.Element
+	elem   *list.Element
+}
+
+type lfuPolicy struct {
+	// buckets ordered by ascending frequency, empty buckets are removed
+	buckets *list.List
+	entries map[string]*lfuEntry
+}
+
+// NewLFUPolicy returns a policy that evicts the least frequently used key, ties are broken by evicting the least
+// recently used one. All operations are O(1).
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{
+		buckets: list.New(),
+		entries: map[string]*lfuEntry{},
+	}
+}
+
+func (p *lfuPolicy) Access(key string) {
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+
+	b := e.bucket.Value.(*lfuBucket)
+	next := e.bucket.Next()
+	if next == nil || next.Value.(*lfuBucket).freq != b.freq+1 {
+		next = p.buckets.InsertAfter(&lfuBucket{freq: b.freq + 1, keys: list.New()}, e.bucket)
+	}
+
+	b.keys.Remove(e.elem)
+	if b.keys.Len() == 0 {
+		p.buckets.Remove(e.bucket)
+	}
+
+	e.bucket = next
+	e.elem = next.Value.(*lfuBucket).keys.PushFront(key)
+}
+
+func (p *lfuPolicy) Add(key string) {
+	if _, ok := p.entries[key]; ok {
+		p.Access(key)
+		return
+	}
+
+	front := p.buckets.Front()
+	if front == nil || front.Value.(*lfuBucket).freq != 1 {
+		front = p.buckets.PushFront(&lfuBucket{freq: 1, keys: list.New()})
+	}
+
+	p.entries[key] = &lfuEntry{
+		bucket: front,
+		elem:   front.Value.(*lfuBucket).keys.PushFront(key),
+	}
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+
+	b := e.bucket.Value.(*lfuBucket)
+	b.keys.Remove(e.elem)
+	if b.keys.Len() == 0 {
+		p.buckets.Remove(e.bucket)
+	}
+
+	delete(p.entries, key)
+}
+
+func (p *lfuPolicy) Evict() (string, bool) {
+	front := p.buckets.Front()
+	if front == nil {
+		return "", false
+	}
+
+	k := front.Value.(*lfuBucket).keys.Back().Value.(string)
+	p.Remove(k)
+	return k, true
+}
+
+func (p *lfuPolicy) Reset() {
+	p.buckets.Init()
+	p.entries = map[string]*lfuEntry{}
+}
+
+const (
+	sketchDepth = 4
+	// counters saturate at this value, like the 4-bit counters of the TinyLFU paper
+	sketchMaxCount = 15
+	// all counters are halved after this many increments per cache entry
+	sketchResetFactor = 10
+)
+
+// cmSketch is a count-min sketch estimating the access frequency of keys, counters are periodically halved so
+// that old accesses fade out
+type cmSketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newCMSketch(size int) *cmSketch {
+	width := 16
+	for width < size {
+		width <<= 1
+	}
+
+	s := &cmSketch{
+		mask:    uint64(width - 1),
+		resetAt: size * sketchResetFactor,
+	}
+
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+
+	return s
+}
+
+func (s *cmSketch) indexes(key string) [sketchDepth]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+
+	h1, h2 := sum&0xffffffff, sum>>32
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+
+	return idx
+}
+
+func (s *cmSketch) increment(key string) {
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < sketchMaxCount {
+			s.rows[i][j]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+func (s *cmSketch) estimate(key string) uint8 {
+	min := uint8(sketchMaxCount)
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < min {
+			min = s.rows[i][j]
+		}
+	}
+
+	return min
+}
+
+// halves all counters
+func (s *cmSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+
+	s.additions /= 2
+}
+
+func (s *cmSketch) clear() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] = 0
+		}
+	}
+
+	s.additions = 0
+}
+
+type tinyLFUSegment int
+
+const (
+	segmentWindow tinyLFUSegment = iota
+	segmentProbation
+	segmentProtected
+)
+
+type tinyLFUEntry struct {
+	segment tinyLFUSegment
+	elem    *list.Element
+}
+
+// tinyLFUPolicy implements W-TinyLFU: new keys enter a small LRU window, keys leaving the window are only admitted to
+// the main segmented LRU if they're estimated to be accessed more frequently than the main LRU's victim
+type tinyLFUPolicy struct {
+	sketch       *cmSketch
+	window       *list.List
+	probation    *list.List
+	protected    *list.List
+	windowCap    int
+	mainCap      int
+	protectedCap int
+	entries      map[string]*tinyLFUEntry
+	// set when the cache has no max entries, the segments are then sized by the number of keys held
+	unbounded bool
+}
+
+const (
+	tinyLFUWindowFactor    = 0.01
+	tinyLFUProtectedFactor = 0.8
+	// width of the frequency sketch of policies of caches without max entries
+	tinyLFUDefaultSketchSize = 4096
+)
+
+// NewTinyLFUPolicy returns a W-TinyLFU policy sized for a cache of maxEntries keys. If maxEntries is 0, like when
+// only MaxBytes limits the cache, the segments follow the number of keys held and the frequency sketch keeps a fixed
+// width, its estimates get less accurate with many more keys than tinyLFUDefaultSketchSize
+func NewTinyLFUPolicy(maxEntries int) EvictionPolicy {
+	p := &tinyLFUPolicy{
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+		entries:   map[string]*tinyLFUEntry{},
+		unbounded: maxEntries <= 0,
+	}
+
+	if p.unbounded {
+		p.sketch = newCMSketch(tinyLFUDefaultSketchSize)
+	} else {
+		p.sketch = newCMSketch(maxEntries)
+	}
+
+	p.resize(maxEntries)
+	return p
+}
+
+// sets the capacities of the segments for a cache of n keys
+func (p *tinyLFUPolicy) resize(n int) {
+	p.windowCap = int(float64(n) * tinyLFUWindowFactor)
+	if p.windowCap < 1 {
+		p.windowCap = 1
+	}
+
+	p.mainCap = n - p.windowCap
+	if p.mainCap < 1 {
+		p.mainCap = 1
+	}
+
+	p.protectedCap = int(float64(p.mainCap) * tinyLFUProtectedFactor)
+
+	// counters are halved after sketchResetFactor increments per key, but no sooner than for the sketch's width
+	if p.unbounded && n > tinyLFUDefaultSketchSize {
+		p.sketch.resetAt = n * sketchResetFactor
+	}
+}
+
+func (p *tinyLFUPolicy) list(s tinyLFUSegment) *list.List {
+	switch s {
+	case segmentProbation:
+		return p.probation
+	case segmentProtected:
+		return p.protected
+	default:
+		return p.window
+	}
+}
+
+func (p *tinyLFUPolicy) Access(key string) {
+	p.sketch.increment(key)
+
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+
+	switch e.segment {
+	case segmentWindow, segmentProtected:
+		p.list(e.segment).MoveToFront(e.elem)
+	case segmentProbation:
+		// a hit in probation promotes the key to protected, demoting protected's lru key if it's full
+		p.probation.Remove(e.elem)
+		e.segment = segmentProtected
+		e.elem = p.protected.PushFront(key)
+
+		if p.protected.Len() > p.protectedCap {
+			p.move(p.protected.Back().Value.(string), segmentProbation)
+		}
+	}
+}
+
+func (p *tinyLFUPolicy) move(key string, s tinyLFUSegment) {
+	e := p.entries[key]
+	p.list(e.segment).Remove(e.elem)
+	e.segment = s
+	e.elem = p.list(s).PushFront(key)
+}
+
+func (p *tinyLFUPolicy) Add(key string) {
+	if _, ok := p.entries[key]; ok {
+		return
+	}
+
+	p.entries[key] = &tinyLFUEntry{
+		segment: segmentWindow,
+		elem:    p.window.PushFront(key),
+	}
+
+	// sized as if the cache was full before key was added, the key leaving the window then competes with the main
+	// lru's victim if the cache turns out to be over its limit
+	if p.unbounded {
+		p.resize(len(p.entries) - 1)
+	}
+
+	// while the main lru has room, keys leaving the window are admitted without competition
+	for p.window.Len() > p.windowCap && p.mainLen() < p.mainCap {
+		p.move(p.window.Back().Value.(string), segmentProbation)
+	}
+}
+
+func (p *tinyLFUPolicy) mainLen() int {
+	return p.probation.Len() + p.protected.Len()
+}
+
+func (p *tinyLFUPolicy) Remove(key string) {
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+
+	p.list(e.segment).Remove(e.elem)
+	delete(p.entries, key)
+}
+
+func (p *tinyLFUPolicy) mainVictim() *list.Element {
+	if e := p.probation.Back(); e != nil {
+		return e
+	}
+
+	return p.protected.Back()
+}
+
+func (p *tinyLFUPolicy) Evict() (string, bool) {
+	candidate := p.window.Back()
+	victim := p.mainVictim()
+
+	switch {
+	case candidate == nil && victim == nil:
+		return "", false
+	case victim == nil:
+		return p.evict(candidate), true
+	case candidate == nil || p.window.Len() <= p.windowCap:
+		return p.evict(victim), true
+	}
+
+	// the key leaving the window competes with the main lru's victim, the less frequently used one is evicted
+	ck, vk := candidate.Value.(string), victim.Value.(string)
+	if p.sketch.estimate(ck) > p.sketch.estimate(vk) {
+		p.move(ck, segmentProbation)
+		return p.evict(victim), true
+	}
+
+	return p.evict(candidate), true
+}
+
+func (p *tinyLFUPolicy) evict(e *list.Element) string {
+	k := e.Value.(string)
+	p.Remove(k)
+	return k
+}
+
+func (p *tinyLFUPolicy) Reset() {
+	p.sketch.clear()
+	p.window.Init()
+	p.probation.Init()
+	p.protected.Init()
+	p.entries = map[string]*tinyLFUEntry{}
+}
@@ -0,0 +1,214 @@
+package csc
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLFUPolicy(t *testing.T) {
+	p := NewLFUPolicy()
+	p.Add("a")
+	p.Add("b")
+	p.Add("c")
+
+	p.Access("a")
+	p.Access("a")
+	p.Access("c")
+
+	// b has the lowest frequency, then c before a
+	for _, want := range []string{"b", "c", "a"} {
+		k, ok := p.Evict()
+		if !ok || k != want {
+			t.Fatalf("evicted %q, want %q", k, want)
+		}
+	}
+
+	if _, ok := p.Evict(); ok {
+		t.Fatal("evicted from empty policy")
+	}
+
+	// ties are broken by recency
+	p.Add("x")
+	p.Add("y")
+	p.Remove("x")
+	p.Add("z")
+	if k, _ := p.Evict(); k != "y" {
+		t.Fatalf("evicted %q, want y", k)
+	}
+}
+
+func TestTinyLFUPolicy_cache(t *testing.T) {
+	c := newCache(100, 0, 1, NewTinyLFUPolicy)
+
+	hot := make([]string, 50)
+	for i := range hot {
+		hot[i] = fmt.Sprintf("hot:%d", i)
+		c.set(hot[i], []byte("foobar"), 60)
+	}
+
+	for n := 0; n < 5; n++ {
+		for _, k := range hot {
+			if _, ok := c.getEntry(k); !ok {
+				t.Fatalf("miss on %s", k)
+			}
+		}
+	}
+
+	// a scan of one-off keys must not push out the hot keys
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("scan:%d", i)
+		c.getEntry(k)
+		c.set(k, []byte("foobar"), 60)
+	}
+
+	for _, k := range hot {
+		if _, ok := c.getEntry(k); !ok {
+			t.Fatalf("hot key %s evicted", k)
+		}
+	}
+
+	stats := c.stats()
+	if stats.NumEntries != 100 {
+		t.Fatalf("entries: %d", stats.NumEntries)
+	}
+
+	if int(stats.Evictions+stats.Rejections) != 1050-100 {
+		t.Fatalf("evictions: %d, rejections: %d", stats.Evictions, stats.Rejections)
+	}
+}
+
+func TestTinyLFUPolicy_maxBytes(t *testing.T) {
+	// only limited by size, every entry takes 14 bytes
+	c := newCache(0, 1400, 1, NewTinyLFUPolicy)
+
+	hot := make([]string, 50)
+	for i := range hot {
+		hot[i] = fmt.Sprintf("hot:%04d", i)
+		c.set(hot[i], []byte("foobar"), 60)
+	}
+
+	for n := 0; n < 5; n++ {
+		for _, k := range hot {
+			c.getEntry(k)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("scn:%04d", i)
+		c.getEntry(k)
+		c.set(k, []byte("foobar"), 60)
+	}
+
+	for _, k := range hot {
+		if _, ok := c.getEntry(k); !ok {
+			t.Fatalf("hot key %s evicted", k)
+		}
+	}
+
+	if n := c.stats().NumEntries; n != 100 {
+		t.Fatalf("entries: %d", n)
+	}
+}
+
+func TestCache_evictionPolicies(t *testing.T) {
+	policies := map[string]EvictionPolicy{
+		"lru":     NewLRUPolicy(),
+		"lfu":     NewLFUPolicy(),
+		"tinylfu": NewTinyLFUPolicy(10),
+	}
+
+	for name, p := range policies {
+		c := newCache(10, 0, 1, func(int) EvictionPolicy { return p })
+		shard := c.shards[0]
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("key:%d", i)
+			c.set(k, []byte("foobar"), 60)
+			c.get(k)
+
+			if i%3 == 0 {
+				c.delete(k)
+			}
+		}
+
+		if n := c.stats().NumEntries; n > 10 {
+			t.Fatalf("%s: entries: %d", name, n)
+		}
+
+		// the policy must track exactly the keys in the cache
+		for len(shard.entries) > 0 {
+			k, ok := p.Evict()
+			if !ok {
+				t.Fatalf("%s: policy lost keys, %d left", name, len(shard.entries))
+			}
+
+			if _, ok := shard.entries[k]; !ok {
+				t.Fatalf("%s: policy evicted unknown key %s", name, k)
+			}
+
+			delete(shard.entries, k)
+		}
+
+		if k, ok := p.Evict(); ok {
+			t.Fatalf("%s: policy has unknown key %s", name, k)
+		}
+	}
+}
+
+// admits no new keys once the cache is full
+type rejectNewPolicy struct {
+	EvictionPolicy
+	last string
+}
+
+func (p *rejectNewPolicy) Add(key string) {
+	p.EvictionPolicy.Add(key)
+	p.last = key
+}
+
+func (p *rejectNewPolicy) Evict() (string, bool) {
+	p.EvictionPolicy.Remove(p.last)
+	return p.last, true
+}
+
+func TestCache_reject(t *testing.T) {
+	c := newCache(2, 0, 1, func(int) EvictionPolicy { return &rejectNewPolicy{EvictionPolicy: NewLRUPolicy()} })
+	c.set("a", []byte("foobar"), 60)
+	c.set("b", []byte("foobar"), 60)
+	c.set("c", []byte("foobar"), 60)
+
+	if _, ok := c.getEntry("c"); ok {
+		t.Fatal("c not rejected")
+	}
+
+	stats := c.stats()
+	if stats.Rejections != 1 || stats.Evictions != 0 || stats.NumEntries != 2 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
+
+func TestCache_shardMaxBytes(t *testing.T) {
+	// the budget of a shard is 1/4 of maxBytes, a larger value isn't cached
+	big := make([]byte, 400)
+	c := newCache(0, 1000, 4, nil)
+	c.set("big", big, 60)
+
+	if _, ok := c.getEntry("big"); ok {
+		t.Fatal("big cached")
+	}
+
+	if stats := c.stats(); stats.Rejections != 1 || stats.NumEntries != 0 {
+		t.Fatalf("stats: %+v", stats)
+	}
+
+	// it fits the budget of a single shard
+	c = newCache(0, 1000, 1, nil)
+	c.set("big", big, 60)
+
+	if _, ok := c.getEntry("big"); !ok {
+		t.Fatal("big not cached")
+	}
+
+	if stats := c.stats(); stats.Rejections != 0 || stats.NumEntries != 1 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
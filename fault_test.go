@@ -0,0 +1,224 @@
+package csc
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jahaja/csc/redistest"
+	"github.com/gomodule/redigo/redis"
+)
+
+// wraps the connections of a pool with fault injecting ones
+type faultConns struct {
+	mu    sync.Mutex
+	conns map[ConnRole][]*redistest.FaultConn
+}
+
+func (f *faultConns) wrap(conn redis.Conn, role ConnRole) redis.Conn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conns == nil {
+		f.conns = map[ConnRole][]*redistest.FaultConn{}
+	}
+
+	fc := redistest.NewFaultConn(conn)
+	f.conns[role] = append(f.conns[role], fc)
+	return fc
+}
+
+// returns the last connection of role
+func (f *faultConns) last(role ConnRole) *redistest.FaultConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	conns := f.conns[role]
+	return conns[len(conns)-1]
+}
+
+func waitEvent(t *testing.T, events chan Event, typ EventType) {
+	t.Helper()
+
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == typ {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", typ)
+		}
+	}
+}
+
+func TestTrackingPool_invalidationLost(t *testing.T) {
+	key := "fault:invalidation"
+
+	s, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer s.Close()
+
+	var faults faultConns
+	pool := NewTrackingPool(PoolOptions{RedisAddress: s.Addr(), MaxEntries: 100, WrapConn: faults.wrap})
+	defer pool.Close()
+
+	events := make(chan Event, 10)
+	pool.Subscribe(func(e Event) {
+		events <- e
+	})
+
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+
+	s.Set(key, []byte("1"))
+	if v, err := c.Get(key); err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	// the invalidation connection fails with the invalidation
+	faults.last(ConnInvalidation).FailReceive(redistest.Fault{Close: true})
+	s.Set(key, []byte("2"))
+	waitEvent(t, events, EventOutOfSync)
+
+	// the stale value isn't served
+	if _, err := c.Get(key); err != ErrClosed {
+		t.Fatalf("err: %v", err)
+	}
+
+	c.Close()
+	if st := pool.PoolStats(); st.Discarded != 1 {
+		t.Fatalf("stats: %+v", st)
+	}
+
+	c, err = pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c.Close()
+
+	if v, err := c.Get(key); err != nil || string(v) != "2" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+}
+
+func TestTrackingPool_connFailed(t *testing.T) {
+	key := "fault:conn"
+
+	s, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer s.Close()
+
+	var faults faultConns
+	pool := NewTrackingPool(PoolOptions{RedisAddress: s.Addr(), MaxEntries: 100, WrapConn: faults.wrap})
+	defer pool.Close()
+
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+
+	s.Set(key, []byte("1"))
+	if v, err := c.Get(key); err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	// an error reply doesn't fail the client
+	conn := faults.last(ConnClient)
+	conn.FailCommand("GET", redistest.Fault{Err: redis.Error("ERR fault"), Times: 1})
+	if _, err := c.Get("other"); err == nil || c.isClosed() {
+		t.Fatalf("err: %v, closed: %v", err, c.isClosed())
+	}
+
+	// once the data connection is lost the server no longer tracks the keys read on it
+	conn.FailCommand("GET", redistest.Fault{Close: true})
+	if _, err := c.Get("other"); err == nil {
+		t.Fatal("no error")
+	}
+
+	s.Set(key, []byte("2"))
+	if _, err := c.Get(key); err != ErrClosed {
+		t.Fatalf("err: %v", err)
+	}
+
+	c.Close()
+	if st := pool.PoolStats(); st.Discarded != 1 || st.Active != 0 {
+		t.Fatalf("stats: %+v", st)
+	}
+}
+
+func TestBroadcastingPool_outOfSync(t *testing.T) {
+	key := "fault:broadcast"
+
+	s, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer s.Close()
+
+	var faults faultConns
+	pool, err := NewDefaultBroadcastingPool(PoolOptions{
+		RedisAddress:        s.Addr(),
+		MaxEntries:          100,
+		HealthCheckInterval: time.Millisecond * 10,
+		WrapConn:            faults.wrap,
+	})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer pool.Close()
+
+	events := make(chan Event, 10)
+	pool.Subscribe(func(e Event) {
+		events <- e
+	})
+
+	c, _ := pool.Get()
+	defer c.Close()
+
+	s.Set(key, []byte("1"))
+	if v, err := c.Get(key); err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	// the invalidation is lost and the tracking connection fails its health checks
+	faults.last(ConnInvalidation).FailReceive(redistest.Fault{Drop: true, Times: 1})
+	s.Set(key, []byte("2"))
+	faults.last(ConnTracking).FailCommand("PING", redistest.Fault{Err: errors.New("fault")})
+	waitEvent(t, events, EventOutOfSync)
+
+	// nothing is cached while out-of-sync
+	for i := 0; i < 2; i++ {
+		if v, err := c.Get(key); err != nil || string(v) != "2" {
+			t.Fatalf("v: %s, err: %v", v, err)
+		}
+	}
+
+	if n := c.Stats().NumEntries; n != 0 {
+		t.Fatalf("entries: %d", n)
+	}
+
+	// the pool reconnects with new connections and caches again
+	waitEvent(t, events, EventInSync)
+	if v, err := c.Get(key); err != nil || string(v) != "2" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	if _, ok := c.cache.getEntry(key); !ok {
+		t.Fatal("not cached")
+	}
+
+	s.Set(key, []byte("3"))
+	waitInvalidated(c, key)
+	if v, err := c.Get(key); err != nil || string(v) != "3" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+}
@@ -2,4 +2,4 @@ module github.com/Jahaja/csc
 
 go 1.16
 
-require github.com/gomodule/redigo v1.8.4
+require github.com/gomodule/redigo v1.8.9
@@ -0,0 +1,208 @@
+package csc
+
+import (
+	"context"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// hashValue is the cached part of a hash
+type hashValue struct {
+	// nil values are fields known to be missing
+	fields map[string][]byte
+	// all fields of the hash are cached
+	complete bool
+}
+
+func (h *hashValue) get(field string) ([]byte, bool) {
+	if h == nil {
+		return nil, false
+	}
+
+	v, ok := h.fields[field]
+	return v, ok || h.complete
+}
+
+// returns a copy of h with fields set to values, nil values mark fields as missing
+func (h *hashValue) with(fields []string, values [][]byte) *hashValue {
+	nh := &hashValue{fields: make(map[string][]byte, len(fields))}
+	if h != nil {
+		for f, v := range h.fields {
+			nh.fields[f] = v
+		}
+	}
+
+	for i, f := range fields {
+		nh.fields[f] = values[i]
+	}
+
+	return nh
+}
+
+func (h *hashValue) size() int {
+	n := 0
+	for f, v := range h.fields {
+		n += len(f) + len(v)
+	}
+
+	return n
+}
+
+func cachedHash(v interface{}) *hashValue {
+	h, _ := v.(*hashValue)
+	return h
+}
+
+// HGet gets field of the hash at key, redis.ErrNil is returned if it's missing. The fields read are cached together
+// and invalidated as a whole when the hash changes
+func (c *Client) HGet(key, field string) ([]byte, error) {
+	return c.HGetContext(context.Background(), key, field)
+}
+
+// HGetContext is like HGet but returns ctx's error if it's done before Redis replies
+func (c *Client) HGetContext(ctx context.Context, key, field string) ([]byte, error) {
+	return c.HGetWithHint(ctx, key, field, CacheDefault)
+}
+
+// HGetWithHint is like HGetContext but hint selects whether the hash is cached and, in OPTIN and OPTOUT tracking
+// modes, tracked by the server
+func (c *Client) HGetWithHint(ctx context.Context, key, field string, hint CacheHint) ([]byte, error) {
+	vs, err := c.HMGetWithHint(ctx, key, hint, field)
+	if err != nil {
+		return nil, err
+	}
+
+	if vs[0] == nil {
+		return nil, redis.ErrNil
+	}
+
+	return vs[0], nil
+}
+
+// HMGet gets fields of the hash at key, the values of missing fields are nil. Like HGet only fields that aren't
+// cached are read from Redis
+func (c *Client) HMGet(key string, fields ...string) ([][]byte, error) {
+	return c.HMGetContext(context.Background(), key, fields...)
+}
+
+// HMGetContext is like HMGet but returns ctx's error if it's done before Redis replies
+func (c *Client) HMGetContext(ctx context.Context, key string, fields ...string) ([][]byte, error) {
+	return c.HMGetWithHint(ctx, key, CacheDefault, fields...)
+}
+
+// HMGetWithHint is like HMGetContext but hint selects whether the hash is cached and, in OPTIN and OPTOUT tracking
+// modes, tracked by the server
+func (c *Client) HMGetWithHint(ctx context.Context, key string, hint CacheHint, fields ...string) ([][]byte, error) {
+	var missing []string
+	res, err := c.readObject(ctx, key, hint, objectRead{
+		local: func(v interface{}) (interface{}, bool) {
+			h := cachedHash(v)
+			values := make([][]byte, len(fields))
+			missing = missing[:0]
+			for i, f := range fields {
+				var ok bool
+				if values[i], ok = h.get(f); !ok {
+					missing = append(missing, f)
+				}
+			}
+
+			return values, len(missing) == 0
+		},
+		cmd: "HMGET",
+		args: func() []interface{} {
+			return redis.Args{}.Add(c.prefixKey(key)).AddFlat(missing)
+		},
+		merge: func(v interface{}, reply interface{}) (interface{}, int, error) {
+			values, err := redis.ByteSlices(reply, nil)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			h := cachedHash(v).with(missing, values)
+			return h, h.size(), nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.([][]byte), nil
+}
+
+// HGetAll gets all fields of the hash at key, it's empty if the hash is missing. The returned map is a copy of the
+// cached hash
+func (c *Client) HGetAll(key string) (map[string][]byte, error) {
+	return c.HGetAllContext(context.Background(), key)
+}
+
+// HGetAllContext is like HGetAll but returns ctx's error if it's done before Redis replies
+func (c *Client) HGetAllContext(ctx context.Context, key string) (map[string][]byte, error) {
+	return c.HGetAllWithHint(ctx, key, CacheDefault)
+}
+
+// HGetAllWithHint is like HGetAllContext but hint selects whether the hash is cached and, in OPTIN and OPTOUT
+// tracking modes, tracked by the server
+func (c *Client) HGetAllWithHint(ctx context.Context, key string, hint CacheHint) (map[string][]byte, error) {
+	res, err := c.readObject(ctx, key, hint, objectRead{
+		local: func(v interface{}) (interface{}, bool) {
+			h := cachedHash(v)
+			if h == nil || !h.complete {
+				return nil, false
+			}
+
+			m := make(map[string][]byte, len(h.fields))
+			for f, v := range h.fields {
+				m[f] = v
+			}
+
+			return m, true
+		},
+		cmd: "HGETALL",
+		args: func() []interface{} {
+			return []interface{}{c.prefixKey(key)}
+		},
+		merge: func(_ interface{}, reply interface{}) (interface{}, int, error) {
+			values, err := redis.ByteSlices(reply, nil)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			h := &hashValue{fields: make(map[string][]byte, len(values)/2), complete: true}
+			for i := 0; i+1 < len(values); i += 2 {
+				h.fields[string(values[i])] = values[i+1]
+			}
+
+			return h, h.size(), nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(map[string][]byte), nil
+}
+
+// HSet sets fields of the hash at key in Redis and drops the locally cached hash
+func (c *Client) HSet(key string, fields map[string][]byte) error {
+	return c.HSetContext(context.Background(), key, fields)
+}
+
+// HSetContext is like HSet but returns ctx's error if it's done before Redis replies
+func (c *Client) HSetContext(ctx context.Context, key string, fields map[string][]byte) error {
+	args := make([]interface{}, 0, len(fields)*2)
+	for f, v := range fields {
+		args = append(args, f, v)
+	}
+
+	return c.writeObject(ctx, c.prefixKey(key), "HSET", args...)
+}
+
+// HDel deletes fields of the hash at key in Redis and drops the locally cached hash
+func (c *Client) HDel(key string, fields ...string) error {
+	return c.HDelContext(context.Background(), key, fields...)
+}
+
+// HDelContext is like HDel but returns ctx's error if it's done before Redis replies
+func (c *Client) HDelContext(ctx context.Context, key string, fields ...string) error {
+	return c.writeObject(ctx, c.prefixKey(key), "HDEL", redis.Args{}.AddFlat(fields)...)
+}
@@ -0,0 +1,93 @@
+package csc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestClient_hash(t *testing.T) {
+	key := "hash"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100})
+	c1, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c1.Close()
+
+	c2, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c2.Close()
+
+	c2.Delete(key)
+	defer c2.Delete(key)
+
+	if err := c2.HSet(key, map[string][]byte{"a": []byte("1"), "b": []byte("2")}); err != nil {
+		t.Fatalf("failed to hset: %v", err)
+	}
+
+	if v, err := c1.HGet(key, "a"); err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	if _, err := c1.HGet(key, "c"); err != redis.ErrNil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// both fields read are cached, the missing one too
+	misses := c1.Stats().Misses
+	vs, err := c1.HMGet(key, "a", "c")
+	if err != nil || string(vs[0]) != "1" || vs[1] != nil {
+		t.Fatalf("vs: %q, err: %v", vs, err)
+	}
+
+	if st := c1.Stats(); st.Misses != misses || st.NumEntries != 1 {
+		t.Fatalf("stats: %+v", st)
+	}
+
+	// a field that isn't cached is read from redis and merged into the cached hash
+	if v, err := c1.HGet(key, "b"); err != nil || string(v) != "2" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	ce, _ := c1.cache.getEntry(key)
+	if h := cachedHash(ce.value); h == nil || h.complete || len(h.fields) != 3 {
+		t.Fatalf("cached: %#v", ce.value)
+	}
+
+	all, err := c1.HGetAll(key)
+	if err != nil {
+		t.Fatalf("failed to hgetall: %v", err)
+	}
+
+	if want := map[string][]byte{"a": []byte("1"), "b": []byte("2")}; !reflect.DeepEqual(all, want) {
+		t.Fatalf("all: %q", all)
+	}
+
+	// the whole hash is invalidated by a change of any field
+	if err := c2.HDel(key, "b"); err != nil {
+		t.Fatalf("failed to hdel: %v", err)
+	}
+
+	waitInvalidated(c1, key)
+	if _, err := c1.HGet(key, "b"); err != redis.ErrNil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// the writing client isn't invalidated by the server but drops its own copy
+	if _, err := c2.HGetAll(key); err != nil {
+		t.Fatalf("failed to hgetall: %v", err)
+	}
+
+	if err := c2.HSet(key, map[string][]byte{"b": []byte("3")}); err != nil {
+		t.Fatalf("failed to hset: %v", err)
+	}
+
+	if v, err := c2.HGet(key, "b"); err != nil || string(v) != "3" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+}
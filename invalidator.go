@@ -0,0 +1,152 @@
+package csc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var errInvalidatorFailed = errors.New("invalidation connection failed")
+
+// invalidator is an invalidation connection shared by tracking clients, which redirect their invalidations to it.
+// Redis doesn't tell which client an invalidation is for, so keys are deleted from the caches of all registered
+// clients, which is a no-op for caches that don't hold them
+type invalidator struct {
+	conn redis.Conn
+	// address of the server, clients redirecting to the connection must be connected to it
+	addr string
+	// client id of the connection, the redirect target
+	id      int
+	mu      sync.Mutex
+	clients map[*Client]struct{}
+	// set once the connection failed, the registered clients are then out-of-sync
+	failed bool
+	// set when the connection is closed on purpose
+	closed bool
+	pool   *TrackingPool
+}
+
+// dials an invalidation connection of p and starts receiving invalidations, p.invalidatorFailed is called once it
+// fails unless it's closed
+func dialInvalidator(ctx context.Context, p *TrackingPool) (*invalidator, error) {
+	opts := &p.options
+	addr, err := p.address()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := redis.DialContext(ctx, "tcp", addr, redis.DialDatabase(opts.RedisDatabase))
+	if err != nil {
+		return nil, err
+	}
+
+	conn = opts.wrapConn(conn, ConnInvalidation)
+	id, err := redis.Int(conn.Do("CLIENT", "ID"))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	inv := &invalidator{
+		conn:    conn,
+		addr:    addr,
+		id:      id,
+		clients: map[*Client]struct{}{},
+		pool:    p,
+	}
+
+	dlog("invalidator.dial: %p cid=%d\n", inv, id)
+	go func() {
+		err := invalidationsReceiver(conn, inv.invalidate)
+		dlog("invalidator.fail: %p err=%v\n", inv, err)
+		if inv.fail() {
+			p.invalidatorFailed(inv)
+		}
+	}()
+
+	return inv, nil
+}
+
+// deletes keys from the caches of the registered clients, or clears them if keys is nil. Redis sends a flush to each
+// client redirecting to the connection, so caches already emptied by a previous one aren't cleared, and counted, again
+// and the flush event is only sent if a cache was cleared
+func (inv *invalidator) invalidate(keys []string) {
+	atomic.AddUint64(&inv.pool.counters.invalidations, 1)
+
+	inv.mu.Lock()
+	dlog("invalidator.invalidating: %p n=%d k=%s\n", inv, len(inv.clients), keys)
+	cleared := false
+	for c := range inv.clients {
+		if keys == nil && c.cache.empty() {
+			continue
+		}
+
+		c.cache.invalidate(keys)
+		cleared = true
+	}
+	inv.mu.Unlock()
+
+	if keys != nil || cleared {
+		inv.pool.events.invalidated(keys)
+	}
+}
+
+// registers c to receive invalidations, fails if the connection has failed
+func (inv *invalidator) add(c *Client) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if inv.failed {
+		return errInvalidatorFailed
+	}
+
+	inv.clients[c] = struct{}{}
+	c.invalidator = inv
+	return nil
+}
+
+func (inv *invalidator) remove(c *Client) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	delete(inv.clients, c)
+}
+
+func (inv *invalidator) numClients() int {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	return len(inv.clients)
+}
+
+// marks the registered clients as closed since they miss invalidations from now on, returns false if the connection
+// was closed on purpose
+func (inv *invalidator) fail() bool {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	inv.failed = true
+	for c := range inv.clients {
+		c.setClosed()
+	}
+
+	return !inv.closed
+}
+
+func (inv *invalidator) isFailed() bool {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	return inv.failed
+}
+
+func (inv *invalidator) close() error {
+	inv.mu.Lock()
+	inv.closed = true
+	inv.mu.Unlock()
+
+	return inv.conn.Close()
+}
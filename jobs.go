@@ -7,11 +7,58 @@ import (
 	"github.com/gomodule/redigo/redis"
 )
 
-func invalidationsReceiver(conn redis.Conn, c *cache) error {
-	if _, err := conn.Do("SUBSCRIBE", "__redis__:invalidate"); err != nil {
+// bounds the commands setting up the tracking of a pool, and dialing its connections where the pool dials them
+const setupTimeout = time.Second * 5
+
+// subscribes conn to the invalidations redirected to it
+func subscribeInvalidations(conn redis.Conn) error {
+	_, err := doWithTimeout(conn, setupTimeout, "SUBSCRIBE", "__redis__:invalidate")
+	return err
+}
+
+// subscribes iconn to invalidations and enables broadcasting tracking of prefixes on conn, redirected to iconn
+func enableBroadcastTracking(conn, iconn redis.Conn, prefixes []string) error {
+	cid, err := redis.Int(doWithTimeout(iconn, setupTimeout, "CLIENT", "ID"))
+	if err != nil {
+		return err
+	}
+
+	// subscribed before tracking is enabled so that no invalidations are missed
+	if err := subscribeInvalidations(iconn); err != nil {
+		return err
+	}
+
+	args := redis.Args{}
+	args = append(args, "TRACKING", "ON", "REDIRECT", cid, "BCAST")
+	for _, prefix := range prefixes {
+		args = append(args, "PREFIX", prefix)
+	}
+
+	_, err = doWithTimeout(conn, setupTimeout, "CLIENT", args...)
+	return err
+}
+
+// runs cmd on conn with a read timeout, without one if conn, e.g. wrapped by PoolOptions.WrapConn, doesn't support it
+func doWithTimeout(conn redis.Conn, timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	if cwt, ok := conn.(redis.ConnWithTimeout); ok {
+		return cwt.DoWithTimeout(timeout, cmd, args...)
+	}
+
+	return conn.Do(cmd, args...)
+}
+
+// subscribes conn to invalidations and receives them until conn fails, see receiveInvalidations
+func invalidationsReceiver(conn redis.Conn, invalidate func(keys []string)) error {
+	if err := subscribeInvalidations(conn); err != nil {
 		return err
 	}
 
+	return receiveInvalidations(conn, invalidate)
+}
+
+// receives invalidations on the subscribed conn and passes the invalidated keys to invalidate until conn fails. the keys
+// are nil when all keys are invalidated, like on FLUSHDB or FLUSHALL
+func receiveInvalidations(conn redis.Conn, invalidate func(keys []string)) error {
 	fails := 0
 	for {
 		if fails >= 5 {
@@ -20,6 +67,11 @@ func invalidationsReceiver(conn redis.Conn, c *cache) error {
 
 		reply, err := conn.Receive()
 		if err != nil {
+			// the connection is closed
+			if conn.Err() != nil {
+				return err
+			}
+
 			fails++
 			Logger.Println("failed to receive from subscription:", err.Error())
 			continue
@@ -43,13 +95,15 @@ func invalidationsReceiver(conn redis.Conn, c *cache) error {
 
 		// values[1] is channel name, skip for now
 		keys, err := redis.Strings(values[2], nil)
-		if err != nil && err != redis.ErrNil {
+		if err == redis.ErrNil {
+			// a null array, all keys are invalidated
+			keys = nil
+		} else if err != nil {
 			Logger.Println("failed to parse subscription reply keys:", err.Error())
 			continue
 		}
 
-		dlog("client.invalidating: %p k=%s\n", c, keys)
-		c.delete(keys...)
+		invalidate(keys)
 	}
 }
 
@@ -0,0 +1,284 @@
+package csc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Loader computes the value of a key that's missing in Redis, e.g. from a database
+type Loader func() ([]byte, error)
+
+var errLoaderPanicked = errors.New("loader panicked")
+
+// max duration of a background refresh, including waiting for a client
+const refreshTimeout = time.Second * 30
+
+type loadCall struct {
+	// closed when the load is done
+	done  chan struct{}
+	entry Entry
+	err   error
+}
+
+// loadGroup de-duplicates concurrent loads of the same key, there's one per cache so that loads are shared by all
+// clients using the cache
+type loadGroup struct {
+	mu    sync.Mutex
+	calls map[string]*loadCall
+}
+
+// begin registers a load of key, it returns the load in progress and false if there already is one
+func (g *loadGroup) begin(key string) (*loadCall, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.calls == nil {
+		g.calls = map[string]*loadCall{}
+	}
+
+	if lc, ok := g.calls[key]; ok {
+		return lc, false
+	}
+
+	lc := &loadCall{done: make(chan struct{}), err: errLoaderPanicked}
+	g.calls[key] = lc
+	return lc, true
+}
+
+// end publishes the result of a load begun with begin
+func (g *loadGroup) end(key string, lc *loadCall) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(lc.done)
+}
+
+// do runs fn unless a load of key is already in progress, in which case it waits for that load's result until ctx
+// is done. shared reports whether the result came from another caller's load
+func (g *loadGroup) do(ctx context.Context, key string, fn func() (Entry, error)) (e Entry, shared bool, err error) {
+	lc, ok := g.begin(key)
+	if !ok {
+		dlog("load.wait: %p k=%s\n", g, key)
+		select {
+		case <-lc.done:
+			return lc.entry, true, lc.err
+		case <-ctx.Done():
+			return Entry{}, true, ctx.Err()
+		}
+	}
+
+	defer g.end(key, lc)
+
+	lc.entry, lc.err = fn()
+	return lc.entry, false, lc.err
+}
+
+// GetOrLoad gets key, calling loader to compute it on a miss. The loaded value is set in Redis with expires and cached.
+// Concurrent calls for the same key by clients sharing a cache, like all clients of a BroadcastingPool, call loader
+// only once and share its result.
+func (c *Client) GetOrLoad(key string, expires int, loader Loader) ([]byte, error) {
+	e, err := c.GetOrLoadEntryContext(context.Background(), key, expires, loader)
+	return e.Data, err
+}
+
+// GetOrLoadContext is like GetOrLoad but returns ctx's error if it's done before the value is loaded. A call waiting
+// for another caller's load gets that load's result, including its error if the other caller's context is done
+func (c *Client) GetOrLoadContext(ctx context.Context, key string, expires int, loader Loader) ([]byte, error) {
+	e, err := c.GetOrLoadEntryContext(ctx, key, expires, loader)
+	return e.Data, err
+}
+
+func (c *Client) GetOrLoadEntry(key string, expires int, loader Loader) (Entry, error) {
+	return c.GetOrLoadEntryContext(context.Background(), key, expires, loader)
+}
+
+// GetOrLoadEntryContext is like GetOrLoadContext but returns the entry. With PoolOptions.StaleTTL set, a stale entry
+// is returned while it's refreshed in the background
+func (c *Client) GetOrLoadEntryContext(ctx context.Context, key string, expires int, loader Loader) (Entry, error) {
+	return c.GetOrLoadEntryWithHint(ctx, key, expires, loader, CacheDefault)
+}
+
+// GetOrLoadWithHint is like GetOrLoadContext but hint selects whether the value is cached and, in OPTIN and OPTOUT
+// tracking modes, tracked by the server
+func (c *Client) GetOrLoadWithHint(ctx context.Context, key string, expires int, loader Loader, hint CacheHint) ([]byte, error) {
+	e, err := c.GetOrLoadEntryWithHint(ctx, key, expires, loader, hint)
+	return e.Data, err
+}
+
+// GetOrLoadEntryWithHint is like GetOrLoadEntryContext with a hint, see GetOrLoadWithHint
+func (c *Client) GetOrLoadEntryWithHint(ctx context.Context, key string, expires int, loader Loader, hint CacheHint) (Entry, error) {
+	if c.isClosed() {
+		return Entry{}, ErrClosed
+	}
+
+	pkey := c.prefixKey(key)
+	e, ok := c.localEntry(pkey)
+	if !ok {
+		var shared bool
+		var err error
+		e, shared, err = c.cache.loads.do(ctx, pkey, func() (Entry, error) {
+			return c.load(ctx, key, expires, loader, hint)
+		})
+
+		dlog("client.getorload: %p k=%s shared=%t\n", c, pkey, shared)
+		if err != nil {
+			return Entry{}, err
+		}
+	}
+
+	if c.shouldRefresh(e) {
+		c.refresh(key, expires, loader)
+	}
+
+	return e, nil
+}
+
+// load reads key from Redis and calls loader if it's missing, hint selects whether the value is cached
+func (c *Client) load(ctx context.Context, key string, expires int, loader Loader, hint CacheHint) (Entry, error) {
+	e, err := c.getEntry(ctx, key, hint)
+	if err == nil {
+		return e, nil
+	}
+
+	if err != redis.ErrNil {
+		return Entry{}, err
+	}
+
+	return c.loadMissing(ctx, key, expires, loader, hint)
+}
+
+func (c *Client) loadMissing(ctx context.Context, key string, expires int, loader Loader, hint CacheHint) (Entry, error) {
+	if c.pool.Options().LoadLock != nil {
+		return c.lockedLoad(ctx, key, expires, loader, hint)
+	}
+
+	return c.loadAndStore(ctx, c.prefixKey(key), expires, loader, hint)
+}
+
+// calls loader and stores its value in key, which is prefixed. the value is only cached if hint allows it, the key
+// must then have been read with the same hint to be tracked
+func (c *Client) loadAndStore(ctx context.Context, key string, expires int, loader Loader, hint CacheHint) (Entry, error) {
+	start := nowFunc()
+	data, err := loader()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	delta := nowFunc().Sub(start)
+
+	// stale values are kept in redis so that other instances can serve them too, values without expires never go stale
+	if expires > NoExpire {
+		expires += c.pool.Options().StaleTTL
+	}
+
+	cache, _ := c.caching(key, hint)
+	if err := c.store(ctx, key, data, expires, delta, cache); err != nil {
+		return Entry{}, err
+	}
+
+	e := Entry{Data: data, delta: delta}
+	if expires > NoExpire {
+		e.Expires = nowFunc().Add(time.Second * time.Duration(expires))
+	}
+
+	return e, nil
+}
+
+// sets key to value in Redis, without expiry if expires is NoExpire
+func (c *Client) setWithExpiry(ctx context.Context, key string, value []byte, expires int) error {
+	var err error
+	if expires > NoExpire {
+		_, err = c.do(ctx, "SETEX", key, expires, value)
+	} else {
+		_, err = c.do(ctx, "SET", key, value)
+	}
+
+	return err
+}
+
+// store sets a loaded value in Redis and, if cache is set, caches it unless the key is invalidated meanwhile
+func (c *Client) store(ctx context.Context, key string, data []byte, expires int, delta time.Duration, cache bool) error {
+	raw, err := c.encodeValue(data)
+	if err != nil {
+		return err
+	}
+
+	if !cache {
+		return c.setWithExpiry(ctx, key, raw, expires)
+	}
+
+	c.cache.set(key, []byte(cacheInProgressSentinel), 30)
+	if err := c.setWithExpiry(ctx, key, raw, expires); err != nil {
+		c.cache.deleteSentinel(key)
+		return err
+	}
+
+	if co := c.pool.Options().Compression; co == nil || !co.CacheCompressed {
+		raw = data
+	}
+
+	if c.cache.replaceSentinel(key, raw, expires) {
+		c.cache.setDelta(key, delta)
+	}
+
+	return nil
+}
+
+// reports whether the value of e should be refreshed, because it's stale or, with XFetch, with a probability that
+// increases as it approaches going stale
+func (c *Client) shouldRefresh(e Entry) bool {
+	opts := c.pool.Options()
+	if e.Expires.IsZero() || (opts.StaleTTL <= 0 && opts.EarlyRefreshBeta <= 0) {
+		return false
+	}
+
+	if e.Stale {
+		return true
+	}
+
+	if opts.EarlyRefreshBeta <= 0 {
+		return false
+	}
+
+	// 1 - Float64 is in (0, 1], keeping the log finite
+	early := -float64(e.delta) * opts.EarlyRefreshBeta * math.Log(1-rand.Float64())
+	return !nowFunc().Add(time.Duration(early)).Before(c.staleAt(e.Expires))
+}
+
+// refreshes key in the background with a client of its own, unless it's being loaded already. calls waiting for the
+// key meanwhile share the refresh's result
+func (c *Client) refresh(key string, expires int, loader Loader) {
+	pkey := c.prefixKey(key)
+	lc, ok := c.cache.loads.begin(pkey)
+	if !ok {
+		return
+	}
+
+	dlog("client.refresh: %p k=%s\n", c, pkey)
+	go func() {
+		defer c.cache.loads.end(pkey, lc)
+
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+
+		rc, err := c.pool.GetContext(ctx)
+		if err != nil {
+			lc.err = err
+			Logger.Println("failed to get a client to refresh a key:", err.Error())
+			return
+		}
+		defer rc.Close()
+
+		// the refreshing client hasn't read the key, so it isn't tracked for it and mustn't cache it
+		lc.entry, lc.err = rc.loadMissing(ctx, key, expires, loader, CacheNo)
+		if lc.err != nil {
+			Logger.Println("failed to refresh a key:", lc.err.Error())
+		}
+	}()
+}
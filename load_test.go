@@ -0,0 +1,219 @@
+package csc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestClient_GetOrLoad(t *testing.T) {
+	key := "getorload"
+	value := "loaded"
+
+	pool, err := NewDefaultBroadcastingPool(PoolOptions{MaxEntries: 100, RedisAddress: redisAddress})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	c, _ := pool.Get()
+	if err := c.Delete(key); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	c.Close()
+
+	var loads uint32
+	loader := func() ([]byte, error) {
+		atomic.AddUint32(&loads, 1)
+		time.Sleep(time.Millisecond * 100)
+		return []byte(value), nil
+	}
+
+	// concurrent loads by clients sharing the pool's cache call the loader once
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c, _ := pool.Get()
+			defer c.Close()
+
+			data, err := c.GetOrLoad(key, 60, loader)
+			if err != nil || string(data) != value {
+				t.Errorf("data: %s, err: %v", data, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if loads != 1 {
+		t.Fatalf("loads: %d", loads)
+	}
+
+	// the loaded value is stored in redis
+	c, _ = pool.Get()
+	defer c.Close()
+
+	c.Flush()
+	data, err := c.Get(key)
+	if err != nil || string(data) != value {
+		t.Fatalf("data: %s, err: %v", data, err)
+	}
+
+	if _, err := c.GetOrLoad(key, 60, loader); err != nil || loads != 1 {
+		t.Fatalf("loads: %d, err: %v", loads, err)
+	}
+
+	// errors aren't cached
+	errLoad := errors.New("load failed")
+	if _, err := c.GetOrLoad("getorload:missing", 60, func() ([]byte, error) { return nil, errLoad }); err != errLoad {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, ok := c.cache.getEntry("getorload:missing"); ok {
+		t.Fatal("sentinel left in cache")
+	}
+
+	c.Delete(key)
+}
+
+func TestClient_GetOrLoad_stale(t *testing.T) {
+	key := "getorload:stale"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100, StaleTTL: 60})
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c.Close()
+
+	c.Delete(key)
+
+	var loads uint32
+	loader := func() ([]byte, error) {
+		n := atomic.AddUint32(&loads, 1)
+		return []byte(fmt.Sprintf("v%d", n)), nil
+	}
+
+	e, err := c.GetOrLoadEntry(key, 1, loader)
+	if err != nil || string(e.Data) != "v1" || e.Stale {
+		t.Fatalf("entry: %+v, err: %v", e, err)
+	}
+
+	// the value is kept in redis for the stale period
+	if ttl, err := redis.Int(c.Conn().Do("TTL", key)); err != nil || ttl != 61 {
+		t.Fatalf("ttl: %d, err: %v", ttl, err)
+	}
+
+	// past expires the stale value is served while it's refreshed in the background
+	nowFunc = func() time.Time {
+		return time.Now().Add(time.Second * 2)
+	}
+	defer func() {
+		nowFunc = time.Now
+	}()
+
+	e, err = c.GetOrLoadEntry(key, 1, loader)
+	if err != nil || string(e.Data) != "v1" || !e.Stale || !e.LocalHit {
+		t.Fatalf("entry: %+v, err: %v", e, err)
+	}
+
+	// the refresh is done once its load is
+	for i := 0; i < 100; i++ {
+		c.cache.loads.mu.Lock()
+		_, loading := c.cache.loads.calls[key]
+		c.cache.loads.mu.Unlock()
+		if !loading {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// the refresh's write invalidates the stale value
+	time.Sleep(time.Millisecond * 100)
+	nowFunc = time.Now
+
+	e, err = c.GetOrLoadEntry(key, 1, loader)
+	if err != nil || string(e.Data) != "v2" || e.Stale {
+		t.Fatalf("entry: %+v, err: %v", e, err)
+	}
+
+	if n := atomic.LoadUint32(&loads); n != 2 {
+		t.Fatalf("loads: %d", n)
+	}
+
+	c.Delete(key)
+}
+
+func TestClient_GetOrLoad_noExpireStale(t *testing.T) {
+	key := "getorload:noexpire"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100, StaleTTL: 60})
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c.Close()
+
+	c.Delete(key)
+
+	var loads uint32
+	loader := func() ([]byte, error) {
+		atomic.AddUint32(&loads, 1)
+		return []byte("v"), nil
+	}
+
+	e, err := c.GetOrLoadEntry(key, NoExpire, loader)
+	if err != nil || string(e.Data) != "v" || e.Stale || !e.Expires.IsZero() {
+		t.Fatalf("entry: %+v, err: %v", e, err)
+	}
+
+	// the value doesn't get the stale period as ttl
+	if ttl, err := redis.Int(c.Conn().Do("TTL", key)); err != nil || ttl != -1 {
+		t.Fatalf("ttl: %d, err: %v", ttl, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		e, err := c.GetOrLoadEntry(key, NoExpire, loader)
+		if err != nil || e.Stale || !e.LocalHit {
+			t.Fatalf("entry: %+v, err: %v", e, err)
+		}
+	}
+
+	if n := atomic.LoadUint32(&loads); n != 1 {
+		t.Fatalf("loads: %d", n)
+	}
+
+	c.Delete(key)
+}
+
+func TestClient_shouldRefresh(t *testing.T) {
+	pool := NewTrackingPool(PoolOptions{MaxEntries: 100, StaleTTL: 10})
+	c := &Client{pool: pool, cache: pool.options.newCache(nil)}
+
+	fresh := Entry{Expires: time.Now().Add(time.Second * 11), delta: time.Second}
+	if c.shouldRefresh(fresh) {
+		t.Fatal("fresh entry refreshed")
+	}
+
+	if !c.shouldRefresh(Entry{Expires: time.Now().Add(time.Second * 9), Stale: true}) {
+		t.Fatal("stale entry not refreshed")
+	}
+
+	// a large beta makes an early refresh near certain, a tiny one near impossible
+	pool.options.EarlyRefreshBeta = 1e6
+	if !c.shouldRefresh(fresh) {
+		t.Fatal("entry not refreshed early")
+	}
+
+	pool.options.EarlyRefreshBeta = 1e-6
+	if c.shouldRefresh(fresh) {
+		t.Fatal("entry refreshed early")
+	}
+}
@@ -0,0 +1,175 @@
+package csc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const loadLockKeyPrefix = "__csc:lock:"
+
+const (
+	defaultLoadLockTTL          = time.Second * 5
+	defaultLoadLockPollInterval = time.Millisecond * 50
+)
+
+// ErrLoadLockTimeout is returned by GetOrLoad when another instance holds the load lock for longer than the wait
+// timeout and the fallback is LoadFallbackError
+var ErrLoadLockTimeout = errors.New("timed out waiting for the load lock")
+
+// LoadFallback selects what GetOrLoad does when another instance's load takes longer than the wait timeout
+type LoadFallback int
+
+const (
+	// LoadFallbackLoad calls the loader without the lock
+	LoadFallbackLoad LoadFallback = iota
+	// LoadFallbackError returns ErrLoadLockTimeout
+	LoadFallbackError
+)
+
+// LoadLockOptions configures a lock in Redis that makes GetOrLoad call the loader of a missing key on only one app
+// instance at a time. Other instances poll Redis for the loaded value while the lock is held.
+type LoadLockOptions struct {
+	// how long the lock is held at most, a loader running longer lets another instance load as well. defaults to 5s
+	TTL time.Duration
+	// how long to wait for another instance's load before falling back. defaults to TTL
+	WaitTimeout time.Duration
+	// how often to check for the loaded value while waiting. defaults to 50ms
+	PollInterval time.Duration
+	Fallback     LoadFallback
+}
+
+func (o *LoadLockOptions) ttl() time.Duration {
+	if o.TTL > 0 {
+		return o.TTL
+	}
+
+	return defaultLoadLockTTL
+}
+
+func (o *LoadLockOptions) waitTimeout() time.Duration {
+	if o.WaitTimeout > 0 {
+		return o.WaitTimeout
+	}
+
+	return o.ttl()
+}
+
+func (o *LoadLockOptions) pollInterval() time.Duration {
+	if o.PollInterval > 0 {
+		return o.PollInterval
+	}
+
+	return defaultLoadLockPollInterval
+}
+
+// lockedLoad calls loader for the missing or stale key while holding the load lock, or waits for the instance holding
+// it to set the key
+func (c *Client) lockedLoad(ctx context.Context, key string, expires int, loader Loader, hint CacheHint) (Entry, error) {
+	opts := c.pool.Options().LoadLock
+	pkey := c.prefixKey(key)
+	lockKey := loadLockKeyPrefix + pkey
+
+	token, err := newLockToken()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	deadline := nowFunc().Add(opts.waitTimeout())
+	for {
+		// the lock is free again if the holder failed or its lock expired before the key was set
+		ok, err := c.acquireLock(ctx, lockKey, token, opts.ttl())
+		if err != nil {
+			return Entry{}, err
+		}
+
+		if ok {
+			dlog("client.lock.acquired: %p k=%s\n", c, lockKey)
+			defer c.releaseLock(ctx, lockKey, token)
+
+			return c.loadAndStore(ctx, pkey, expires, loader, hint)
+		}
+
+		if !nowFunc().Before(deadline) {
+			dlog("client.lock.timeout: %p k=%s\n", c, lockKey)
+			if opts.Fallback == LoadFallbackError {
+				return Entry{}, ErrLoadLockTimeout
+			}
+
+			return c.loadAndStore(ctx, pkey, expires, loader, hint)
+		}
+
+		if err := sleepContext(ctx, opts.pollInterval()); err != nil {
+			return Entry{}, err
+		}
+
+		e, err := c.getEntry(ctx, key, hint)
+		if err == nil {
+			return e, nil
+		}
+
+		if err != redis.ErrNil {
+			return Entry{}, err
+		}
+	}
+}
+
+func (c *Client) acquireLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	_, err := redis.String(c.do(ctx, "SET", key, token, "NX", "PX", ttl.Milliseconds()))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// releases the lock if it's still held with token, it may have expired and been acquired by another instance.
+// this uses an optimistic transaction rather than a script so that it works where scripting is disabled
+func (c *Client) releaseLock(ctx context.Context, key, token string) {
+	if contextError(ctx) != nil {
+		// the connection is unusable, the lock expires by itself
+		return
+	}
+
+	if _, err := c.conn.Do("WATCH", key); err != nil {
+		return
+	}
+
+	held, err := redis.String(c.conn.Do("GET", key))
+	if err != nil || held != token {
+		c.conn.Do("UNWATCH")
+		return
+	}
+
+	c.conn.Send("MULTI")
+	c.conn.Send("DEL", key)
+	if _, err := c.conn.Do("EXEC"); err != nil {
+		dlog("client.lock.release.fail: %p k=%s err=%s\n", c, key, err.Error())
+	}
+}
+
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// sleeps for d, returns ctx's error if it's done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
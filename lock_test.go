@@ -0,0 +1,106 @@
+package csc
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_GetOrLoad_lock(t *testing.T) {
+	key := "getorload:lock"
+	value := "loaded"
+	lock := &LoadLockOptions{TTL: time.Second, PollInterval: time.Millisecond * 10}
+
+	// pools with their own caches, like app instances
+	pools := make([]*BroadcastingPool, 4)
+	for i := range pools {
+		p, err := NewDefaultBroadcastingPool(PoolOptions{MaxEntries: 100, RedisAddress: redisAddress, LoadLock: lock})
+		if err != nil {
+			t.Fatalf("failed to create pool: %v", err)
+		}
+
+		pools[i] = p
+	}
+
+	c, _ := pools[0].Get()
+	c.Delete(key)
+	c.Close()
+
+	var loads uint32
+	loader := func() ([]byte, error) {
+		atomic.AddUint32(&loads, 1)
+		time.Sleep(time.Millisecond * 100)
+		return []byte(value), nil
+	}
+
+	wg := sync.WaitGroup{}
+	for _, p := range pools {
+		wg.Add(1)
+		go func(p *BroadcastingPool) {
+			defer wg.Done()
+
+			c, _ := p.Get()
+			defer c.Close()
+
+			data, err := c.GetOrLoad(key, 60, loader)
+			if err != nil || string(data) != value {
+				t.Errorf("data: %s, err: %v", data, err)
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	if loads != 1 {
+		t.Fatalf("loads: %d", loads)
+	}
+
+	// the lock is released
+	c, _ = pools[0].Get()
+	defer c.Close()
+
+	if n, err := c.Conn().Do("EXISTS", loadLockKeyPrefix+key); err != nil || n.(int64) != 0 {
+		t.Fatalf("lock: %v, err: %v", n, err)
+	}
+
+	c.Delete(key)
+}
+
+func TestClient_GetOrLoad_lockTimeout(t *testing.T) {
+	key := "getorload:locked"
+	lock := &LoadLockOptions{TTL: time.Second, WaitTimeout: time.Millisecond * 50, Fallback: LoadFallbackError}
+
+	pool, err := NewDefaultBroadcastingPool(PoolOptions{MaxEntries: 100, RedisAddress: redisAddress, LoadLock: lock})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	c, _ := pool.Get()
+	defer c.Close()
+
+	c.Delete(key)
+	if _, err := c.Conn().Do("SET", loadLockKeyPrefix+key, "other", "PX", 1000); err != nil {
+		t.Fatalf("failed to set lock: %v", err)
+	}
+	defer c.Conn().Do("DEL", loadLockKeyPrefix+key)
+
+	loader := func() ([]byte, error) {
+		return []byte("loaded"), nil
+	}
+
+	if _, err := c.GetOrLoad(key, 60, loader); err != ErrLoadLockTimeout {
+		t.Fatalf("err: %v", err)
+	}
+
+	lock.Fallback = LoadFallbackLoad
+	if data, err := c.GetOrLoad(key, 60, loader); err != nil || string(data) != "loaded" {
+		t.Fatalf("data: %s, err: %v", data, err)
+	}
+
+	// another instance's lock is left alone
+	if held, err := c.Conn().Do("GET", loadLockKeyPrefix+key); err != nil || string(held.([]byte)) != "other" {
+		t.Fatalf("lock: %v, err: %v", held, err)
+	}
+
+	c.Delete(key)
+}
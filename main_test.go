@@ -0,0 +1,25 @@
+package csc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/Jahaja/csc/redistest"
+)
+
+// the address of the in-process Redis server shared by the tests
+var redisAddress string
+
+func TestMain(m *testing.M) {
+	s, err := redistest.NewServer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to start redis server:", err)
+		os.Exit(1)
+	}
+
+	redisAddress = s.Addr()
+	code := m.Run()
+	s.Close()
+	os.Exit(code)
+}
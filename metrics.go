@@ -0,0 +1,63 @@
+package csc
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// indexes of the cache counters
+const (
+	counterHits = iota
+	counterMisses
+	counterEvictions
+	counterRejections
+	counterExpired
+	counterFlushes
+	numCacheCounters
+)
+
+// counters of a pool, shared with the caches of its clients. unlike Stats, which are per cache and reset by Flush,
+// they only ever increase and survive the clients of tracking pools
+type counters struct {
+	cache [numCacheCounters]uint64
+	// invalidation messages received
+	invalidations uint64
+	// times caches went out-of-sync because an invalidation or data connection failed
+	outOfSync uint64
+	// times invalidation connections were dialed again after failing
+	reconnects uint64
+	// latency of commands run by clients
+	roundTrips histogram
+}
+
+// adds n to the cache counter i, c may be nil for caches that don't belong to a pool
+func (c *counters) addCache(i int, n uint64) {
+	if c != nil {
+		atomic.AddUint64(&c.cache[i], n)
+	}
+}
+
+func (c *counters) cacheCounter(i int) uint64 {
+	return atomic.LoadUint64(&c.cache[i])
+}
+
+// upper bounds in seconds of the round trip latency buckets
+var roundTripBuckets = [...]float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// histogram counts durations in roundTripBuckets, the last count is of durations above all of them
+type histogram struct {
+	counts    [len(roundTripBuckets) + 1]uint64
+	sumNanos  uint64
+	numValues uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(roundTripBuckets) && d.Seconds() > roundTripBuckets[i] {
+		i++
+	}
+
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sumNanos, uint64(d))
+	atomic.AddUint64(&h.numValues, 1)
+}
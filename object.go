@@ -0,0 +1,113 @@
+package csc
+
+import (
+	"context"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// objectRead reads part or all of a non-string value, like a hash. the parts read are cached together in one entry
+// per key, which is invalidated as a whole. cached values must be comparable, like pointers, and aren't modified
+type objectRead struct {
+	// answers the read from the cached value, which is nil if there's none. ok is false if it doesn't hold the parts read
+	local func(v interface{}) (result interface{}, ok bool)
+	cmd   string
+	// returns the arguments of cmd, it's called after local so that only the missing parts are read
+	args func() []interface{}
+	// merges the reply of cmd into the cached value, nil if there's none, and returns the new value and its size in
+	// bytes. local must be able to answer the read from the new value
+	merge func(v interface{}, reply interface{}) (value interface{}, size int, err error)
+}
+
+// readObject reads the value of key, which isn't prefixed, with r. like getEntry the merged value is only cached if
+// the key isn't invalidated while it's fetched
+func (c *Client) readObject(ctx context.Context, key string, hint CacheHint, r objectRead) (interface{}, error) {
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+
+	key = c.prefixKey(key)
+	dlog("client.read: %p k=%s c=%s\n", c, key, r.cmd)
+
+	ce, _ := c.cache.getEntry(key)
+	if res, ok := r.local(ce.value); ok {
+		return res, nil
+	}
+
+	cached := ce.value
+	cache, caching := c.caching(key, hint)
+	if cache {
+		// the cached parts are taken out while the missing ones are fetched so that an invalidation drops both. if
+		// another read replaced them meanwhile, all parts are fetched
+		if sc, _ := c.cache.swapSentinel(key); sc.value != cached {
+			cached = nil
+			r.local(nil)
+		}
+	}
+
+	// CLIENT CACHING applies to the whole transaction, the TTL read is tracked like the read of the object
+	if caching != "" {
+		c.conn.Send("CLIENT", "CACHING", caching)
+	}
+
+	c.conn.Send("MULTI")
+	c.conn.Send(r.cmd, r.args()...)
+	c.conn.Send("TTL", key)
+	replies, err := redis.Values(c.do(ctx, "EXEC"))
+	if err == nil {
+		err = replyError(replies)
+	}
+
+	if err != nil {
+		if cache {
+			c.cache.deleteSentinel(key)
+		}
+
+		return nil, err
+	}
+
+	n := len(replies)
+	value, size, err := r.merge(cached, replies[n-2])
+	if err != nil {
+		if cache {
+			c.cache.deleteSentinel(key)
+		}
+
+		return nil, err
+	}
+
+	if cache {
+		expire, _ := redis.Int(replies[n-1], nil)
+		c.cache.replaceSentinelValue(key, value, size, expire)
+	}
+
+	res, _ := r.local(value)
+	return res, nil
+}
+
+// returns the first error among the replies of a pipeline
+func replyError(replies []interface{}) error {
+	for _, rpl := range replies {
+		if err, ok := rpl.(redis.Error); ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeObject runs a command modifying key, which is prefixed, and drops the cached value. the server doesn't
+// invalidate keys for the client modifying them with NOLOOP
+func (c *Client) writeObject(ctx context.Context, key string, cmd string, args ...interface{}) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+
+	dlog("client.write: %p k=%s c=%s\n", c, key, cmd)
+	if _, err := c.do(ctx, cmd, append([]interface{}{key}, args...)...); err != nil {
+		return err
+	}
+
+	c.cache.delete(key)
+	return nil
+}
@@ -3,6 +3,8 @@ package csc
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,14 +14,64 @@ import (
 
 var ErrTooManyActiveClients = errors.New("too many active clients")
 
+// ErrWaitCanceled is returned by GetContext when the context is done before a client becomes available. The returned
+// error also matches the context's error with errors.Is
+var ErrWaitCanceled = errors.New("canceled while waiting for a client")
+
+type waitError struct {
+	err error
+}
+
+func (e *waitError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrWaitCanceled, e.err)
+}
+
+func (e *waitError) Is(target error) bool {
+	return target == ErrWaitCanceled
+}
+
+func (e *waitError) Unwrap() error {
+	return e.err
+}
+
 type Pool interface {
 	Get() (*Client, error)
+	// GetContext is like Get but gives up waiting for a client when ctx is done
+	GetContext(ctx context.Context) (*Client, error)
 	Close() error
 	Options() *PoolOptions
 
+	counts() *counters
+
 	put(*Client)
 }
 
+// ConnRole tells PoolOptions.WrapConn what a connection is used for
+type ConnRole int
+
+const (
+	// ConnClient connections run the commands of clients, the invalidations of a tracking pool's RESP3 connections are
+	// pushed on them but don't go through the wrapper
+	ConnClient ConnRole = iota
+	// ConnInvalidation connections are subscribed to the invalidations redirected to them
+	ConnInvalidation
+	// ConnTracking is the connection of a broadcasting pool whose tracking is redirected to its invalidation
+	// connection, it's pinged as a health check
+	ConnTracking
+)
+
+// TrackingMode selects which reads of a tracking pool's clients the server tracks
+type TrackingMode int
+
+const (
+	// TrackingDefault tracks all reads
+	TrackingDefault TrackingMode = iota
+	// TrackingOptIn only tracks, and caches, reads hinted with CacheYes
+	TrackingOptIn
+	// TrackingOptOut tracks, and caches, all reads but those hinted with CacheNo
+	TrackingOptOut
+)
+
 type PoolOptions struct {
 	RedisAddress  string
 	RedisDatabase int
@@ -27,28 +79,234 @@ type PoolOptions struct {
 	MaxIdle       int
 	IdleTimeout   time.Duration
 	Wait          bool
-	// key prefix to add to keys. in broadcasting mode this is used to invalidate only keys with this prefix
+	// key prefix to add to keys. in broadcasting mode this is used to invalidate only keys with this prefix, unless
+	// TrackPrefixes is set
 	KeyPrefix  string
 	MaxEntries int
+	// max total size in bytes of the keys and values in the local cache, 0 means no limit.
+	// MaxEntries may be 0 if this is set. see CacheShards for the largest value that is cached
+	MaxBytes int64
+	// how to evict keys from the local cache when MaxEntries or MaxBytes is reached, defaults to EvictRandom.
+	// EvictTinyLFU is sized by MaxEntries, or by the number of keys held if only MaxBytes is set
+	Eviction Eviction
+	// creates a custom eviction policy for each local cache shard, overrides Eviction
+	NewEvictionPolicy func(maxEntries int) EvictionPolicy
+	// number of independently locked shards of the local cache, rounded up to a power of two. the limits are split
+	// evenly between the shards and eviction is done per shard, so the largest key and value that is cached is
+	// MaxBytes/CacheShards bytes, larger ones are counted as rejections. defaults to 1
+	CacheShards int
+	// makes GetOrLoad call the loader of a missing key on only one app instance at a time, nil disables the lock
+	LoadLock *LoadLockOptions
+	// seconds that GetOrLoad keeps serving a value after its expires while one refresh runs in the background, 0
+	// disables serving stale values. GetOrLoad sets values in Redis with expires plus StaleTTL so that they outlive
+	// their expires
+	StaleTTL int
+	// makes GetOrLoad refresh values before they go stale with a probability that increases as they approach it, like
+	// XFetch. higher values refresh earlier, 1 is a sensible default and 0 disables early refreshes. the time loading
+	// the value took is taken into account, values not loaded by this process are refreshed once stale
+	EarlyRefreshBeta float64
+	// makes tracking clients use a single RESP3 connection, on which invalidations are pushed, instead of redirecting
+	// them to a shared invalidation connection. falls back to redirecting if the server doesn't support RESP3
+	RESP3 bool
+	// number of invalidation connections shared by the clients of a tracking pool, defaults to 1. clients redirect
+	// their invalidations to one of them and are out-of-sync, thus closed, if it fails
+	InvalidationConns int
+	// selects which reads tracking clients have tracked by the server and cache, broadcasting pools track all keys
+	TrackingMode TrackingMode
+	// prefixes of the keys that a broadcasting pool is invalidated for and caches, other keys aren't cached. the
+	// prefixes match whole keys, including KeyPrefix, and mustn't overlap. defaults to KeyPrefix, if set
+	TrackPrefixes []string
+	// encodes the values of GetValue and SetValue, defaults to JSONCodec
+	Codec Codec
+	// makes GetValue keep decoded values in the local cache along with their bytes, local hits then copy them instead
+	// of decoding. the copies are shallow so the decoded values, and the maps, slices and pointers they hold, mustn't
+	// be modified. decoded values aren't counted by MaxBytes
+	CacheDecoded bool
+	// compresses large values, nil disables compression
+	Compression *CompressionOptions
+	// interval of the pings checking the tracking connection of a broadcasting pool, which is out-of-sync after 5
+	// failed ones. defaults to 5 seconds
+	HealthCheckInterval time.Duration
+	// wraps the connections of the pool, e.g. to instrument them or to inject faults in tests. the wrapper should
+	// implement redis.ConnWithContext, the Context methods of clients fail otherwise
+	WrapConn func(conn redis.Conn, role ConnRole) redis.Conn
+	// addresses of nodes of a cluster pool's cluster that its slots are discovered from, RedisAddress is used as well
+	ClusterAddresses []string
+	// interval of the refreshes of a cluster pool's slots, which are refreshed on MOVED as well. defaults to 10 seconds
+	ClusterRefreshInterval time.Duration
+	// addresses of the Redis Sentinels monitoring SentinelMaster. when set, tracking and broadcasting pools connect
+	// to the master reported by the sentinels instead of RedisAddress and watch their +switch-master messages. on a
+	// failover the local caches are flushed and tracking is re-established on the new master right away. a
+	// broadcasting pool created with NewBroadcastingPool must dial the master itself
+	SentinelAddresses []string
+	// name of the master monitored by the sentinels
+	SentinelMaster string
+}
+
+func (o *PoolOptions) wrapConn(conn redis.Conn, role ConnRole) redis.Conn {
+	if o.WrapConn != nil {
+		return o.WrapConn(conn, role)
+	}
+
+	return conn
+}
+
+func (o *PoolOptions) healthCheckInterval() time.Duration {
+	if o.HealthCheckInterval > 0 {
+		return o.HealthCheckInterval
+	}
+
+	return time.Second * 5
+}
+
+func (o *PoolOptions) clusterRefreshInterval() time.Duration {
+	if o.ClusterRefreshInterval > 0 {
+		return o.ClusterRefreshInterval
+	}
+
+	return defaultClusterRefreshInterval
+}
+
+// returns the constructor of eviction policies for the local cache shards, nil for random eviction
+func (o *PoolOptions) newEvictionPolicy() func(maxEntries int) EvictionPolicy {
+	if o.NewEvictionPolicy != nil {
+		return o.NewEvictionPolicy
+	}
+
+	switch o.Eviction {
+	case EvictLRU:
+		return func(int) EvictionPolicy { return NewLRUPolicy() }
+	case EvictLFU:
+		return func(int) EvictionPolicy { return NewLFUPolicy() }
+	case EvictTinyLFU:
+		return NewTinyLFUPolicy
+	default:
+		return nil
+	}
+}
+
+// returns the prefixes of the keys broadcasting pools track, nil for all keys
+func (o *PoolOptions) trackPrefixes() []string {
+	if len(o.TrackPrefixes) > 0 {
+		return o.TrackPrefixes
+	}
+
+	if o.KeyPrefix != "" {
+		return []string{o.KeyPrefix}
+	}
+
+	return nil
+}
+
+// reports whether key, which is prefixed, is tracked with trackPrefixes
+func (o *PoolOptions) tracks(key string) bool {
+	prefixes := o.trackPrefixes()
+	if len(prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// returns the CLIENT TRACKING arguments of the tracking mode
+func (o *PoolOptions) trackingArgs() []interface{} {
+	switch o.TrackingMode {
+	case TrackingOptIn:
+		return []interface{}{"OPTIN"}
+	case TrackingOptOut:
+		return []interface{}{"OPTOUT"}
+	default:
+		return nil
+	}
+}
+
+func (o *PoolOptions) codec() Codec {
+	if o.Codec != nil {
+		return o.Codec
+	}
+
+	return JSONCodec
+}
+
+// creates a local cache counting into cnt, which may be nil
+func (o *PoolOptions) newCache(cnt *counters) *cache {
+	c := newCache(o.MaxEntries, o.MaxBytes, o.CacheShards, o.newEvictionPolicy())
+	c.setCounters(cnt)
+	return c
+}
+
+// PoolStats describes the clients of a pool and the time spent waiting for them
+type PoolStats struct {
+	// number of clients, in use or idle
+	Active int `json:"active"`
+	Idle   int `json:"idle"`
+	// number of gets that had to wait for a client and the total and longest time spent waiting
+	Waited       uint64        `json:"waited"`
+	WaitDuration time.Duration `json:"wait_duration"`
+	MaxWait      time.Duration `json:"max_wait"`
+	// number of gets whose context was done while waiting
+	WaitCanceled uint64 `json:"wait_canceled"`
+	// number of clients that failed to dial and of clients discarded because they failed, like out-of-sync ones
+	DialFailures uint64 `json:"dial_failures"`
+	Discarded    uint64 `json:"discarded"`
+}
+
+// TrackingPoolStats are the cache stats of all clients of a tracking pool, including discarded ones, and the pool's
+// stats. Hits, Misses, Evictions, Rejections and Expired aren't reset by flushing the clients' caches
+type TrackingPoolStats struct {
+	Stats
+	PoolStats
 }
 
 type TrackingPool struct {
 	options PoolOptions
 	// number of active clients, used or in the free list
-	active uint32
+	active       uint32
+	dialFailures uint64
+	discarded    uint64
 	// number of times a Get had to wait to receive a connection
 	waited uint64
+	// total and longest wait in nanoseconds
+	waitNanos    uint64
+	maxWaitNanos uint64
+	waitCanceled uint64
+	// set once the server turned out not to support RESP3
+	noResp3 uint32
 	// buffered channel representing available slots when there's a max active clients limit
 	ch chan struct{}
 	mu sync.Mutex
 	// available clients to reuse
 	free []*Client
+	// all active clients
+	clients map[*Client]struct{}
+	imu     sync.Mutex
+	// shared invalidation connections, clients are assigned to them round-robin. nil until needed, failed ones are
+	// replaced when next needed
+	invalidators    []*invalidator
+	nextInvalidator int
+	counters        counters
+	events          subscribers
+	// resolves the master and watches failovers, nil without SentinelMaster
+	sentinel *sentinel
 }
 
 func NewTrackingPool(opts PoolOptions) *TrackingPool {
 	p := &TrackingPool{
 		options: opts,
+		clients: map[*Client]struct{}{},
+	}
+
+	n := p.options.InvalidationConns
+	if n <= 0 {
+		n = 1
 	}
+	p.invalidators = make([]*invalidator, n)
 
 	if p.options.Wait && p.options.MaxActive > 0 {
 		// setup slots
@@ -58,32 +316,85 @@ func NewTrackingPool(opts PoolOptions) *TrackingPool {
 		}
 	}
 
+	if p.options.SentinelMaster != "" {
+		p.sentinel = newSentinel(&p.options)
+		p.sentinel.watch(p.failover)
+	}
+
 	return p
 }
 
-func (p *TrackingPool) Get() (*Client, error) {
-	// grab a slot, there're MaxActive slots available when waiting
-	if p.options.Wait && p.options.MaxActive > 0 {
-		// assume that we're waiting if there's no slot
-		waiting := len(p.ch) == 0
-		var start time.Time
-		if waiting {
-			atomic.AddUint64(&p.waited, 1)
-			if debugMode {
-				start = nowFunc()
-				dlog("tpool.waiting: %p", p)
-			}
+// returns the address of the Redis server, the master reported by the sentinels if any
+func (p *TrackingPool) address() (string, error) {
+	if p.sentinel != nil {
+		return p.sentinel.masterAddr()
+	}
+
+	return p.options.RedisAddress, nil
+}
+
+// called after a failover to addr. the clients are flushed and closed since their tracking state was lost with the
+// former master, and the invalidation connections are replaced by ones to the new master
+func (p *TrackingPool) failover(addr string) {
+	atomic.AddUint64(&p.counters.outOfSync, 1)
+	p.events.emit(Event{Type: EventOutOfSync})
+
+	p.mu.Lock()
+	free := p.free
+	p.free = nil
+	clients := make([]*Client, 0, len(p.clients))
+	for c := range p.clients {
+		clients = append(clients, c)
+	}
+	p.mu.Unlock()
+
+	for _, c := range clients {
+		c.setClosed()
+		c.cache.flush()
+	}
+
+	for _, c := range free {
+		p.discard(c)
+	}
+
+	p.imu.Lock()
+	defer p.imu.Unlock()
+
+	reconnected := true
+	for i, inv := range p.invalidators {
+		if inv == nil {
+			continue
 		}
 
-		select {
-		case <-p.ch:
+		inv.close()
+		p.invalidators[i] = nil
+
+		inv, err := dialInvalidator(context.Background(), p)
+		if err != nil {
+			Logger.Println("failed to dial invalidation connection to new master:", err.Error())
+			reconnected = false
+			continue
 		}
 
-		if debugMode && waiting {
-			dlog("tclient.waited: %p, t=%dus", p, time.Since(start).Microseconds())
+		p.invalidators[i] = inv
+	}
+
+	if reconnected {
+		atomic.AddUint64(&p.counters.reconnects, 1)
+		p.events.emit(Event{Type: EventInSync})
+	}
+}
+
+func (p *TrackingPool) Get() (*Client, error) {
+	return p.GetContext(context.Background())
+}
+
+func (p *TrackingPool) GetContext(ctx context.Context) (*Client, error) {
+	// grab a slot, there're MaxActive slots available when waiting
+	if p.ch != nil {
+		if err := p.wait(ctx); err != nil {
+			return nil, err
 		}
-	} else if p.options.MaxActive > 0 && int(atomic.LoadUint32(&p.active)) >= p.options.MaxActive {
-		return nil, ErrTooManyActiveClients
 	}
 
 	c := p.getFree()
@@ -91,81 +402,281 @@ func (p *TrackingPool) Get() (*Client, error) {
 		return c, nil
 	}
 
-	dconn, err := redis.Dial("tcp", p.options.RedisAddress, redis.DialDatabase(p.options.RedisDatabase))
+	// reserve a place for the new client
+	if n := atomic.AddUint32(&p.active, 1); p.ch == nil && p.options.MaxActive > 0 && int(n) > p.options.MaxActive {
+		atomic.AddUint32(&p.active, ^uint32(0))
+		return nil, ErrTooManyActiveClients
+	}
+
+	c, err := p.dial(ctx)
+	if err != nil {
+		atomic.AddUint32(&p.active, ^uint32(0))
+		atomic.AddUint64(&p.dialFailures, 1)
+
+		// give the slot back, no client holds it
+		if p.ch != nil {
+			p.ch <- struct{}{}
+		}
+
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.clients[c] = struct{}{}
+	p.mu.Unlock()
+
+	// a failover after the client was added closes it, one during the dial is caught here since the sentinel
+	// switches the master before calling failover
+	if addr, err := p.address(); err != nil || addr != c.addr {
+		c.setClosed()
+		p.put(c)
+
+		if err == nil {
+			err = errMasterSwitched
+		}
+
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// waits for a free slot until ctx is done
+func (p *TrackingPool) wait(ctx context.Context) error {
+	select {
+	case <-p.ch:
+		return nil
+	default:
+	}
+
+	atomic.AddUint64(&p.waited, 1)
+	start := nowFunc()
+	dlog("tpool.waiting: %p", p)
+
+	select {
+	case <-p.ch:
+		d := p.recordWait(start)
+		dlog("tclient.waited: %p, t=%dus", p, d.Microseconds())
+		return nil
+	case <-ctx.Done():
+		p.recordWait(start)
+		atomic.AddUint64(&p.waitCanceled, 1)
+		dlog("tclient.waitcanceled: %p", p)
+		return &waitError{err: ctx.Err()}
+	}
+}
+
+func (p *TrackingPool) recordWait(start time.Time) time.Duration {
+	d := nowFunc().Sub(start)
+	atomic.AddUint64(&p.waitNanos, uint64(d))
+	for {
+		max := atomic.LoadUint64(&p.maxWaitNanos)
+		if uint64(d) <= max || atomic.CompareAndSwapUint64(&p.maxWaitNanos, max, uint64(d)) {
+			return d
+		}
+	}
+}
+
+func (p *TrackingPool) dial(ctx context.Context) (*Client, error) {
+	if p.options.RESP3 && atomic.LoadUint32(&p.noResp3) == 0 {
+		c, err := p.dialResp3(ctx)
+		if !errors.Is(err, errNoResp3) {
+			return c, err
+		}
+
+		Logger.Println("falling back to shared invalidation connections:", err.Error())
+		atomic.StoreUint32(&p.noResp3, 1)
+	}
+
+	inv, err := p.getInvalidator(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	iconn, err := redis.Dial("tcp", p.options.RedisAddress, redis.DialDatabase(p.options.RedisDatabase))
+	// the client must be connected to the server of the connection it redirects to
+	conn, err := redis.DialContext(ctx, "tcp", inv.addr, redis.DialDatabase(p.options.RedisDatabase))
 	if err != nil {
 		return nil, err
 	}
 
-	c = &Client{
+	conn = p.options.wrapConn(conn, ConnClient)
+	args := append([]interface{}{"TRACKING", "ON", "REDIRECT", inv.id, "NOLOOP"}, p.options.trackingArgs()...)
+	if _, err := conn.Do("CLIENT", args...); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &Client{
 		pool:  p,
-		conn:  dconn,
-		cache: newCache(p.options.MaxEntries),
-		iconn: iconn,
+		conn:  conn,
+		cache: p.options.newCache(&p.counters),
+		addr:  inv.addr,
 	}
 
-	cid, err := redis.Int(c.iconn.Do("CLIENT", "ID"))
+	if err := inv.add(c); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.watchExpiry()
+
+	return c, nil
+}
+
+// returns the next shared invalidation connection, dialing it if needed. a failed one is replaced by a new one
+func (p *TrackingPool) getInvalidator(ctx context.Context) (*invalidator, error) {
+	p.imu.Lock()
+	defer p.imu.Unlock()
+
+	i := p.nextInvalidator
+	p.nextInvalidator = (i + 1) % len(p.invalidators)
+
+	failed := p.invalidators[i]
+	if failed != nil && !failed.isFailed() {
+		return failed, nil
+	}
+
+	inv, err := dialInvalidator(ctx, p)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := c.conn.Do("CLIENT", "TRACKING", "ON", "REDIRECT", cid, "NOLOOP"); err != nil {
+	if failed != nil {
+		atomic.AddUint64(&p.counters.reconnects, 1)
+		p.events.emit(Event{Type: EventInSync})
+	}
+
+	p.invalidators[i] = inv
+	return inv, nil
+}
+
+// called when a shared invalidation connection fails, its clients are out-of-sync
+func (p *TrackingPool) invalidatorFailed(inv *invalidator) {
+	Logger.Println("invalidation connection failed, clients out-of-sync")
+	atomic.AddUint64(&p.counters.outOfSync, 1)
+	p.events.emit(Event{Type: EventOutOfSync})
+}
+
+// dials a client with a single connection receiving both replies and invalidations
+func (p *TrackingPool) dialResp3(ctx context.Context) (*Client, error) {
+	c := &Client{
+		pool:  p,
+		cache: p.options.newCache(&p.counters),
+	}
+
+	addr, err := p.address()
+	if err != nil {
 		return nil, err
 	}
 
+	c.addr = addr
+	conn, err := dialResp3(ctx, addr, p.options.RedisDatabase, func(msg pushMessage) {
+		keys, ok, err := invalidationPush(msg)
+		if !ok {
+			return
+		}
+
+		if err != nil {
+			Logger.Println("failed to parse invalidation push keys:", err.Error())
+			return
+		}
+
+		dlog("client.invalidating: %p k=%s\n", c.cache, keys)
+		atomic.AddUint64(&p.counters.invalidations, 1)
+		c.cache.invalidate(keys)
+		p.events.invalidated(keys)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	args := append([]interface{}{"TRACKING", "ON", "NOLOOP"}, p.options.trackingArgs()...)
+	if _, err := conn.Do("CLIENT", args...); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.conn = p.options.wrapConn(conn, ConnClient)
+
+	// invalidations are missed once the connection fails
 	go func() {
-		if err := invalidationsReceiver(c.iconn, c.cache); err != nil {
-			c.setClosed()
+		<-conn.done
+		if !c.isClosed() {
+			atomic.AddUint64(&p.counters.outOfSync, 1)
+			p.events.emit(Event{Type: EventOutOfSync})
 		}
+
+		c.setClosed()
 	}()
-	go expireWatcher(context.Background(), c.cache)
+	c.watchExpiry()
 
-	atomic.AddUint32(&p.active, 1)
 	return c, nil
 }
 
 // closes connections of all clients in the free list
 func (p *TrackingPool) Close() error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	free := p.free
+	p.free = nil
+	p.mu.Unlock()
 
 	dlog("tpool.close: %p\n", p)
-	for _, c := range p.free {
+	for _, c := range free {
 		c.setClosed()
-		c.Close()
+		p.release(c)
+	}
+
+	// clients still in use are closed by the failing invalidation connections
+	p.imu.Lock()
+	for _, inv := range p.invalidators {
+		if inv != nil {
+			inv.close()
+		}
+	}
+	p.imu.Unlock()
+
+	if p.sentinel != nil {
+		p.sentinel.close()
 	}
 
 	return nil
 }
 
-// getFree returns nil if there is no free client
+// getFree returns nil if there is no free client, clients that failed while free are discarded
 func (p *TrackingPool) getFree() *Client {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	numFree := len(p.free)
-	dlog("tpool.getfree: %p n=%d\n", p, numFree)
+	for {
+		p.mu.Lock()
+		numFree := len(p.free)
+		dlog("tpool.getfree: %p n=%d\n", p, numFree)
+
+		if numFree == 0 {
+			p.mu.Unlock()
+			return nil
+		}
 
-	if numFree > 0 {
 		c := p.free[0]
 		copy(p.free, p.free[1:])
 		p.free = p.free[:numFree-1]
-		return c
-	}
+		p.mu.Unlock()
 
-	return nil
+		if !c.isClosed() {
+			return c
+		}
+
+		p.discard(c)
+	}
 }
 
+// puts c back into the free list, or discards it if it's closed
 func (p *TrackingPool) put(c *Client) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	dlog("tpool.put: %p n=%d\n", p, len(p.free))
-	p.free = append(p.free, c)
+	if c.isClosed() {
+		p.discard(c)
+	} else {
+		p.mu.Lock()
+		dlog("tpool.put: %p n=%d\n", p, len(p.free))
+		p.free = append(p.free, c)
+		p.mu.Unlock()
+	}
 
 	// notify that a slot has become available
 	if p.ch != nil {
@@ -173,10 +684,98 @@ func (p *TrackingPool) put(c *Client) {
 	}
 }
 
+// discards a failed client
+func (p *TrackingPool) discard(c *Client) {
+	dlog("tpool.discard: %p c=%p\n", p, c)
+	atomic.AddUint64(&p.discarded, 1)
+	p.release(c)
+}
+
+// closes the connection of c and forgets it
+func (p *TrackingPool) release(c *Client) {
+	if c.invalidator != nil {
+		c.invalidator.remove(c)
+	}
+
+	if c.stopExpiry != nil {
+		c.stopExpiry()
+	}
+
+	c.conn.Close()
+
+	p.mu.Lock()
+	_, ok := p.clients[c]
+	delete(p.clients, c)
+	p.mu.Unlock()
+
+	if ok {
+		atomic.AddUint32(&p.active, ^uint32(0))
+	}
+}
+
 func (p *TrackingPool) Options() *PoolOptions {
 	return &p.options
 }
 
+func (p *TrackingPool) counts() *counters {
+	return &p.counters
+}
+
+// Subscribe calls fn with the invalidation events of the pool's clients until the returned function is called.
+// Invalidations of keys held by any client are sent, once per invalidation message. fn is called on the goroutine
+// receiving invalidations, so it must be quick and mustn't block
+func (p *TrackingPool) Subscribe(fn func(Event)) func() {
+	return p.events.subscribe(fn)
+}
+
+func (p *TrackingPool) PoolStats() PoolStats {
+	p.mu.Lock()
+	idle := len(p.free)
+	p.mu.Unlock()
+
+	return PoolStats{
+		Active:       int(atomic.LoadUint32(&p.active)),
+		Idle:         idle,
+		Waited:       atomic.LoadUint64(&p.waited),
+		WaitDuration: time.Duration(atomic.LoadUint64(&p.waitNanos)),
+		MaxWait:      time.Duration(atomic.LoadUint64(&p.maxWaitNanos)),
+		WaitCanceled: atomic.LoadUint64(&p.waitCanceled),
+		DialFailures: atomic.LoadUint64(&p.dialFailures),
+		Discarded:    atomic.LoadUint64(&p.discarded),
+	}
+}
+
+// Stats aggregates the cache stats of the pool's clients
+func (p *TrackingPool) Stats() TrackingPoolStats {
+	st := TrackingPoolStats{
+		Stats: Stats{
+			Hits:       p.counters.cacheCounter(counterHits),
+			Misses:     p.counters.cacheCounter(counterMisses),
+			Evictions:  p.counters.cacheCounter(counterEvictions),
+			Rejections: p.counters.cacheCounter(counterRejections),
+			Expired:    p.counters.cacheCounter(counterExpired),
+			Flushes:    p.counters.cacheCounter(counterFlushes),
+		},
+		PoolStats: p.PoolStats(),
+	}
+
+	p.mu.Lock()
+	caches := make([]*cache, 0, len(p.clients))
+	for c := range p.clients {
+		caches = append(caches, c.cache)
+	}
+	p.mu.Unlock()
+
+	for _, c := range caches {
+		cs := c.stats()
+		st.NumEntries += cs.NumEntries
+		st.Bytes += cs.Bytes
+		st.PeakBytes += cs.PeakBytes
+	}
+
+	return st
+}
+
 type BroadcastingPool struct {
 	options   PoolOptions
 	rpool     *redis.Pool
@@ -185,30 +784,70 @@ type BroadcastingPool struct {
 	cache     *cache
 	outOfSync uint32
 	closed    uint32
+	counters  counters
+	events    subscribers
+	// closed when the invalidations receiver of iconn returns
+	received chan struct{}
+	// watches failovers, nil without SentinelMaster
+	sentinel *sentinel
+	// wakes up the reconnecting job, which closes done once it returned. only the job touches the connections while
+	// the pool is open
+	reconnect chan struct{}
+	done      chan struct{}
+	// stops the health checks of conn, pinged is closed once they returned
+	stop   chan struct{}
+	pinged chan struct{}
 }
 
 // creates a new broadcasting pool and starts the background jobs
 func NewBroadcastingPool(rpool *redis.Pool, opts PoolOptions) (*BroadcastingPool, error) {
+	var s *sentinel
+	if opts.SentinelMaster != "" {
+		s = newSentinel(&opts)
+	}
+
+	return newBroadcastingPool(rpool, opts, s)
+}
+
+func newBroadcastingPool(rpool *redis.Pool, opts PoolOptions, s *sentinel) (*BroadcastingPool, error) {
 	p := &BroadcastingPool{
-		options: opts,
-		rpool:   rpool,
-		cache:   newCache(opts.MaxEntries),
+		options:   opts,
+		rpool:     rpool,
+		sentinel:  s,
+		reconnect: make(chan struct{}, 1),
+		done:      make(chan struct{}),
 	}
+	p.cache = opts.newCache(&p.counters)
 
 	if err := p.setupConnections(); err != nil {
 		return nil, err
 	}
 
+	if p.sentinel != nil {
+		p.sentinel.watch(p.failover)
+	}
+
 	go expireWatcher(context.Background(), p.cache)
 	go func() {
-		for !p.isClosed() {
-			time.Sleep(time.Second)
+		defer close(p.done)
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-p.reconnect:
+			}
+
+			if p.isClosed() {
+				return
+			}
 
 			if p.isOutOfSync() {
 				dlog("bpool.conn.outofsync: %p\n", p)
 
-				p.conn.Close()
-				p.iconn.Close()
+				p.closeConnections()
 				p.cache.flush()
 
 				if err := p.setupConnections(); err != nil {
@@ -216,6 +855,7 @@ func NewBroadcastingPool(rpool *redis.Pool, opts PoolOptions) (*BroadcastingPool
 					continue
 				}
 
+				atomic.AddUint64(&p.counters.reconnects, 1)
 				p.setOutofSync(false)
 			}
 		}
@@ -227,29 +867,34 @@ func NewBroadcastingPool(rpool *redis.Pool, opts PoolOptions) (*BroadcastingPool
 func (p *BroadcastingPool) setupConnections() error {
 	dlog("bpool.conn.setup: %p\n", p)
 
-	p.conn = p.rpool.Get()
-	p.iconn = p.rpool.Get()
-
-	cid, err := redis.Int(p.iconn.Do("CLIENT", "ID"))
+	conn, err := p.dial(ConnTracking)
 	if err != nil {
 		return err
 	}
 
-	dlog("bpool.conn.iconn: %p cid=%d p=%s\n", p, cid, p.options.KeyPrefix)
-
-	args := redis.Args{}
-	args = append(args, "TRACKING", "ON", "REDIRECT", cid, "BCAST")
-	if p.options.KeyPrefix != "" {
-		args = append(args, "PREFIX", p.options.KeyPrefix)
+	iconn, err := p.dial(ConnInvalidation)
+	if err != nil {
+		conn.Close()
+		return err
 	}
 
-	if _, err := p.conn.Do("CLIENT", args...); err != nil {
+	if err := enableBroadcastTracking(conn, iconn, p.options.trackPrefixes()); err != nil {
+		conn.Close()
+		iconn.Close()
 		return err
 	}
 
-	// ping the redirecting data conn periodically as a healthcheck
-	go func(conn redis.Conn) {
-		ticker := time.NewTicker(time.Second * 5)
+	p.conn, p.iconn = conn, iconn
+
+	// ping the redirecting data conn periodically as a healthcheck, until the connections are closed
+	stop, pinged := make(chan struct{}), make(chan struct{})
+	p.stop, p.pinged = stop, pinged
+	go func() {
+		defer close(pinged)
+
+		ticker := time.NewTicker(p.options.healthCheckInterval())
+		defer ticker.Stop()
+
 		fails := 0
 		for !p.isClosed() {
 			if fails >= 5 {
@@ -259,6 +904,8 @@ func (p *BroadcastingPool) setupConnections() error {
 			}
 
 			select {
+			case <-stop:
+				return
 			case <-ticker.C:
 				_, err := conn.Do("PING")
 				if err != nil {
@@ -270,10 +917,20 @@ func (p *BroadcastingPool) setupConnections() error {
 				fails = 0
 			}
 		}
-	}(p.conn)
+	}()
 
+	received := make(chan struct{})
+	p.received = received
 	go func() {
-		if err := invalidationsReceiver(p.iconn, p.cache); err != nil {
+		defer close(received)
+
+		err := receiveInvalidations(iconn, p.invalidate)
+
+		// the connection fails once it's closed by closeConnections
+		select {
+		case <-stop:
+		default:
+			dlog("bpool.conn.receivefail: %p err=%v\n", p, err)
 			Logger.Println("invalidation data connection failed, connections out-of-sync")
 			p.setOutofSync(true)
 		}
@@ -282,13 +939,52 @@ func (p *BroadcastingPool) setupConnections() error {
 	return nil
 }
 
+// dials a connection with the dial function of the redis pool. it isn't taken from the redis pool, so it doesn't count
+// against MaxActive and closing it doesn't read the replies pending on it
+func (p *BroadcastingPool) dial(role ConnRole) (redis.Conn, error) {
+	var conn redis.Conn
+	var err error
+	switch {
+	case p.rpool.DialContext != nil:
+		conn, err = p.rpool.DialContext(context.Background())
+	case p.rpool.Dial != nil:
+		conn, err = p.rpool.Dial()
+	default:
+		err = errors.New("redis pool has no dial function")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return p.options.wrapConn(conn, role), nil
+}
+
+// NewDefaultBroadcastingPool creates a broadcasting pool dialing RedisAddress, or the master reported by the sentinels
 func NewDefaultBroadcastingPool(opts PoolOptions) (*BroadcastingPool, error) {
-	return NewBroadcastingPool(
+	var s *sentinel
+	if opts.SentinelMaster != "" {
+		s = newSentinel(&opts)
+	}
+
+	return newBroadcastingPool(
 		&redis.Pool{
 			Dial: func() (redis.Conn, error) {
-				return redis.Dial("tcp", opts.RedisAddress, redis.DialDatabase(opts.RedisDatabase))
+				if s != nil {
+					return s.dial(context.Background(), &opts)
+				}
+
+				return redis.Dial("tcp", opts.RedisAddress, redis.DialDatabase(opts.RedisDatabase),
+					redis.DialConnectTimeout(setupTimeout))
 			},
 			TestOnBorrow: func(c redis.Conn, t time.Time) error {
+				// connections to a former master are discarded
+				if s != nil {
+					if err := s.testConn(c); err != nil {
+						return err
+					}
+				}
+
 				if time.Since(t) < time.Second {
 					return nil
 				}
@@ -298,13 +994,34 @@ func NewDefaultBroadcastingPool(opts PoolOptions) (*BroadcastingPool, error) {
 			},
 		},
 		opts,
+		s,
 	)
 }
 
 func (p *BroadcastingPool) Get() (*Client, error) {
 	c := &Client{
 		pool:  p,
-		conn:  p.rpool.Get(),
+		conn:  p.options.wrapConn(p.rpool.Get(), ConnClient),
+		cache: p.cache,
+	}
+
+	return c, nil
+}
+
+// GetContext waits for a connection of the redis pool until ctx is done, the redis pool must have Wait set to wait
+func (p *BroadcastingPool) GetContext(ctx context.Context) (*Client, error) {
+	conn, err := p.rpool.GetContext(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, &waitError{err: ctx.Err()}
+		}
+
+		return nil, err
+	}
+
+	c := &Client{
+		pool:  p,
+		conn:  p.options.wrapConn(conn, ConnClient),
 		cache: p.cache,
 	}
 
@@ -315,12 +1032,35 @@ func (p *BroadcastingPool) Close() error {
 	dlog("bpool.close: %p\n", p)
 
 	atomic.StoreUint32(&p.closed, 1)
-	p.conn.Close()
-	p.iconn.Close()
+	if p.sentinel != nil {
+		p.sentinel.close()
+	}
+
+	// the connections are closed once the reconnecting job can no longer reopen them
+	p.wakeReconnect()
+	<-p.done
+
+	p.closeConnections()
 	p.cache.flush()
 	return p.rpool.Close()
 }
 
+// closes the connections of the pool and waits for their goroutines to return, the connections aren't pooled so
+// closing them returns right away even if the server doesn't respond
+func (p *BroadcastingPool) closeConnections() {
+	if p.stop == nil {
+		return
+	}
+
+	close(p.stop)
+	<-p.pinged
+
+	p.conn.Close()
+	p.iconn.Close()
+	<-p.received
+	p.stop = nil
+}
+
 func (p *BroadcastingPool) isOutOfSync() bool {
 	return atomic.LoadUint32(&p.outOfSync) == 1
 }
@@ -331,16 +1071,57 @@ func (p *BroadcastingPool) isClosed() bool {
 
 func (p *BroadcastingPool) setOutofSync(b bool) {
 	if b {
-		atomic.StoreUint32(&p.outOfSync, 1)
-	} else {
-		atomic.StoreUint32(&p.outOfSync, 0)
+		if atomic.SwapUint32(&p.outOfSync, 1) == 0 {
+			// invalidations may be missed from now on, nothing is cached until the pool reconnected
+			p.cache.flush()
+			atomic.AddUint64(&p.counters.outOfSync, 1)
+			p.events.emit(Event{Type: EventOutOfSync})
+		}
+	} else if atomic.SwapUint32(&p.outOfSync, 0) == 1 {
+		p.events.emit(Event{Type: EventInSync})
+	}
+}
+
+// called after a failover to addr, the cache is flushed and the connections are reopened to the new master right away
+func (p *BroadcastingPool) failover(addr string) {
+	p.setOutofSync(true)
+	p.wakeReconnect()
+}
+
+func (p *BroadcastingPool) wakeReconnect() {
+	select {
+	case p.reconnect <- struct{}{}:
+	default:
 	}
 }
 
+// reports whether the pool is invalidated for key, which is prefixed
+func (p *BroadcastingPool) tracks(key string) bool {
+	return p.options.tracks(key)
+}
+
+func (p *BroadcastingPool) invalidate(keys []string) {
+	dlog("bpool.invalidating: %p k=%s\n", p, keys)
+	atomic.AddUint64(&p.counters.invalidations, 1)
+	p.cache.invalidate(keys)
+	p.events.invalidated(keys)
+}
+
 func (p *BroadcastingPool) Stats() Stats {
 	return p.cache.stats()
 }
 
+// PoolStats returns the stats of the redis pool, the connections used by the pool itself aren't taken from it
+func (p *BroadcastingPool) PoolStats() PoolStats {
+	st := p.rpool.Stats()
+	return PoolStats{
+		Active:       st.ActiveCount,
+		Idle:         st.IdleCount,
+		Waited:       uint64(st.WaitCount),
+		WaitDuration: st.WaitDuration,
+	}
+}
+
 func (p *BroadcastingPool) put(c *Client) {
 	dlog("bpool.put: %p\n", p)
 
@@ -355,3 +1136,13 @@ func (p *BroadcastingPool) Flush() {
 func (p *BroadcastingPool) Options() *PoolOptions {
 	return &p.options
 }
+
+func (p *BroadcastingPool) counts() *counters {
+	return &p.counters
+}
+
+// Subscribe calls fn with the invalidation events of the pool until the returned function is called. fn is called
+// on the goroutine receiving invalidations, so it must be quick and mustn't block
+func (p *BroadcastingPool) Subscribe(fn func(Event)) func() {
+	return p.events.subscribe(fn)
+}
@@ -1,12 +1,17 @@
 package csc
 
 import (
+	"context"
+	"errors"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/gomodule/redigo/redis"
 )
 
 func TestClientPool(t *testing.T) {
-	pool := NewTrackingPool(PoolOptions{RedisAddress: ":6379", Wait: true, MaxActive: 1, MaxEntries: 100})
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, Wait: true, MaxActive: 1, MaxEntries: 100})
 	c1, err := pool.Get()
 	if err != nil {
 		t.FailNow()
@@ -35,10 +40,48 @@ func TestClientPool(t *testing.T) {
 	if pool.waited != 2 {
 		t.Fatal("waited is not 2")
 	}
+
+	if st := pool.PoolStats(); st.WaitDuration < time.Millisecond*100 || st.MaxWait > st.WaitDuration {
+		t.Fatalf("stats: %+v", st)
+	}
+}
+
+func TestClientPool_GetContext(t *testing.T) {
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, Wait: true, MaxActive: 1, MaxEntries: 100})
+	c1, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	_, err = pool.GetContext(ctx)
+	if !errors.Is(err, ErrWaitCanceled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err: %v", err)
+	}
+
+	st := pool.PoolStats()
+	if st.Waited != 1 || st.WaitCanceled != 1 || st.WaitDuration < time.Millisecond*50 {
+		t.Fatalf("stats: %+v", st)
+	}
+
+	// the slot is still usable once the client is returned
+	c1.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := pool.GetContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if st := pool.PoolStats(); st.Active != 1 || st.Idle != 0 {
+		t.Fatalf("stats: %+v", st)
+	}
 }
 
 func TestBroadcastPool(t *testing.T) {
-	pool, err := NewDefaultBroadcastingPool(PoolOptions{MaxEntries: 1000, RedisAddress: ":6379"})
+	pool, err := NewDefaultBroadcastingPool(PoolOptions{MaxEntries: 1000, RedisAddress: redisAddress})
 	if err != nil {
 		t.FailNow()
 	}
@@ -48,4 +91,246 @@ func TestBroadcastPool(t *testing.T) {
 	if _, err := pool.Get(); err != nil {
 		t.FailNow()
 	}
+
+	if err := pool.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+}
+
+func TestBroadcastingPool_maxActive(t *testing.T) {
+	key := "bpool:maxactive"
+
+	// the connections of the pool itself aren't taken from the redis pool
+	rpool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", redisAddress)
+		},
+		MaxActive: 1,
+		Wait:      true,
+	}
+
+	pool, err := NewBroadcastingPool(rpool, PoolOptions{MaxEntries: 100})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer pool.Close()
+
+	c, _ := pool.Get()
+	defer c.Close()
+
+	if err := c.Set(key, []byte("1"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	if v, err := c.Get(key); err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	if st := pool.PoolStats(); st.Active != 1 {
+		t.Fatalf("stats: %+v", st)
+	}
+
+	if err := c.Set(key, []byte("2"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	waitInvalidated(c, key)
+	if v, err := c.Get(key); err != nil || string(v) != "2" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+}
+
+func TestBroadcastingPool_closeReconnecting(t *testing.T) {
+	// reopening the connections takes a while
+	var slow uint32
+	wrap := func(conn redis.Conn, role ConnRole) redis.Conn {
+		if role == ConnTracking && atomic.LoadUint32(&slow) == 1 {
+			time.Sleep(time.Millisecond * 50)
+		}
+
+		return conn
+	}
+
+	pool, err := NewDefaultBroadcastingPool(PoolOptions{MaxEntries: 100, RedisAddress: redisAddress, WrapConn: wrap})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	// the pool is closed while reconnecting, which mustn't reopen the connections
+	atomic.StoreUint32(&slow, 1)
+	pool.failover(redisAddress)
+	time.Sleep(time.Millisecond * 10)
+	if err := pool.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	if pool.stop != nil {
+		t.Fatal("connections reopened")
+	}
+}
+
+func TestTrackingPool_sharedInvalidation(t *testing.T) {
+	key := "sharedinvalidation"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100, InvalidationConns: 2})
+	clients := make([]*Client, 4)
+	for i := range clients {
+		c, err := pool.Get()
+		if err != nil {
+			t.Fatalf("failed to get client from pool: %v", err)
+		}
+
+		clients[i] = c
+	}
+
+	// clients are spread over the shared connections
+	inv := pool.invalidators[0]
+	if inv.numClients() != 2 || pool.invalidators[1].numClients() != 2 {
+		t.Fatalf("clients: %d, %d", inv.numClients(), pool.invalidators[1].numClients())
+	}
+
+	if err := clients[0].Set(key, []byte("1"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	for _, c := range clients[1:] {
+		if _, err := c.Get(key); err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+	}
+
+	if err := clients[0].Set(key, []byte("2"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	for _, c := range clients[1:] {
+		for i := 0; i < 100; i++ {
+			if _, ok := c.cache.getEntry(key); !ok {
+				break
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		if v, err := c.Get(key); err != nil || string(v) != "2" {
+			t.Fatalf("v: %s, err: %v", v, err)
+		}
+	}
+
+	// the clients of a failed invalidation connection are out-of-sync, new clients get a new connection
+	inv.conn.Close()
+	for i := 0; i < 100 && !clients[2].isClosed(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if !clients[0].isClosed() || !clients[2].isClosed() || clients[1].isClosed() {
+		t.Fatal("clients of the failed connection not closed")
+	}
+
+	for i := 0; i < 100 && atomic.LoadUint64(&pool.counters.outOfSync) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if n := atomic.LoadUint64(&pool.counters.outOfSync); n != 1 {
+		t.Fatalf("out-of-sync: %d", n)
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+
+	if inv.numClients() != 0 {
+		t.Fatalf("clients: %d", inv.numClients())
+	}
+
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+
+	if c.invalidator == inv || c.invalidator.isFailed() {
+		t.Fatal("client registered with the failed connection")
+	}
+
+	c.Delete(key)
+	pool.Close()
+}
+
+func TestTrackingPool_Stats(t *testing.T) {
+	key := "trackingstats"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100, MaxActive: 2, Wait: true})
+	c1, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+
+	c2, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+
+	if err := c1.Set(key, []byte("1"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	for _, c := range []*Client{c1, c2, c2} {
+		if _, err := c.Get(key); err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+	}
+
+	// a failed client is discarded, its slot is given back and its counters are kept
+	var stopped bool
+	stopExpiry := c2.stopExpiry
+	c2.stopExpiry = func() {
+		stopped = true
+		stopExpiry()
+	}
+
+	c2.setClosed()
+	c2.Close()
+	if !stopped {
+		t.Fatal("expiry watcher of discarded client not stopped")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	c3, err := pool.GetContext(ctx)
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+
+	st := pool.Stats()
+	if st.Hits != 1 || st.Misses != 2 || st.NumEntries != 1 || st.Active != 2 || st.Discarded != 1 {
+		t.Fatalf("stats: %+v", st)
+	}
+
+	// a client failing while free isn't reused
+	c1.Close()
+	c1.setClosed()
+	c3.Close()
+
+	c4, err := pool.GetContext(ctx)
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+
+	if c4 != c3 {
+		t.Fatal("failed client reused")
+	}
+
+	if st := pool.Stats(); st.Active != 1 || st.Idle != 0 || st.Discarded != 2 || st.NumEntries != 0 {
+		t.Fatalf("stats: %+v", st)
+	}
+
+	c4.Delete(key)
+	c4.Close()
+	pool.Close()
+
+	if st := pool.Stats(); st.Active != 0 {
+		t.Fatalf("stats: %+v", st)
+	}
 }
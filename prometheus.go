@@ -0,0 +1,213 @@
+package csc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Collector reports the metrics of pools in the Prometheus text exposition format. It can serve them over HTTP or
+// write them anywhere, like a file read by the node exporter's textfile collector.
+type Collector struct {
+	mu    sync.Mutex
+	names []string
+	pools []Pool
+}
+
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+// Register adds p to the pools reported, its metrics are labeled with pool=name. p replaces the pool registered
+// with the same name, if any, as series must be unique
+func (c *Collector) Register(name string, p Pool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, n := range c.names {
+		if n == name {
+			c.pools[i] = p
+			return
+		}
+	}
+
+	c.names = append(c.names, name)
+	c.pools = append(c.pools, p)
+}
+
+// metric is a metric family, value returns its value for a pool and false if the pool doesn't have it
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value func(p Pool) (float64, bool)
+}
+
+func cacheCounterMetric(name string, i int, help string) metric {
+	return metric{name, "counter", help, func(p Pool) (float64, bool) {
+		return float64(p.counts().cacheCounter(i)), true
+	}}
+}
+
+func counterMetric(name string, counter func(cnt *counters) *uint64, help string) metric {
+	return metric{name, "counter", help, func(p Pool) (float64, bool) {
+		return float64(atomic.LoadUint64(counter(p.counts()))), true
+	}}
+}
+
+func poolStatsMetric(name, kind string, value func(st PoolStats) float64, help string) metric {
+	return metric{name, kind, help, func(p Pool) (float64, bool) {
+		switch pool := p.(type) {
+		case *TrackingPool:
+			return value(pool.PoolStats()), true
+		case *BroadcastingPool:
+			return value(pool.PoolStats()), true
+		case *ClusterPool:
+			return value(pool.PoolStats()), true
+		default:
+			return 0, false
+		}
+	}}
+}
+
+func cacheStatsMetric(name string, value func(st Stats) float64, help string) metric {
+	return metric{name, "gauge", help, func(p Pool) (float64, bool) {
+		switch pool := p.(type) {
+		case *TrackingPool:
+			return value(pool.Stats().Stats), true
+		case *BroadcastingPool:
+			return value(pool.Stats()), true
+		case *ClusterPool:
+			return value(pool.Stats()), true
+		default:
+			return 0, false
+		}
+	}}
+}
+
+var metrics = []metric{
+	cacheCounterMetric("csc_cache_hits_total", counterHits, "Local cache hits."),
+	cacheCounterMetric("csc_cache_misses_total", counterMisses, "Local cache misses."),
+	cacheCounterMetric("csc_cache_evictions_total", counterEvictions, "Keys evicted from local caches."),
+	cacheCounterMetric("csc_cache_rejections_total", counterRejections, "Keys not cached because they didn't fit."),
+	cacheCounterMetric("csc_cache_expired_total", counterExpired, "Expired keys removed from local caches."),
+	cacheCounterMetric("csc_cache_flushes_total", counterFlushes, "Local caches cleared because Redis invalidated all keys."),
+	cacheStatsMetric("csc_cache_entries", func(st Stats) float64 {
+		return float64(st.NumEntries)
+	}, "Keys in the local caches."),
+	cacheStatsMetric("csc_cache_bytes", func(st Stats) float64 {
+		return float64(st.Bytes)
+	}, "Size of the keys and values in the local caches."),
+	counterMetric("csc_invalidations_total", func(cnt *counters) *uint64 {
+		return &cnt.invalidations
+	}, "Invalidation messages received."),
+	counterMetric("csc_out_of_sync_total", func(cnt *counters) *uint64 {
+		return &cnt.outOfSync
+	}, "Times local caches went out-of-sync because a connection failed."),
+	counterMetric("csc_reconnects_total", func(cnt *counters) *uint64 {
+		return &cnt.reconnects
+	}, "Times invalidation connections were reopened after failing."),
+	poolStatsMetric("csc_pool_active_clients", "gauge", func(st PoolStats) float64 {
+		return float64(st.Active)
+	}, "Clients in use or idle."),
+	poolStatsMetric("csc_pool_idle_clients", "gauge", func(st PoolStats) float64 {
+		return float64(st.Idle)
+	}, "Idle clients."),
+	poolStatsMetric("csc_pool_waited_total", "counter", func(st PoolStats) float64 {
+		return float64(st.Waited)
+	}, "Gets that waited for a client."),
+	poolStatsMetric("csc_pool_wait_seconds_total", "counter", func(st PoolStats) float64 {
+		return st.WaitDuration.Seconds()
+	}, "Time spent waiting for clients."),
+	poolStatsMetric("csc_pool_wait_canceled_total", "counter", func(st PoolStats) float64 {
+		return float64(st.WaitCanceled)
+	}, "Gets whose context was done while waiting for a client."),
+	poolStatsMetric("csc_pool_dial_failures_total", "counter", func(st PoolStats) float64 {
+		return float64(st.DialFailures)
+	}, "Clients that failed to dial."),
+	poolStatsMetric("csc_pool_discarded_total", "counter", func(st PoolStats) float64 {
+		return float64(st.Discarded)
+	}, "Clients discarded because they failed."),
+}
+
+// WriteTo writes the metrics of the registered pools to w
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	names := append([]string(nil), c.names...)
+	pools := append([]Pool(nil), c.pools...)
+	c.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		header := false
+		for i, p := range pools {
+			v, ok := m.value(p)
+			if !ok {
+				continue
+			}
+
+			if !header {
+				writeMetricHeader(&buf, m.name, m.kind, m.help)
+				header = true
+			}
+
+			fmt.Fprintf(&buf, "%s{pool=\"%s\"} %s\n", m.name, escapeLabel(names[i]), formatFloat(v))
+		}
+	}
+
+	if len(pools) > 0 {
+		name := "csc_redis_roundtrip_seconds"
+		writeMetricHeader(&buf, name, "histogram", "Latency of commands run by clients.")
+		for i, p := range pools {
+			writeHistogram(&buf, name, escapeLabel(names[i]), &p.counts().roundTrips)
+		}
+	}
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics for Prometheus to scrape
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeHistogram(buf *bytes.Buffer, name, pool string, h *histogram) {
+	var cumulative uint64
+	for i, le := range roundTripBuckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(buf, "%s_bucket{pool=\"%s\",le=\"%s\"} %d\n", name, pool, formatFloat(le), cumulative)
+	}
+
+	// values are observed concurrently, the +Inf bucket mustn't be below the finite ones
+	count := atomic.LoadUint64(&h.numValues)
+	if cumulative > count {
+		count = cumulative
+	}
+
+	sum := time.Duration(atomic.LoadUint64(&h.sumNanos)).Seconds()
+	fmt.Fprintf(buf, "%s_bucket{pool=\"%s\",le=\"+Inf\"} %d\n", name, pool, count)
+	fmt.Fprintf(buf, "%s_sum{pool=\"%s\"} %s\n", name, pool, formatFloat(sum))
+	fmt.Fprintf(buf, "%s_count{pool=\"%s\"} %d\n", name, pool, count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
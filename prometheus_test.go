@@ -0,0 +1,96 @@
+package csc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCollector(t *testing.T) {
+	key := "metrics"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100})
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Set(key, []byte("1"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get(key); err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+	}
+
+	// the counters are monotonic, unlike Stats
+	c.Flush()
+	c.Delete(key)
+
+	col := NewCollector()
+	col.Register(`tracking "a"`, pool)
+
+	var buf bytes.Buffer
+	if _, err := col.WriteTo(&buf); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE csc_cache_hits_total counter\n",
+		`csc_cache_hits_total{pool="tracking \"a\""} 2` + "\n",
+		`csc_cache_misses_total{pool="tracking \"a\""} 1` + "\n",
+		`csc_pool_active_clients{pool="tracking \"a\""} 1` + "\n",
+		"# TYPE csc_redis_roundtrip_seconds histogram\n",
+		// SETEX, GET and TTL in a transaction, and DEL
+		`csc_redis_roundtrip_seconds_bucket{pool="tracking \"a\"",le="+Inf"} 3` + "\n",
+		`csc_redis_roundtrip_seconds_count{pool="tracking \"a\""} 3` + "\n",
+		`csc_cache_entries{pool="tracking \"a\""} 0` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestCollector_duplicate(t *testing.T) {
+	pool1 := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100})
+	defer pool1.Close()
+
+	pool2 := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100})
+	defer pool2.Close()
+
+	c, err := pool2.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c.Close()
+
+	// the pool registered last under a name is reported once
+	col := NewCollector()
+	col.Register("a", pool1)
+	col.Register("b", pool1)
+	col.Register("a", pool2)
+
+	var buf bytes.Buffer
+	if _, err := col.WriteTo(&buf); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	out := buf.String()
+	if n := strings.Count(out, `csc_pool_active_clients{pool="a"}`); n != 1 {
+		t.Fatalf("series: %d, in:\n%s", n, out)
+	}
+
+	for _, want := range []string{
+		`csc_pool_active_clients{pool="a"} 1` + "\n",
+		`csc_pool_active_clients{pool="b"} 0` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+}
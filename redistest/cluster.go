@@ -0,0 +1,275 @@
+package redistest
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// NumSlots is the number of hash slots of a cluster
+const NumSlots = 16384
+
+// Cluster runs servers forming a Redis Cluster of masters without replicas. Keys are routed by hash slot like in Redis,
+// servers reply MOVED to commands for slots they don't own and ASK for missing keys of slots being migrated.
+type Cluster struct {
+	servers []*Server
+
+	mu sync.Mutex
+	// index of the server owning each slot
+	owners [NumSlots]int
+	// index of the server each migrating slot is imported by
+	migrating map[int]int
+}
+
+// NewCluster starts a cluster of n servers on random local ports, with the slots split evenly between them
+func NewCluster(n int) (*Cluster, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of servers: %d", n)
+	}
+
+	c := &Cluster{migrating: map[int]int{}}
+	for i := 0; i < n; i++ {
+		s, err := NewServer()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		s.cluster = c
+		s.node = i
+		c.servers = append(c.servers, s)
+	}
+
+	for slot := range c.owners {
+		c.owners[slot] = slot * n / NumSlots
+	}
+
+	return c, nil
+}
+
+// Server returns the i:th server of the cluster
+func (c *Cluster) Server(i int) *Server {
+	return c.servers[i]
+}
+
+// Addrs returns the addresses of the servers
+func (c *Cluster) Addrs() []string {
+	addrs := make([]string, len(c.servers))
+	for i, s := range c.servers {
+		addrs[i] = s.Addr()
+	}
+
+	return addrs
+}
+
+// Close stops all servers
+func (c *Cluster) Close() error {
+	var err error
+	for _, s := range c.servers {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// Owner returns the index of the server owning slot
+func (c *Cluster) Owner(slot int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.owners[slot]
+}
+
+// Set sets the string value of key on the server owning it, like Server.Set
+func (c *Cluster) Set(key string, value []byte) {
+	c.servers[c.Owner(Slot(key))].Set(key, value)
+}
+
+// MoveSlot moves slot and its keys to the i:th server, like a finished resharding. The keys are deleted from the
+// previous owner, invalidating them there.
+func (c *Cluster) MoveSlot(slot, i int) {
+	from := c.servers[c.Owner(slot)]
+	items := from.takeSlot(slot)
+	c.servers[i].putItems(items)
+
+	c.mu.Lock()
+	c.owners[slot] = i
+	delete(c.migrating, slot)
+	c.mu.Unlock()
+}
+
+// MigrateSlot starts migrating slot to the i:th server, the owner then replies ASK to commands for keys it doesn't
+// have. MoveSlot finishes the migration.
+func (c *Cluster) MigrateSlot(slot, i int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.migrating[slot] = i
+}
+
+// returns the error redirecting a command for keys to another server of the cluster, if any
+func (c *Cluster) redirect(s *Server, cl *client, keys []string) string {
+	slot := Slot(keys[0])
+	for _, k := range keys[1:] {
+		if Slot(k) != slot {
+			return "CROSSSLOT Keys in request don't hash to the same slot"
+		}
+	}
+
+	c.mu.Lock()
+	owner := c.owners[slot]
+	importer, migrating := c.migrating[slot]
+	c.mu.Unlock()
+
+	if owner != s.node {
+		if migrating && importer == s.node && cl.asking {
+			return ""
+		}
+
+		return fmt.Sprintf("MOVED %d %s", slot, c.servers[owner].Addr())
+	}
+
+	if migrating {
+		for _, k := range keys {
+			if s.lookup(0, k) == nil {
+				return fmt.Sprintf("ASK %d %s", slot, c.servers[importer].Addr())
+			}
+		}
+	}
+
+	return ""
+}
+
+// writes the reply of CLUSTER SLOTS
+func (c *Cluster) writeSlots(w *writer) {
+	c.mu.Lock()
+	owners := c.owners
+	c.mu.Unlock()
+
+	type slotRange struct{ start, end, owner int }
+	var ranges []slotRange
+	for slot, owner := range owners {
+		if n := len(ranges); n > 0 && ranges[n-1].owner == owner && ranges[n-1].end == slot-1 {
+			ranges[n-1].end = slot
+			continue
+		}
+
+		ranges = append(ranges, slotRange{slot, slot, owner})
+	}
+
+	w.array(len(ranges))
+	for _, r := range ranges {
+		host, port, _ := net.SplitHostPort(c.servers[r.owner].Addr())
+		p, _ := strconv.Atoi(port)
+
+		w.array(3)
+		w.int(int64(r.start))
+		w.int(int64(r.end))
+		w.array(3)
+		w.bulkString(host)
+		w.int(int64(p))
+		w.bulkString(fmt.Sprintf("%040d", r.owner))
+	}
+}
+
+// removes and returns the items of slot, invalidating them
+func (s *Server) takeSlot(slot int) map[string]*item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := map[string]*item{}
+	for k, it := range s.db(0) {
+		if Slot(k) == slot {
+			items[k] = it
+			delete(s.db(0), k)
+			s.touch(nil, 0, k)
+		}
+	}
+
+	return items
+}
+
+func (s *Server) putItems(items map[string]*item) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, it := range items {
+		s.db(0)[k] = it
+		s.touch(nil, 0, k)
+	}
+}
+
+// returns the keys of a command, which are routed by slot in a cluster
+func commandKeys(name string, args []string) []string {
+	switch name {
+	case "MGET", "DEL", "EXISTS", "WATCH":
+		return args[1:]
+	case "PING", "ECHO", "SELECT", "HELLO", "CLIENT", "DBSIZE", "FLUSHDB", "FLUSHALL", "PUBLISH", "SUBSCRIBE",
+		"UNSUBSCRIBE", "PUNSUBSCRIBE", "UNWATCH", "CLUSTER", "ASKING":
+		return nil
+	}
+
+	if len(args) < 2 {
+		return nil
+	}
+
+	return args[1:2]
+}
+
+func cmdCluster(s *Server, c *client, args []string) {
+	if s.cluster == nil {
+		c.w.err("ERR This instance has cluster support disabled")
+		return
+	}
+
+	switch strings.ToUpper(args[1]) {
+	case "SLOTS":
+		s.cluster.writeSlots(&c.w)
+	case "KEYSLOT":
+		if len(args) != 3 {
+			c.w.err(errSyntax)
+			return
+		}
+
+		c.w.int(int64(Slot(args[2])))
+	default:
+		c.w.err("ERR unknown subcommand '" + args[1] + "'")
+	}
+}
+
+func cmdAsking(s *Server, c *client, args []string) {
+	c.asking = true
+	c.w.ok()
+}
+
+// Slot returns the hash slot of key, only the part within the first {} is hashed if it's not empty
+func Slot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+
+	return int(crc16(key) % NumSlots)
+}
+
+// CRC16 XMODEM, as used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
@@ -0,0 +1,99 @@
+package redistest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestCluster(t *testing.T) {
+	c, err := NewCluster(2)
+	if err != nil {
+		t.Fatalf("failed to start cluster: %v", err)
+	}
+	defer c.Close()
+
+	conn, err := redis.Dial("tcp", c.Server(0).Addr(), redis.DialReadTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	slots, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil || len(slots) != 2 {
+		t.Fatalf("slots: %v, err: %v", slots, err)
+	}
+
+	if s, err := redis.Int(conn.Do("CLUSTER", "KEYSLOT", "123456789")); err != nil || s != 12739 {
+		t.Fatalf("slot: %d, err: %v", s, err)
+	}
+
+	// returns a key of the i:th server
+	keyOf := func(i int) string {
+		for n := 0; ; n++ {
+			if k := fmt.Sprintf("{%d}", n); c.Owner(Slot(k)) == i {
+				return k
+			}
+		}
+	}
+
+	// a key of the other server is redirected
+	key := keyOf(1)
+	slot := Slot(key)
+
+	moved := fmt.Sprintf("MOVED %d %s", slot, c.Server(1).Addr())
+	if _, err := conn.Do("SET", key, "1"); err == nil || err.Error() != moved {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := conn.Do("MGET", keyOf(0), key); err == nil || !strings.HasPrefix(err.Error(), "CROSSSLOT") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// missing keys of a migrating slot are redirected with ASK, which the importing server only accepts after ASKING
+	c.MigrateSlot(slot, 0)
+	c.Set(key, []byte("1"))
+	conn1, err := redis.Dial("tcp", c.Server(1).Addr(), redis.DialReadTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn1.Close()
+
+	if v, err := redis.String(conn1.Do("GET", key)); err != nil || v != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	ask := fmt.Sprintf("ASK %d %s", slot, c.Server(0).Addr())
+	if _, err := conn1.Do("GET", key+"x"); err == nil || err.Error() != ask {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := conn.Do("SET", key+"x", "2"); err == nil || err.Error() != moved {
+		t.Fatalf("err: %v", err)
+	}
+
+	conn.Send("ASKING")
+	if _, err := conn.Do("SET", key+"x", "2"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// moving the slot moves its keys
+	c.MoveSlot(slot, 0)
+	for _, k := range []string{key, key + "x"} {
+		if _, ok := c.Server(0).Get(k); !ok {
+			t.Fatalf("not moved: %s", k)
+		}
+	}
+
+	if v, err := redis.String(conn.Do("GET", key)); err != nil || v != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	moved = fmt.Sprintf("MOVED %d %s", slot, c.Server(0).Addr())
+	if _, err := conn1.Do("GET", key); err == nil || err.Error() != moved {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,1071 @@
+package redistest
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	errSyntax    = "ERR syntax error"
+	errWrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+	errNotInt    = "ERR value is not an integer or out of range"
+	errNotFloat  = "ERR value is not a valid float"
+)
+
+type command struct {
+	// minimum number of arguments including the command name, negative means exact
+	arity int
+	fn    func(s *Server, c *client, args []string)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"PING":         {1, cmdPing},
+		"ECHO":         {-2, cmdEcho},
+		"SELECT":       {-2, cmdSelect},
+		"HELLO":        {1, cmdHello},
+		"CLIENT":       {2, cmdClient},
+		"GET":          {-2, cmdGet},
+		"SET":          {3, cmdSet},
+		"SETEX":        {-4, cmdSetex},
+		"MGET":         {2, cmdMget},
+		"DEL":          {2, cmdDel},
+		"EXISTS":       {2, cmdExists},
+		"TTL":          {-2, cmdTTL},
+		"PTTL":         {-2, cmdPTTL},
+		"EXPIRE":       {-3, cmdExpire},
+		"DBSIZE":       {-1, cmdDBSize},
+		"FLUSHDB":      {1, cmdFlushDB},
+		"FLUSHALL":     {1, cmdFlushAll},
+		"HGET":         {-3, cmdHGet},
+		"HMGET":        {3, cmdHMGet},
+		"HGETALL":      {-2, cmdHGetAll},
+		"HSET":         {4, cmdHSet},
+		"HDEL":         {3, cmdHDel},
+		"SADD":         {3, cmdSAdd},
+		"SREM":         {3, cmdSRem},
+		"SMEMBERS":     {-2, cmdSMembers},
+		"SISMEMBER":    {-3, cmdSIsMember},
+		"ZADD":         {4, cmdZAdd},
+		"ZREM":         {3, cmdZRem},
+		"ZRANGE":       {4, cmdZRange},
+		"ZSCORE":       {-3, cmdZScore},
+		"PUBLISH":      {-3, cmdPublish},
+		"SUBSCRIBE":    {2, cmdSubscribe},
+		"UNSUBSCRIBE":  {1, cmdUnsubscribe},
+		"PUNSUBSCRIBE": {1, cmdPUnsubscribe},
+		"WATCH":        {2, cmdWatch},
+		"UNWATCH":      {-1, cmdUnwatch},
+		"CLUSTER":      {2, cmdCluster},
+		"ASKING":       {-1, cmdAsking},
+		"SENTINEL":     {2, cmdSentinel},
+	}
+}
+
+// dispatch runs a single command, returns true if the connection should be closed
+func (s *Server) dispatch(c *client, args []string) bool {
+	name := strings.ToUpper(args[0])
+
+	switch name {
+	case "QUIT":
+		c.w.ok()
+		return true
+	case "MULTI":
+		if c.multi {
+			c.w.err("ERR MULTI calls can not be nested")
+			return false
+		}
+
+		c.multi = true
+		c.multiErr = false
+		c.queued = nil
+		c.w.ok()
+		return false
+	case "EXEC":
+		s.exec(c)
+		c.asking = false
+		c.caching = 0
+		return false
+	case "DISCARD":
+		if !c.multi {
+			c.w.err("ERR DISCARD without MULTI")
+			return false
+		}
+
+		c.multi = false
+		c.queued = nil
+		c.watched = nil
+		c.asking = false
+		c.caching = 0
+		c.w.ok()
+		return false
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		c.w.err("ERR unknown command '" + args[0] + "'")
+		c.multiErr = c.multi
+		return false
+	}
+
+	if (cmd.arity < 0 && len(args) != -cmd.arity) || (cmd.arity > 0 && len(args) < cmd.arity) {
+		c.w.err("ERR wrong number of arguments for '" + strings.ToLower(args[0]) + "' command")
+		c.multiErr = c.multi
+		return false
+	}
+
+	if s.cluster != nil && name != "ASKING" {
+		keys := commandKeys(name, args)
+		redirect := ""
+		if len(keys) > 0 {
+			redirect = s.cluster.redirect(s, c, keys)
+		}
+
+		// like in Redis the flag of ASKING holds for a whole transaction
+		if !c.multi {
+			c.asking = false
+		}
+
+		if redirect != "" {
+			c.w.err(redirect)
+			c.multiErr = c.multi
+			return false
+		}
+	}
+
+	if c.multi {
+		if name == "WATCH" {
+			c.w.err("ERR WATCH inside MULTI is not allowed")
+			return false
+		}
+
+		c.queued = append(c.queued, args)
+		c.w.simple("QUEUED")
+		return false
+	}
+
+	s.run(c, name, args)
+	return false
+}
+
+func (s *Server) run(c *client, name string, args []string) {
+	caching := c.caching
+	commands[name].fn(s, c, args)
+
+	// the CLIENT CACHING flag only applies to the command, or transaction, following it
+	if caching != 0 && c.caching == caching {
+		c.caching = 0
+	}
+}
+
+func (s *Server) exec(c *client) {
+	if !c.multi {
+		c.w.err("ERR EXEC without MULTI")
+		return
+	}
+
+	queued := c.queued
+	watched := c.watched
+	c.multi = false
+	c.queued = nil
+	c.watched = nil
+
+	if c.multiErr {
+		c.w.err("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	for k, v := range watched {
+		if s.versions[k] != v {
+			c.w.nullArray()
+			return
+		}
+	}
+
+	// like in Redis the CLIENT CACHING flag holds for a whole transaction
+	caching := c.caching
+	c.w.array(len(queued))
+	for _, args := range queued {
+		c.caching = caching
+		s.run(c, strings.ToUpper(args[0]), args)
+	}
+}
+
+func cmdPing(s *Server, c *client, args []string) {
+	// like Redis, a subscribed RESP2 connection gets a pong message
+	if c.w.proto != 3 && len(c.subs) > 0 {
+		msg := ""
+		if len(args) > 1 {
+			msg = args[1]
+		}
+
+		c.w.array(2)
+		c.w.bulkString("pong")
+		c.w.bulkString(msg)
+		return
+	}
+
+	if len(args) > 1 {
+		c.w.bulkString(args[1])
+		return
+	}
+
+	c.w.simple("PONG")
+}
+
+func cmdEcho(s *Server, c *client, args []string) {
+	c.w.bulkString(args[1])
+}
+
+func cmdSelect(s *Server, c *client, args []string) {
+	db, err := strconv.Atoi(args[1])
+	if err != nil || db < 0 || db > 15 {
+		c.w.err("ERR DB index is out of range")
+		return
+	}
+
+	c.db = db
+	c.w.ok()
+}
+
+func cmdHello(s *Server, c *client, args []string) {
+	if s.resp2Only {
+		c.w.err("ERR unknown command 'HELLO'")
+		return
+	}
+
+	if len(args) > 1 {
+		proto, err := strconv.Atoi(args[1])
+		if err != nil || (proto != 2 && proto != 3) {
+			c.w.err("NOPROTO unsupported protocol version")
+			return
+		}
+
+		c.w.proto = proto
+	}
+
+	c.w.mapHeader(7)
+	c.w.bulkString("server")
+	c.w.bulkString("redis")
+	c.w.bulkString("version")
+	c.w.bulkString("6.2.0")
+	c.w.bulkString("proto")
+	c.w.int(int64(c.w.proto))
+	c.w.bulkString("id")
+	c.w.int(c.id)
+	c.w.bulkString("mode")
+	c.w.bulkString("standalone")
+	c.w.bulkString("role")
+	c.w.bulkString("master")
+	c.w.bulkString("modules")
+	c.w.array(0)
+}
+
+func cmdClient(s *Server, c *client, args []string) {
+	switch strings.ToUpper(args[1]) {
+	case "ID":
+		c.w.int(c.id)
+	case "SETNAME":
+		c.w.ok()
+	case "GETREDIR":
+		if !c.tracking {
+			c.w.int(-1)
+			return
+		}
+
+		c.w.int(c.redirect)
+	case "TRACKING":
+		clientTracking(s, c, args[2:])
+	case "CACHING":
+		if len(args) != 3 {
+			c.w.err(errSyntax)
+			return
+		}
+
+		if !c.tracking || (!c.optin && !c.optout) {
+			c.w.err("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+			return
+		}
+
+		switch strings.ToUpper(args[2]) {
+		case "YES":
+			c.caching = 1
+		case "NO":
+			c.caching = -1
+		default:
+			c.w.err(errSyntax)
+			return
+		}
+
+		c.w.ok()
+	default:
+		c.w.err("ERR unknown subcommand '" + args[1] + "'")
+	}
+}
+
+func clientTracking(s *Server, c *client, args []string) {
+	if len(args) == 0 {
+		c.w.err(errSyntax)
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "OFF":
+		c.tracking = false
+		c.bcast = false
+		c.prefixes = nil
+		c.redirect = 0
+		c.noloop = false
+		c.optin = false
+		c.optout = false
+		c.w.ok()
+		return
+	case "ON":
+	default:
+		c.w.err(errSyntax)
+		return
+	}
+
+	var (
+		redirect int64
+		bcast    bool
+		noloop   bool
+		optin    bool
+		optout   bool
+		prefixes []string
+	)
+
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REDIRECT":
+			if i+1 >= len(args) {
+				c.w.err(errSyntax)
+				return
+			}
+
+			i++
+			id, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				c.w.err(errNotInt)
+				return
+			}
+
+			if _, ok := s.clients[id]; !ok {
+				c.w.err("ERR The client ID you want redirect to does not exist")
+				return
+			}
+
+			redirect = id
+		case "PREFIX":
+			if i+1 >= len(args) {
+				c.w.err(errSyntax)
+				return
+			}
+
+			i++
+			prefixes = append(prefixes, args[i])
+		case "BCAST":
+			bcast = true
+		case "NOLOOP":
+			noloop = true
+		case "OPTIN":
+			optin = true
+		case "OPTOUT":
+			optout = true
+		default:
+			c.w.err(errSyntax)
+			return
+		}
+	}
+
+	if len(prefixes) > 0 && !bcast {
+		c.w.err("ERR PREFIX option requires BCAST mode to be enabled")
+		return
+	}
+
+	if bcast && (optin || optout) {
+		c.w.err("ERR OPTIN and OPTOUT are not compatible with BCAST")
+		return
+	}
+
+	if optin && optout {
+		c.w.err("ERR You can't use both OPTIN and OPTOUT")
+		return
+	}
+
+	c.tracking = true
+	c.redirect = redirect
+	c.bcast = bcast
+	c.noloop = noloop
+	c.optin = optin
+	c.optout = optout
+	c.prefixes = prefixes
+	c.w.ok()
+}
+
+func cmdGet(s *Server, c *client, args []string) {
+	it := s.lookup(c.db, args[1])
+	s.read(c, args[1])
+	if it == nil {
+		c.w.null()
+		return
+	}
+
+	if it.kind != kindString {
+		c.w.err(errWrongType)
+		return
+	}
+
+	c.w.bulk(it.str)
+}
+
+func cmdSet(s *Server, c *client, args []string) {
+	var (
+		ttl time.Duration
+		nx  bool
+		xx  bool
+	)
+
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				c.w.err(errSyntax)
+				return
+			}
+
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				c.w.err("ERR invalid expire time in 'set' command")
+				return
+			}
+
+			if strings.ToUpper(args[i]) == "EX" {
+				ttl = time.Duration(n) * time.Second
+			} else {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+			i++
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			c.w.err(errSyntax)
+			return
+		}
+	}
+
+	exists := s.lookup(c.db, args[1]) != nil
+	if (nx && exists) || (xx && !exists) {
+		c.w.null()
+		return
+	}
+
+	s.setString(c, args[1], args[2], ttl)
+	c.w.ok()
+}
+
+func cmdSetex(s *Server, c *client, args []string) {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		c.w.err(errNotInt)
+		return
+	}
+
+	if n <= 0 {
+		c.w.err("ERR invalid expire time in 'setex' command")
+		return
+	}
+
+	s.setString(c, args[1], args[3], time.Duration(n)*time.Second)
+	c.w.ok()
+}
+
+func (s *Server) setString(c *client, key, value string, ttl time.Duration) {
+	it := &item{kind: kindString, str: []byte(value)}
+	if ttl > 0 {
+		it.expires = time.Now().Add(ttl)
+	}
+
+	s.db(c.db)[key] = it
+	s.touch(c, c.db, key)
+}
+
+func cmdMget(s *Server, c *client, args []string) {
+	c.w.array(len(args) - 1)
+	for _, k := range args[1:] {
+		it := s.lookup(c.db, k)
+		s.read(c, k)
+		if it == nil || it.kind != kindString {
+			c.w.null()
+			continue
+		}
+
+		c.w.bulk(it.str)
+	}
+}
+
+func cmdDel(s *Server, c *client, args []string) {
+	n := 0
+	for _, k := range args[1:] {
+		if s.lookup(c.db, k) == nil {
+			continue
+		}
+
+		delete(s.db(c.db), k)
+		s.touch(c, c.db, k)
+		n++
+	}
+
+	c.w.int(int64(n))
+}
+
+func cmdExists(s *Server, c *client, args []string) {
+	n := 0
+	for _, k := range args[1:] {
+		if s.lookup(c.db, k) != nil {
+			n++
+		}
+	}
+
+	c.w.int(int64(n))
+}
+
+func (s *Server) ttl(c *client, key string) time.Duration {
+	it := s.lookup(c.db, key)
+	s.read(c, key)
+	if it == nil {
+		return -2
+	}
+
+	if it.expires.IsZero() {
+		return -1
+	}
+
+	return time.Until(it.expires)
+}
+
+func cmdTTL(s *Server, c *client, args []string) {
+	ttl := s.ttl(c, args[1])
+	if ttl < 0 {
+		c.w.int(int64(ttl))
+		return
+	}
+
+	c.w.int(int64(math.Round(ttl.Seconds())))
+}
+
+func cmdPTTL(s *Server, c *client, args []string) {
+	ttl := s.ttl(c, args[1])
+	if ttl < 0 {
+		c.w.int(int64(ttl))
+		return
+	}
+
+	c.w.int(ttl.Milliseconds())
+}
+
+func cmdExpire(s *Server, c *client, args []string) {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		c.w.err(errNotInt)
+		return
+	}
+
+	it := s.lookup(c.db, args[1])
+	if it == nil {
+		c.w.int(0)
+		return
+	}
+
+	if n <= 0 {
+		delete(s.db(c.db), args[1])
+	} else {
+		it.expires = time.Now().Add(time.Duration(n) * time.Second)
+	}
+
+	s.touch(c, c.db, args[1])
+	c.w.int(1)
+}
+
+func cmdDBSize(s *Server, c *client, args []string) {
+	n := 0
+	for k := range s.db(c.db) {
+		if s.lookup(c.db, k) != nil {
+			n++
+		}
+	}
+
+	c.w.int(int64(n))
+}
+
+func cmdFlushDB(s *Server, c *client, args []string) {
+	s.flush(c.db)
+	c.w.ok()
+}
+
+func cmdFlushAll(s *Server, c *client, args []string) {
+	s.flush(-1)
+	c.w.ok()
+}
+
+// lookupKind returns the item at key if it is of kind k, writes a WRONGTYPE error and returns false if it is not
+func (s *Server) lookupKind(c *client, key string, k kind) (*item, bool) {
+	it := s.lookup(c.db, key)
+	s.read(c, key)
+	if it != nil && it.kind != k {
+		c.w.err(errWrongType)
+		return nil, false
+	}
+
+	return it, true
+}
+
+func cmdHGet(s *Server, c *client, args []string) {
+	it, ok := s.lookupKind(c, args[1], kindHash)
+	if !ok {
+		return
+	}
+
+	if it == nil {
+		c.w.null()
+		return
+	}
+
+	c.w.bulk(it.hash[args[2]])
+}
+
+func cmdHMGet(s *Server, c *client, args []string) {
+	it, ok := s.lookupKind(c, args[1], kindHash)
+	if !ok {
+		return
+	}
+
+	c.w.array(len(args) - 2)
+	for _, f := range args[2:] {
+		if it == nil {
+			c.w.null()
+			continue
+		}
+
+		c.w.bulk(it.hash[f])
+	}
+}
+
+func cmdHGetAll(s *Server, c *client, args []string) {
+	it, ok := s.lookupKind(c, args[1], kindHash)
+	if !ok {
+		return
+	}
+
+	if it == nil {
+		c.w.mapHeader(0)
+		return
+	}
+
+	fields := make([]string, 0, len(it.hash))
+	for f := range it.hash {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	c.w.mapHeader(len(fields))
+	for _, f := range fields {
+		c.w.bulkString(f)
+		c.w.bulk(it.hash[f])
+	}
+}
+
+func cmdHSet(s *Server, c *client, args []string) {
+	if len(args)%2 != 0 {
+		c.w.err("ERR wrong number of arguments for 'hset' command")
+		return
+	}
+
+	it, ok := s.lookupKind(c, args[1], kindHash)
+	if !ok {
+		return
+	}
+
+	if it == nil {
+		it = &item{kind: kindHash, hash: map[string][]byte{}}
+		s.db(c.db)[args[1]] = it
+	}
+
+	n := 0
+	for i := 2; i < len(args); i += 2 {
+		if _, ok := it.hash[args[i]]; !ok {
+			n++
+		}
+
+		it.hash[args[i]] = []byte(args[i+1])
+	}
+
+	s.touch(c, c.db, args[1])
+	c.w.int(int64(n))
+}
+
+func cmdHDel(s *Server, c *client, args []string) {
+	it, ok := s.lookupKind(c, args[1], kindHash)
+	if !ok {
+		return
+	}
+
+	n := 0
+	if it != nil {
+		for _, f := range args[2:] {
+			if _, ok := it.hash[f]; ok {
+				delete(it.hash, f)
+				n++
+			}
+		}
+
+		if len(it.hash) == 0 {
+			delete(s.db(c.db), args[1])
+		}
+	}
+
+	if n > 0 {
+		s.touch(c, c.db, args[1])
+	}
+
+	c.w.int(int64(n))
+}
+
+func cmdSAdd(s *Server, c *client, args []string) {
+	it, ok := s.lookupKind(c, args[1], kindSet)
+	if !ok {
+		return
+	}
+
+	if it == nil {
+		it = &item{kind: kindSet, set: map[string]struct{}{}}
+		s.db(c.db)[args[1]] = it
+	}
+
+	n := 0
+	for _, m := range args[2:] {
+		if _, ok := it.set[m]; !ok {
+			it.set[m] = struct{}{}
+			n++
+		}
+	}
+
+	if n > 0 {
+		s.touch(c, c.db, args[1])
+	}
+
+	c.w.int(int64(n))
+}
+
+func cmdSRem(s *Server, c *client, args []string) {
+	it, ok := s.lookupKind(c, args[1], kindSet)
+	if !ok {
+		return
+	}
+
+	n := 0
+	if it != nil {
+		for _, m := range args[2:] {
+			if _, ok := it.set[m]; ok {
+				delete(it.set, m)
+				n++
+			}
+		}
+
+		if len(it.set) == 0 {
+			delete(s.db(c.db), args[1])
+		}
+	}
+
+	if n > 0 {
+		s.touch(c, c.db, args[1])
+	}
+
+	c.w.int(int64(n))
+}
+
+func cmdSMembers(s *Server, c *client, args []string) {
+	it, ok := s.lookupKind(c, args[1], kindSet)
+	if !ok {
+		return
+	}
+
+	var members []string
+	if it != nil {
+		for m := range it.set {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+	}
+
+	c.w.setHeader(len(members))
+	for _, m := range members {
+		c.w.bulkString(m)
+	}
+}
+
+func cmdSIsMember(s *Server, c *client, args []string) {
+	it, ok := s.lookupKind(c, args[1], kindSet)
+	if !ok {
+		return
+	}
+
+	if it == nil {
+		c.w.int(0)
+		return
+	}
+
+	if _, ok := it.set[args[2]]; ok {
+		c.w.int(1)
+		return
+	}
+
+	c.w.int(0)
+}
+
+func cmdZAdd(s *Server, c *client, args []string) {
+	if len(args)%2 != 0 {
+		c.w.err(errSyntax)
+		return
+	}
+
+	it, ok := s.lookupKind(c, args[1], kindZSet)
+	if !ok {
+		return
+	}
+
+	scores := make([]float64, 0, (len(args)-2)/2)
+	for i := 2; i < len(args); i += 2 {
+		f, err := strconv.ParseFloat(args[i], 64)
+		if err != nil {
+			c.w.err(errNotFloat)
+			return
+		}
+
+		scores = append(scores, f)
+	}
+
+	if it == nil {
+		it = &item{kind: kindZSet, zset: map[string]float64{}}
+		s.db(c.db)[args[1]] = it
+	}
+
+	n := 0
+	for i := 2; i < len(args); i += 2 {
+		if _, ok := it.zset[args[i+1]]; !ok {
+			n++
+		}
+
+		it.zset[args[i+1]] = scores[(i-2)/2]
+	}
+
+	s.touch(c, c.db, args[1])
+	c.w.int(int64(n))
+}
+
+func cmdZRem(s *Server, c *client, args []string) {
+	it, ok := s.lookupKind(c, args[1], kindZSet)
+	if !ok {
+		return
+	}
+
+	n := 0
+	if it != nil {
+		for _, m := range args[2:] {
+			if _, ok := it.zset[m]; ok {
+				delete(it.zset, m)
+				n++
+			}
+		}
+
+		if len(it.zset) == 0 {
+			delete(s.db(c.db), args[1])
+		}
+	}
+
+	if n > 0 {
+		s.touch(c, c.db, args[1])
+	}
+
+	c.w.int(int64(n))
+}
+
+func cmdZRange(s *Server, c *client, args []string) {
+	start, err1 := strconv.Atoi(args[2])
+	stop, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil {
+		c.w.err(errNotInt)
+		return
+	}
+
+	withScores := false
+	for _, a := range args[4:] {
+		if strings.ToUpper(a) != "WITHSCORES" {
+			c.w.err(errSyntax)
+			return
+		}
+
+		withScores = true
+	}
+
+	it, ok := s.lookupKind(c, args[1], kindZSet)
+	if !ok {
+		return
+	}
+
+	var members []string
+	if it != nil {
+		for m := range it.zset {
+			members = append(members, m)
+		}
+
+		sort.Slice(members, func(i, j int) bool {
+			si, sj := it.zset[members[i]], it.zset[members[j]]
+			if si != sj {
+				return si < sj
+			}
+
+			return members[i] < members[j]
+		})
+	}
+
+	n := len(members)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+
+	if start > stop || start >= n {
+		c.w.array(0)
+		return
+	}
+
+	members = members[start : stop+1]
+	if !withScores {
+		c.w.strings(members)
+		return
+	}
+
+	// RESP3 replies with an array of member-score pairs
+	if c.w.proto == 3 {
+		c.w.array(len(members))
+		for _, m := range members {
+			c.w.array(2)
+			c.w.bulkString(m)
+			c.w.double(it.zset[m])
+		}
+
+		return
+	}
+
+	c.w.array(len(members) * 2)
+	for _, m := range members {
+		c.w.bulkString(m)
+		c.w.double(it.zset[m])
+	}
+}
+
+func cmdZScore(s *Server, c *client, args []string) {
+	it, ok := s.lookupKind(c, args[1], kindZSet)
+	if !ok {
+		return
+	}
+
+	if it == nil {
+		c.w.null()
+		return
+	}
+
+	f, ok := it.zset[args[2]]
+	if !ok {
+		c.w.null()
+		return
+	}
+
+	c.w.double(f)
+}
+
+func cmdPublish(s *Server, c *client, args []string) {
+	c.w.int(int64(s.publish(args[1], args[2])))
+}
+
+func cmdSubscribe(s *Server, c *client, args []string) {
+	for _, ch := range args[1:] {
+		c.subs[ch] = true
+
+		c.w.push(3)
+		c.w.bulkString("subscribe")
+		c.w.bulkString(ch)
+		c.w.int(int64(len(c.subs)))
+	}
+}
+
+func cmdUnsubscribe(s *Server, c *client, args []string) {
+	channels := args[1:]
+	if len(channels) == 0 {
+		for ch := range c.subs {
+			channels = append(channels, ch)
+		}
+		sort.Strings(channels)
+	}
+
+	if len(channels) == 0 {
+		c.w.push(3)
+		c.w.bulkString("unsubscribe")
+		c.w.null()
+		c.w.int(0)
+		return
+	}
+
+	for _, ch := range channels {
+		delete(c.subs, ch)
+
+		c.w.push(3)
+		c.w.bulkString("unsubscribe")
+		c.w.bulkString(ch)
+		c.w.int(int64(len(c.subs)))
+	}
+}
+
+// patterns aren't supported, replies as if none were subscribed to
+func cmdPUnsubscribe(s *Server, c *client, args []string) {
+	c.w.push(3)
+	c.w.bulkString("punsubscribe")
+	c.w.null()
+	c.w.int(int64(len(c.subs)))
+}
+
+func cmdWatch(s *Server, c *client, args []string) {
+	if c.watched == nil {
+		c.watched = map[string]uint64{}
+	}
+
+	for _, k := range args[1:] {
+		s.lookup(c.db, k)
+
+		vk := versionKey(c.db, k)
+		c.watched[vk] = s.versions[vk]
+	}
+
+	c.w.ok()
+}
+
+func cmdUnwatch(s *Server, c *client, args []string) {
+	c.watched = nil
+	c.w.ok()
+}
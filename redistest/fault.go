@@ -0,0 +1,239 @@
+package redistest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var errFaultClosed = errors.New("redistest: connection closed by fault")
+
+// Fault describes how a FaultConn fails a command or a received reply
+type Fault struct {
+	// delays sending the command, or returning the received reply
+	Delay time.Duration
+	// returned instead of sending the command, or instead of the received reply, which is lost
+	Err error
+	// sends PING in place of the command, like a lost write, so that pipelined replies stay in order. a dropped
+	// received reply, like an invalidation message, is discarded and the next one is received
+	Drop bool
+	// closes the connection before sending the command, or after receiving the reply, which is lost
+	Close bool
+	// number of times the fault is injected, 0 means always
+	Times int
+}
+
+type faultRule struct {
+	fault    Fault
+	injected int
+}
+
+// FaultConn wraps a connection, injecting faults into the commands sent on it and the replies received on it, e.g.
+// the invalidations of a subscribed connection. Faults can be changed while the connection is in use.
+type FaultConn struct {
+	conn     redis.Conn
+	mu       sync.Mutex
+	commands map[string]*faultRule
+	receive  *faultRule
+}
+
+func NewFaultConn(conn redis.Conn) *FaultConn {
+	return &FaultConn{
+		conn:     conn,
+		commands: map[string]*faultRule{},
+	}
+}
+
+// FailCommand injects f into the calls of cmd, replacing the fault of cmd if any
+func (c *FaultConn) FailCommand(cmd string, f Fault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.commands[strings.ToUpper(cmd)] = &faultRule{fault: f}
+}
+
+// FailReceive injects f into the replies received, replacing the previous receive fault if any
+func (c *FaultConn) FailReceive(f Fault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.receive = &faultRule{fault: f}
+}
+
+// Reset removes all faults
+func (c *FaultConn) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.commands = map[string]*faultRule{}
+	c.receive = nil
+}
+
+// returns the fault to inject from the rule, if it isn't used up
+func (c *FaultConn) inject(r *faultRule) (Fault, bool) {
+	if r == nil {
+		return Fault{}, false
+	}
+
+	if r.fault.Times > 0 {
+		if r.injected >= r.fault.Times {
+			return Fault{}, false
+		}
+
+		r.injected++
+	}
+
+	return r.fault, true
+}
+
+func (c *FaultConn) commandFault(cmd string) (Fault, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.inject(c.commands[strings.ToUpper(cmd)])
+}
+
+func (c *FaultConn) receiveFault() (Fault, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.inject(c.receive)
+}
+
+// applies the fault of cmd, returns the command to send in its place or an error
+func (c *FaultConn) command(cmd string, args []interface{}) (string, []interface{}, error) {
+	f, ok := c.commandFault(cmd)
+	if !ok {
+		return cmd, args, nil
+	}
+
+	time.Sleep(f.Delay)
+
+	if f.Close {
+		c.conn.Close()
+	}
+
+	if f.Err != nil {
+		return "", nil, f.Err
+	}
+
+	if f.Drop {
+		return "PING", nil, nil
+	}
+
+	return cmd, args, nil
+}
+
+// applies the receive fault to a received reply, drop is true if the reply is discarded
+func (c *FaultConn) received(reply interface{}, err error) (_ interface{}, drop bool, _ error) {
+	if err != nil {
+		return reply, false, err
+	}
+
+	f, ok := c.receiveFault()
+	if !ok {
+		return reply, false, nil
+	}
+
+	time.Sleep(f.Delay)
+
+	if f.Close {
+		c.conn.Close()
+		if err := c.conn.Err(); err != nil {
+			return nil, false, err
+		}
+
+		return nil, false, errFaultClosed
+	}
+
+	if f.Err != nil {
+		return nil, false, f.Err
+	}
+
+	return reply, f.Drop, nil
+}
+
+func (c *FaultConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *FaultConn) Err() error {
+	return c.conn.Err()
+}
+
+func (c *FaultConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c *FaultConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "" {
+		var err error
+		if cmd, args, err = c.command(cmd, args); err != nil {
+			return nil, err
+		}
+	}
+
+	if ctx.Done() == nil {
+		return c.conn.Do(cmd, args...)
+	}
+
+	return redis.DoContext(c.conn, ctx, cmd, args...)
+}
+
+func (c *FaultConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "" {
+		var err error
+		if cmd, args, err = c.command(cmd, args); err != nil {
+			return nil, err
+		}
+	}
+
+	return redis.DoWithTimeout(c.conn, timeout, cmd, args...)
+}
+
+func (c *FaultConn) Send(cmd string, args ...interface{}) error {
+	cmd, args, err := c.command(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	return c.conn.Send(cmd, args...)
+}
+
+func (c *FaultConn) Flush() error {
+	return c.conn.Flush()
+}
+
+func (c *FaultConn) Receive() (interface{}, error) {
+	return c.ReceiveContext(context.Background())
+}
+
+func (c *FaultConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	for {
+		var reply interface{}
+		var err error
+		if ctx.Done() == nil {
+			reply, err = c.conn.Receive()
+		} else {
+			reply, err = redis.ReceiveContext(c.conn, ctx)
+		}
+
+		reply, drop, err := c.received(reply, err)
+		if !drop {
+			return reply, err
+		}
+	}
+}
+
+func (c *FaultConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	for {
+		reply, drop, err := c.received(redis.ReceiveWithTimeout(c.conn, timeout))
+		if !drop {
+			return reply, err
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads a single command sent by a client, either as a RESP array of bulk strings or inline
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, errProtocol
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, errProtocol
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// writer encodes replies using the protocol version negotiated by the client
+type writer struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func (w *writer) simple(s string) {
+	fmt.Fprintf(w.w, "+%s\r\n", s)
+}
+
+func (w *writer) ok() {
+	w.simple("OK")
+}
+
+func (w *writer) err(s string) {
+	fmt.Fprintf(w.w, "-%s\r\n", s)
+}
+
+func (w *writer) int(n int64) {
+	fmt.Fprintf(w.w, ":%d\r\n", n)
+}
+
+func (w *writer) bulk(b []byte) {
+	if b == nil {
+		w.null()
+		return
+	}
+
+	fmt.Fprintf(w.w, "$%d\r\n", len(b))
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) bulkString(s string) {
+	w.bulk([]byte(s))
+}
+
+func (w *writer) null() {
+	if w.proto == 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *writer) nullArray() {
+	if w.proto == 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+
+	w.w.WriteString("*-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	fmt.Fprintf(w.w, "*%d\r\n", n)
+}
+
+func (w *writer) push(n int) {
+	if w.proto == 3 {
+		fmt.Fprintf(w.w, ">%d\r\n", n)
+		return
+	}
+
+	w.array(n)
+}
+
+// map writes a map header, in RESP2 maps are flattened arrays
+func (w *writer) mapHeader(n int) {
+	if w.proto == 3 {
+		fmt.Fprintf(w.w, "%%%d\r\n", n)
+		return
+	}
+
+	w.array(n * 2)
+}
+
+func (w *writer) setHeader(n int) {
+	if w.proto == 3 {
+		fmt.Fprintf(w.w, "~%d\r\n", n)
+		return
+	}
+
+	w.array(n)
+}
+
+func (w *writer) double(f float64) {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if w.proto == 3 {
+		fmt.Fprintf(w.w, ",%s\r\n", s)
+		return
+	}
+
+	w.bulkString(s)
+}
+
+func (w *writer) strings(ss []string) {
+	w.array(len(ss))
+	for _, s := range ss {
+		w.bulkString(s)
+	}
+}
@@ -0,0 +1,97 @@
+package redistest
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+const switchMasterChannel = "+switch-master"
+
+// Sentinel is a server acting as a Redis Sentinel monitoring a single master. It replies to SENTINEL
+// get-master-addr-by-name and publishes +switch-master on failovers, the servers aren't replicated.
+type Sentinel struct {
+	server *Server
+	name   string
+
+	mu     sync.Mutex
+	master string
+}
+
+// NewSentinel starts a sentinel on a random local port monitoring the master at addr as name
+func NewSentinel(name, addr string) (*Sentinel, error) {
+	s, err := NewServer()
+	if err != nil {
+		return nil, err
+	}
+
+	sn := &Sentinel{server: s, name: name, master: addr}
+	s.mu.Lock()
+	s.sentinel = sn
+	s.mu.Unlock()
+
+	return sn, nil
+}
+
+// Addr returns the address the sentinel is listening on
+func (sn *Sentinel) Addr() string {
+	return sn.server.Addr()
+}
+
+// Close stops the sentinel
+func (sn *Sentinel) Close() error {
+	return sn.server.Close()
+}
+
+// KillClients closes all client connections of the sentinel
+func (sn *Sentinel) KillClients() {
+	sn.server.KillClients()
+}
+
+// Master returns the address of the master
+func (sn *Sentinel) Master() string {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	return sn.master
+}
+
+// Failover promotes the server at addr to master and publishes +switch-master like after a failover
+func (sn *Sentinel) Failover(addr string) {
+	sn.mu.Lock()
+	old := sn.master
+	sn.master = addr
+	sn.mu.Unlock()
+
+	oldHost, oldPort, _ := net.SplitHostPort(old)
+	host, port, _ := net.SplitHostPort(addr)
+	sn.server.Publish(switchMasterChannel, strings.Join([]string{sn.name, oldHost, oldPort, host, port}, " "))
+}
+
+func cmdSentinel(s *Server, c *client, args []string) {
+	sn := s.sentinel
+	if sn == nil {
+		c.w.err("ERR unknown command '" + args[0] + "'")
+		return
+	}
+
+	switch strings.ToUpper(args[1]) {
+	case "GET-MASTER-ADDR-BY-NAME":
+		if len(args) != 3 {
+			c.w.err(errSyntax)
+			return
+		}
+
+		if args[2] != sn.name {
+			c.w.nullArray()
+			return
+		}
+
+		host, port, _ := net.SplitHostPort(sn.Master())
+		c.w.array(2)
+		c.w.bulkString(host)
+		c.w.bulkString(port)
+	default:
+		c.w.err("ERR unknown sentinel subcommand '" + args[1] + "'")
+	}
+}
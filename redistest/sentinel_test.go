@@ -0,0 +1,49 @@
+package redistest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestSentinel(t *testing.T) {
+	sn, err := NewSentinel("mymaster", "127.0.0.1:6379")
+	if err != nil {
+		t.Fatalf("failed to start sentinel: %v", err)
+	}
+	defer sn.Close()
+
+	conn, err := redis.Dial("tcp", sn.Addr(), redis.DialReadTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	addr, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", "mymaster"))
+	if err != nil || len(addr) != 2 || addr[0] != "127.0.0.1" || addr[1] != "6379" {
+		t.Fatalf("addr: %v, err: %v", addr, err)
+	}
+
+	if _, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", "other")); err != redis.ErrNil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := conn.Do("SUBSCRIBE", "+switch-master"); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	sn.Failover("127.0.0.1:6380")
+	msg, err := redis.Values(conn.Receive())
+	if err != nil || len(msg) != 3 {
+		t.Fatalf("msg: %v, err: %v", msg, err)
+	}
+
+	if data, _ := redis.String(msg[2], nil); data != "mymaster 127.0.0.1 6379 127.0.0.1 6380" {
+		t.Fatalf("data: %s", data)
+	}
+
+	if sn.Master() != "127.0.0.1:6380" {
+		t.Fatalf("master: %s", sn.Master())
+	}
+}
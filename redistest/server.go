@@ -0,0 +1,441 @@
+// Package redistest provides an in-process Redis server speaking RESP2 and RESP3 for testing code that relies on
+// server-assisted client side caching, without requiring a running Redis.
+//
+// The server implements a small subset of Redis: strings, hashes, sets and sorted sets, expiry, MULTI/EXEC/WATCH,
+// pub/sub and CLIENT TRACKING in default, BCAST, OPTIN and OPTOUT modes with REDIRECT and NOLOOP. Invalidation messages
+// are delivered on the __redis__:invalidate channel to redirect targets, or as push messages on RESP3 connections.
+//
+// A Cluster runs servers forming a Redis Cluster, with CLUSTER SLOTS, MOVED and ASK redirections and slot migrations.
+// A Sentinel reports the master of servers and publishes +switch-master on failovers.
+package redistest
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const invalidateChannel = "__redis__:invalidate"
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindHash
+	kindSet
+	kindZSet
+)
+
+type item struct {
+	kind    kind
+	str     []byte
+	hash    map[string][]byte
+	set     map[string]struct{}
+	zset    map[string]float64
+	expires time.Time
+}
+
+type client struct {
+	id   int64
+	conn net.Conn
+	w    writer
+	db   int
+
+	tracking bool
+	bcast    bool
+	prefixes []string
+	redirect int64
+	noloop   bool
+	optin    bool
+	optout   bool
+	// CLIENT CACHING flag for the next command, 1 is yes, -1 is no
+	caching int
+
+	multi    bool
+	multiErr bool
+	queued   [][]string
+	watched  map[string]uint64
+
+	subs map[string]bool
+
+	// set by ASKING for the next command
+	asking bool
+}
+
+type Server struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	dbs      map[int]map[string]*item
+	clients  map[int64]*client
+	nextID   int64
+	tracked  map[string]map[int64]struct{}
+	versions map[string]uint64
+	version  uint64
+	closed   bool
+	wg       sync.WaitGroup
+	// HELLO is rejected like by a Redis older than 6
+	resp2Only bool
+	// the cluster of the server and its index in it, nil if it's standalone
+	cluster *Cluster
+	node    int
+	// set if the server acts as a sentinel
+	sentinel *Sentinel
+}
+
+// NewServer starts a server listening on a random local port
+func NewServer() (*Server, error) {
+	return NewServerAddr("127.0.0.1:0")
+}
+
+// NewServerAddr starts a server listening on addr
+func NewServerAddr(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		ln:       ln,
+		dbs:      map[int]map[string]*item{},
+		clients:  map[int64]*client{},
+		tracked:  map[string]map[int64]struct{}{},
+		versions: map[string]uint64{},
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and closes all client connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.ln.Close()
+	for _, c := range s.clients {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// SetRESP2Only makes the server reject HELLO like a Redis older than 6, which only supports RESP2
+func (s *Server) SetRESP2Only(b bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resp2Only = b
+}
+
+// NumClients returns the number of connected clients
+func (s *Server) NumClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.clients)
+}
+
+// KillClients closes all client connections, like CLIENT KILL would
+func (s *Server) KillClients() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// Get returns the string value of key in database 0, bypassing tracking
+func (s *Server) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it := s.lookup(0, key)
+	if it == nil || it.kind != kindString {
+		return nil, false
+	}
+
+	return it.str, true
+}
+
+// Set sets the string value of key in database 0 and sends invalidations like a write from another client would
+func (s *Server) Set(key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.db(0)[key] = &item{kind: kindString, str: value}
+	s.touch(nil, 0, key)
+}
+
+// FlushAll removes all keys and sends flush invalidations to all tracking clients
+func (s *Server) FlushAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flush(-1)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+
+		s.nextID++
+		c := &client{
+			id:   s.nextID,
+			conn: conn,
+			w:    writer{w: bufio.NewWriter(conn), proto: 2},
+			subs: map[string]bool{},
+		}
+		s.clients[c.id] = c
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c *client) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c.id)
+		s.mu.Unlock()
+		c.conn.Close()
+	}()
+
+	r := bufio.NewReader(c.conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		s.mu.Lock()
+		quit := s.dispatch(c, args)
+		c.w.w.Flush()
+		s.mu.Unlock()
+
+		if quit {
+			return
+		}
+	}
+}
+
+func (s *Server) db(n int) map[string]*item {
+	db, ok := s.dbs[n]
+	if !ok {
+		db = map[string]*item{}
+		s.dbs[n] = db
+	}
+
+	return db
+}
+
+// lookup returns the item at key, expiring it if needed
+func (s *Server) lookup(db int, key string) *item {
+	it, ok := s.db(db)[key]
+	if !ok {
+		return nil
+	}
+
+	if !it.expires.IsZero() && !it.expires.After(time.Now()) {
+		delete(s.db(db), key)
+		s.touch(nil, db, key)
+		return nil
+	}
+
+	return it
+}
+
+// read records that c read key, for tracking purposes
+func (s *Server) read(c *client, key string) {
+	if !c.tracking || c.bcast {
+		return
+	}
+
+	if c.optin && c.caching != 1 {
+		return
+	}
+
+	if c.optout && c.caching == -1 {
+		return
+	}
+
+	ids, ok := s.tracked[key]
+	if !ok {
+		ids = map[int64]struct{}{}
+		s.tracked[key] = ids
+	}
+
+	ids[c.id] = struct{}{}
+}
+
+// touch is called on every modification of key by client by (nil when modified by the server itself)
+func (s *Server) touch(by *client, db int, key string) {
+	s.version++
+	s.versions[versionKey(db, key)] = s.version
+
+	for id := range s.tracked[key] {
+		c, ok := s.clients[id]
+		if !ok || (c.noloop && c == by) {
+			continue
+		}
+
+		s.invalidate(c, []string{key})
+	}
+	delete(s.tracked, key)
+
+	for _, c := range s.sortedClients() {
+		if !c.tracking || !c.bcast || (c.noloop && c == by) {
+			continue
+		}
+
+		if !matchesPrefix(c.prefixes, key) {
+			continue
+		}
+
+		s.invalidate(c, []string{key})
+	}
+}
+
+// flush removes all keys of db, or of all databases if db is -1
+func (s *Server) flush(db int) {
+	for n, keys := range s.dbs {
+		if db != -1 && n != db {
+			continue
+		}
+
+		for k := range keys {
+			s.version++
+			s.versions[versionKey(n, k)] = s.version
+		}
+
+		s.dbs[n] = map[string]*item{}
+	}
+
+	s.tracked = map[string]map[int64]struct{}{}
+	for _, c := range s.sortedClients() {
+		if c.tracking {
+			s.invalidate(c, nil)
+		}
+	}
+}
+
+// invalidate sends an invalidation message for keys to the tracking client c, nil keys means a flush
+func (s *Server) invalidate(c *client, keys []string) {
+	writeKeys := func(w *writer) {
+		if keys == nil {
+			w.nullArray()
+			return
+		}
+
+		w.strings(keys)
+	}
+
+	if c.redirect != 0 {
+		target, ok := s.clients[c.redirect]
+		if !ok {
+			return
+		}
+
+		if target.w.proto != 3 && !target.subs[invalidateChannel] {
+			return
+		}
+
+		target.w.push(3)
+		target.w.bulkString("message")
+		target.w.bulkString(invalidateChannel)
+		writeKeys(&target.w)
+		target.w.w.Flush()
+		return
+	}
+
+	if c.w.proto == 3 {
+		c.w.push(2)
+		c.w.bulkString("invalidate")
+		writeKeys(&c.w)
+		c.w.w.Flush()
+	}
+}
+
+func (s *Server) publish(channel string, msg string) int {
+	n := 0
+	for _, c := range s.sortedClients() {
+		if !c.subs[channel] {
+			continue
+		}
+
+		c.w.push(3)
+		c.w.bulkString("message")
+		c.w.bulkString(channel)
+		c.w.bulkString(msg)
+		c.w.w.Flush()
+		n++
+	}
+
+	return n
+}
+
+// Publish publishes msg on channel and returns the number of receivers
+func (s *Server) Publish(channel string, msg string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.publish(channel, msg)
+}
+
+func (s *Server) sortedClients() []*client {
+	cs := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		cs = append(cs, c)
+	}
+
+	sort.Slice(cs, func(i, j int) bool { return cs[i].id < cs[j].id })
+	return cs
+}
+
+func matchesPrefix(prefixes []string, key string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+
+	for _, p := range prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func versionKey(db int, key string) string {
+	return strconv.Itoa(db) + ":" + key
+}
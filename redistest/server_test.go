@@ -0,0 +1,84 @@
+package redistest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestServer_tracking(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer s.Close()
+
+	dial := func() redis.Conn {
+		conn, err := redis.Dial("tcp", s.Addr(), redis.DialReadTimeout(time.Second))
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+
+		return conn
+	}
+
+	iconn := dial()
+	defer iconn.Close()
+
+	id, err := redis.Int(iconn.Do("CLIENT", "ID"))
+	if err != nil {
+		t.Fatalf("failed to get id: %v", err)
+	}
+
+	if _, err := iconn.Do("SUBSCRIBE", "__redis__:invalidate"); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	conn := dial()
+	defer conn.Close()
+
+	if _, err := conn.Do("CLIENT", "TRACKING", "ON", "REDIRECT", id); err != nil {
+		t.Fatalf("failed to enable tracking: %v", err)
+	}
+
+	if _, err := conn.Do("SET", "foo", "1"); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	if v, err := redis.String(conn.Do("GET", "foo")); err != nil || v != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	receive := func() []interface{} {
+		t.Helper()
+		values, err := redis.Values(iconn.Receive())
+		if err != nil {
+			t.Fatalf("failed to receive: %v", err)
+		}
+
+		return values
+	}
+
+	// a write by another client invalidates the read key
+	s.Set("foo", []byte("2"))
+	if values := receive(); string(values[0].([]byte)) != "message" || !reflect.DeepEqual(values[2], []interface{}{[]byte("foo")}) {
+		t.Fatalf("invalidation: %q", values)
+	}
+
+	// flushes invalidate all keys with a null array
+	s.FlushAll()
+	if values := receive(); values[2] != nil {
+		t.Fatalf("invalidation: %q", values)
+	}
+
+	if _, ok := s.Get("foo"); ok {
+		t.Fatal("foo not flushed")
+	}
+
+	values, err := redis.Values(iconn.Do("UNSUBSCRIBE"))
+	if err != nil || string(values[0].([]byte)) != "unsubscribe" || values[2] != int64(0) {
+		t.Fatalf("unsubscribe: %q, err: %v", values, err)
+	}
+}
@@ -0,0 +1,420 @@
+package csc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// max number of replies read ahead of the caller, the reader stops reading push messages as well when it's reached
+const resp3ReplyBuffer = 128
+
+var errResp3Closed = errors.New("resp3 connection closed")
+
+// errNoResp3 is returned when dialing a server that doesn't support RESP3
+var errNoResp3 = errors.New("server doesn't support resp3")
+
+// pushMessage is an out-of-band RESP3 push, like an invalidation
+type pushMessage []interface{}
+
+// resp3Conn is a redis.Conn speaking RESP3, which lets the server push messages, like invalidations, on the same
+// connection as replies. A goroutine reads from the connection, passing push messages to onPush and queueing
+// replies for Do and Receive. Replies are converted to the same types as redigo returns for RESP2: maps and sets are
+// flattened into slices, doubles and big numbers are returned as bulk strings and booleans as integers
+type resp3Conn struct {
+	conn net.Conn
+	bw   *bufio.Writer
+	br   *bufio.Reader
+	// number of sent commands whose replies haven't been received
+	pending int
+	// closed by the reader when it exits, err is then set
+	replies chan interface{}
+	onPush  func(pushMessage)
+	// closed when the reader exits
+	done chan struct{}
+	mu   sync.Mutex
+	err  error
+}
+
+// dials addr and switches to RESP3 with HELLO 3, returns errNoResp3 if the server doesn't support it
+func dialResp3(ctx context.Context, addr string, db int, onPush func(pushMessage)) (*resp3Conn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newResp3Conn(nc, onPush)
+	if _, err := c.DoContext(ctx, "HELLO", 3); err != nil {
+		c.Close()
+		if _, ok := err.(redis.Error); ok {
+			return nil, fmt.Errorf("%w: %s", errNoResp3, err)
+		}
+
+		return nil, err
+	}
+
+	if db != 0 {
+		if _, err := c.DoContext(ctx, "SELECT", db); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func newResp3Conn(nc net.Conn, onPush func(pushMessage)) *resp3Conn {
+	c := &resp3Conn{
+		conn:    nc,
+		bw:      bufio.NewWriter(nc),
+		br:      bufio.NewReader(nc),
+		replies: make(chan interface{}, resp3ReplyBuffer),
+		onPush:  onPush,
+		done:    make(chan struct{}),
+	}
+
+	go c.readLoop()
+	return c
+}
+
+func (c *resp3Conn) readLoop() {
+	defer close(c.done)
+	defer close(c.replies)
+
+	for {
+		reply, err := readResp3(c.br)
+		if err != nil {
+			c.fatal(err)
+			return
+		}
+
+		if msg, ok := reply.(pushMessage); ok {
+			if c.onPush != nil {
+				c.onPush(msg)
+			}
+
+			continue
+		}
+
+		c.replies <- reply
+	}
+}
+
+// closes the connection, the first error is kept and returned by all later calls
+func (c *resp3Conn) fatal(err error) error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+		c.conn.Close()
+	}
+	err = c.err
+	c.mu.Unlock()
+
+	return err
+}
+
+func (c *resp3Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+func (c *resp3Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil
+	}
+
+	c.err = errResp3Closed
+	return c.conn.Close()
+}
+
+func (c *resp3Conn) Send(cmd string, args ...interface{}) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	writeCommand(c.bw, cmd, args)
+	c.pending++
+	return nil
+}
+
+func (c *resp3Conn) Flush() error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	if err := c.bw.Flush(); err != nil {
+		return c.fatal(err)
+	}
+
+	return nil
+}
+
+func (c *resp3Conn) Receive() (interface{}, error) {
+	return c.ReceiveContext(context.Background())
+}
+
+func (c *resp3Conn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	reply, err := c.receive(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.pending > 0 {
+		c.pending--
+	}
+
+	if err, ok := reply.(redis.Error); ok {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+func (c *resp3Conn) receive(ctx context.Context) (interface{}, error) {
+	select {
+	case reply, ok := <-c.replies:
+		if !ok {
+			return nil, c.Err()
+		}
+
+		return reply, nil
+	case <-ctx.Done():
+		return nil, c.fatal(ctx.Err())
+	}
+}
+
+func (c *resp3Conn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+// DoContext sends cmd and returns its reply, or the replies of all pending commands if cmd is empty. Like redigo the
+// connection is closed if ctx is done before the reply is received
+func (c *resp3Conn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	if dl, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(dl)
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+
+	pending := c.pending
+	c.pending = 0
+
+	if cmd != "" {
+		writeCommand(c.bw, cmd, args)
+	}
+
+	if err := c.bw.Flush(); err != nil {
+		return nil, c.fatal(err)
+	}
+
+	if cmd == "" {
+		replies := make([]interface{}, pending)
+		for i := range replies {
+			reply, err := c.receive(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			replies[i] = reply
+		}
+
+		return replies, nil
+	}
+
+	var err error
+	var reply interface{}
+	for i := 0; i <= pending; i++ {
+		var e error
+		if reply, e = c.receive(ctx); e != nil {
+			return nil, e
+		}
+
+		if e, ok := reply.(redis.Error); ok && err == nil {
+			err = e
+		}
+	}
+
+	return reply, err
+}
+
+// writes cmd to w, write errors are returned by the next flush of w
+func writeCommand(w *bufio.Writer, cmd string, args []interface{}) {
+	fmt.Fprintf(w, "*%d\r\n", len(args)+1)
+	writeBulk(w, []byte(cmd))
+
+	for _, arg := range args {
+		writeBulk(w, argBytes(arg))
+	}
+}
+
+// formats arg like redigo does
+func argBytes(arg interface{}) []byte {
+	switch a := arg.(type) {
+	case string:
+		return []byte(a)
+	case []byte:
+		return a
+	case int:
+		return strconv.AppendInt(nil, int64(a), 10)
+	case int64:
+		return strconv.AppendInt(nil, a, 10)
+	case float64:
+		return strconv.AppendFloat(nil, a, 'g', -1, 64)
+	case bool:
+		if a {
+			return []byte("1")
+		}
+
+		return []byte("0")
+	case nil:
+		return nil
+	case redis.Argument:
+		return argBytes(a.RedisArg())
+	default:
+		return []byte(fmt.Sprint(a))
+	}
+}
+
+func writeBulk(w *bufio.Writer, b []byte) {
+	fmt.Fprintf(w, "$%d\r\n", len(b))
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+var errProtocol = errors.New("resp3: invalid reply")
+
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+
+	return line[:len(line)-2], nil
+}
+
+func readResp3(br *bufio.Reader) (interface{}, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return nil, err
+	}
+
+	body := string(line[1:])
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return redis.Error(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '_':
+		return nil, nil
+	case '#':
+		if body == "t" {
+			return int64(1), nil
+		}
+
+		return int64(0), nil
+	case ',', '(':
+		return []byte(body), nil
+	case '$', '=', '!':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errProtocol
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+
+		b = b[:n]
+		switch line[0] {
+		case '!':
+			return redis.Error(b), nil
+		case '=':
+			// verbatim strings are prefixed by their format, like txt:
+			if len(b) >= 4 {
+				b = b[4:]
+			}
+		}
+
+		return b, nil
+	case '*', '~', '%', '>', '|':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errProtocol
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		if line[0] == '%' || line[0] == '|' {
+			n *= 2
+		}
+
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readResp3(br); err != nil {
+				return nil, err
+			}
+		}
+
+		switch line[0] {
+		case '>':
+			return pushMessage(values), nil
+		case '|':
+			// attributes describe the reply that follows them
+			return readResp3(br)
+		}
+
+		return values, nil
+	}
+
+	return nil, errProtocol
+}
+
+// returns the keys of an invalidation push message, nil keys mean that all keys are invalidated.
+// ok is false if msg isn't an invalidation
+func invalidationPush(msg pushMessage) (keys []string, ok bool, err error) {
+	if len(msg) != 2 {
+		return nil, false, nil
+	}
+
+	kind, _ := redis.String(msg[0], nil)
+	if kind != "invalidate" {
+		return nil, false, nil
+	}
+
+	if msg[1] == nil {
+		return nil, true, nil
+	}
+
+	keys, err = redis.Strings(msg[1], nil)
+	return keys, true, err
+}
@@ -0,0 +1,180 @@
+package csc
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jahaja/csc/redistest"
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestReadResp3(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"+OK\r\n", "OK"},
+		{"-ERR fail\r\n", redis.Error("ERR fail")},
+		{":42\r\n", int64(42)},
+		{"_\r\n", nil},
+		{"#t\r\n", int64(1)},
+		{",1.5\r\n", []byte("1.5")},
+		{"$3\r\nfoo\r\n", []byte("foo")},
+		{"$-1\r\n", nil},
+		{"=7\r\ntxt:foo\r\n", []byte("foo")},
+		{"!4\r\nFAIL\r\n", redis.Error("FAIL")},
+		{"*2\r\n$1\r\na\r\n:1\r\n", []interface{}{[]byte("a"), int64(1)}},
+		{"%1\r\n+k\r\n$1\r\nv\r\n", []interface{}{"k", []byte("v")}},
+		{"~1\r\n$1\r\na\r\n", []interface{}{[]byte("a")}},
+		{"|1\r\n+ttl\r\n:3\r\n$1\r\nv\r\n", []byte("v")},
+		{">2\r\n$10\r\ninvalidate\r\n_\r\n", pushMessage{[]byte("invalidate"), nil}},
+	}
+
+	for _, tt := range tests {
+		got, err := readResp3(bufio.NewReader(strings.NewReader(tt.in)))
+		if err != nil {
+			t.Fatalf("%q: %v", tt.in, err)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%q: got %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestResp3Conn_push(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	pushed := make(chan []string, 1)
+	conn := newResp3Conn(client, func(msg pushMessage) {
+		keys, ok, err := invalidationPush(msg)
+		if ok && err == nil {
+			pushed <- keys
+		}
+	})
+	defer conn.Close()
+
+	go func() {
+		br := bufio.NewReader(server)
+		if _, err := readResp3(br); err != nil {
+			return
+		}
+
+		// an invalidation pushed ahead of the reply
+		server.Write([]byte(">2\r\n$10\r\ninvalidate\r\n*1\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"))
+	}()
+
+	v, err := redis.String(conn.Do("GET", "foo"))
+	if err != nil || v != "bar" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	select {
+	case keys := <-pushed:
+		if len(keys) != 1 || keys[0] != "foo" {
+			t.Fatalf("keys: %v", keys)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no invalidation")
+	}
+
+	// the connection fails when the server goes away
+	server.Close()
+	<-conn.done
+	if _, err := conn.Do("PING"); err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestTrackingPool_RESP3(t *testing.T) {
+	key := "resp3"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100, RESP3: true})
+	c1, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c1.Close()
+
+	if _, ok := c1.conn.(*resp3Conn); !ok || c1.invalidator != nil {
+		t.Fatalf("conn: %T, invalidator: %v", c1.conn, c1.invalidator)
+	}
+
+	c2, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c2.Close()
+
+	if err := c2.Set(key, []byte("1"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	if v, err := c1.Get(key); err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	if err := c2.Set(key, []byte("2"), 60); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	// the invalidation is pushed on c1's only connection
+	for i := 0; i < 100; i++ {
+		if _, ok := c1.cache.getEntry(key); !ok {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if v, err := c1.Get(key); err != nil || string(v) != "2" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	c2.Delete(key)
+}
+
+func TestTrackingPool_RESP3fallback(t *testing.T) {
+	key := "resp3fallback"
+
+	s, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer s.Close()
+
+	// like a Redis older than 6, HELLO is an unknown command
+	s.SetRESP2Only(true)
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: s.Addr(), MaxEntries: 100, RESP3: true})
+	defer pool.Close()
+
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c.Close()
+
+	if _, ok := c.conn.(*resp3Conn); ok || c.invalidator == nil || atomic.LoadUint32(&pool.noResp3) != 1 {
+		t.Fatalf("conn: %T, invalidator: %v", c.conn, c.invalidator)
+	}
+
+	s.Set(key, []byte("1"))
+	if v, err := c.Get(key); err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	// invalidations are redirected to the shared connection
+	s.Set(key, []byte("2"))
+	waitInvalidated(c, key)
+
+	if v, err := c.Get(key); err != nil || string(v) != "2" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+}
@@ -0,0 +1,281 @@
+package csc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const switchMasterChannel = "+switch-master"
+
+// the watcher pings its sentinel at sentinelPingInterval and gives up on it once nothing was received for
+// sentinelTimeout
+const (
+	sentinelPingInterval = time.Second
+	sentinelTimeout      = time.Second * 5
+)
+
+var errMasterSwitched = errors.New("connection to a former master")
+
+// sentinel resolves the master named PoolOptions.SentinelMaster with the sentinels of PoolOptions.SentinelAddresses
+// and watches their +switch-master messages, which report failovers
+type sentinel struct {
+	addrs []string
+	name  string
+
+	mu     sync.Mutex
+	master string
+	// the subscribed connection of the watcher, closed to stop it
+	conn   redis.Conn
+	closed bool
+	// called with the address of the new master after a failover
+	onSwitch func(addr string)
+	done     chan struct{}
+}
+
+func newSentinel(opts *PoolOptions) *sentinel {
+	return &sentinel{
+		addrs: opts.SentinelAddresses,
+		name:  opts.SentinelMaster,
+		done:  make(chan struct{}),
+	}
+}
+
+// returns the address of the master, asking the sentinels if it isn't known yet
+func (s *sentinel) masterAddr() (string, error) {
+	s.mu.Lock()
+	master := s.master
+	s.mu.Unlock()
+
+	if master != "" {
+		return master, nil
+	}
+
+	master, err := s.resolve()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.master == "" {
+		s.master = master
+	}
+
+	return s.master, nil
+}
+
+// asks the sentinels for the address of the master, the first one replying is used
+func (s *sentinel) resolve() (string, error) {
+	err := errors.New("no sentinel addresses")
+	for _, addr := range s.addrs {
+		var master string
+		if master, err = s.query(addr); err == nil {
+			return master, nil
+		}
+
+		dlog("sentinel.query.fail: %p a=%s err=%s\n", s, addr, err.Error())
+	}
+
+	return "", err
+}
+
+func (s *sentinel) query(addr string) (string, error) {
+	conn, err := redis.Dial("tcp", addr, redis.DialConnectTimeout(time.Second*5), redis.DialReadTimeout(time.Second*5))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	hostPort, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.name))
+	if err == redis.ErrNil {
+		return "", errors.New("sentinel doesn't know master " + s.name)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(hostPort) != 2 {
+		return "", errors.New("invalid sentinel master address reply")
+	}
+
+	return net.JoinHostPort(hostPort[0], hostPort[1]), nil
+}
+
+// starts watching failovers, onSwitch is called on the watcher's goroutine
+func (s *sentinel) watch(onSwitch func(addr string)) {
+	s.onSwitch = onSwitch
+	go func() {
+		defer close(s.done)
+
+		for i := 0; !s.isClosed(); i++ {
+			addr := s.addrs[i%len(s.addrs)]
+			if err := s.subscribe(addr); err != nil && !s.isClosed() {
+				Logger.Println("sentinel connection failed:", err.Error())
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+}
+
+// subscribes to +switch-master on the sentinel at addr and receives the messages until the connection fails or the
+// sentinel stops replying to pings
+func (s *sentinel) subscribe(addr string) error {
+	conn, err := redis.Dial("tcp", addr, redis.DialConnectTimeout(sentinelTimeout), redis.DialWriteTimeout(sentinelTimeout))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+
+	s.conn = conn
+	s.mu.Unlock()
+
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	if err := psc.Subscribe(switchMasterChannel); err != nil {
+		return err
+	}
+
+	// a failover may have been missed while disconnected
+	if master, err := s.resolve(); err == nil {
+		s.switchMaster(master)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(sentinelPingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		switch m := psc.ReceiveWithTimeout(sentinelTimeout).(type) {
+		case redis.Message:
+			dlog("sentinel.message: %p m=%s\n", s, m.Data)
+
+			// <master name> <old ip> <old port> <new ip> <new port>
+			fields := strings.Fields(string(m.Data))
+			if len(fields) == 5 && fields[0] == s.name {
+				s.switchMaster(net.JoinHostPort(fields[3], fields[4]))
+			}
+		case error:
+			return m
+		}
+	}
+}
+
+// sets the address of the master, onSwitch is called if it changed
+func (s *sentinel) switchMaster(addr string) {
+	s.mu.Lock()
+	old := s.master
+	s.master = addr
+	s.mu.Unlock()
+
+	if old == "" || old == addr {
+		return
+	}
+
+	Logger.Println("master", s.name, "switched from", old, "to", addr)
+	s.onSwitch(addr)
+}
+
+func (s *sentinel) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// stops the watcher and waits for it to return
+func (s *sentinel) close() {
+	s.mu.Lock()
+	s.closed = true
+	conn := s.conn
+	s.mu.Unlock()
+
+	if s.onSwitch == nil {
+		return
+	}
+
+	if conn != nil {
+		conn.Close()
+	}
+
+	<-s.done
+}
+
+// dials the master
+func (s *sentinel) dial(ctx context.Context, opts *PoolOptions) (redis.Conn, error) {
+	addr, err := s.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := redis.DialContext(ctx, "tcp", addr, redis.DialDatabase(opts.RedisDatabase))
+	if err != nil {
+		return nil, err
+	}
+
+	return &masterConn{Conn: conn, addr: addr}, nil
+}
+
+// checks that a pooled connection is still to the master, redis.Pool.TestOnBorrow then discards those to a former one
+func (s *sentinel) testConn(conn redis.Conn) error {
+	mc, ok := conn.(*masterConn)
+	if !ok {
+		return nil
+	}
+
+	if addr, err := s.masterAddr(); err != nil || addr != mc.addr {
+		return errMasterSwitched
+	}
+
+	return nil
+}
+
+// masterConn is a connection of a redis.Pool to the master at addr
+type masterConn struct {
+	redis.Conn
+	addr string
+}
+
+func (c *masterConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return redis.DoContext(c.Conn, ctx, cmd, args...)
+}
+
+func (c *masterConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func (c *masterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+}
+
+func (c *masterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return redis.ReceiveWithTimeout(c.Conn, timeout)
+}
@@ -0,0 +1,254 @@
+package csc
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jahaja/csc/redistest"
+	"github.com/gomodule/redigo/redis"
+)
+
+// starts a sentinel monitoring the first of two servers as mymaster
+func newTestSentinel(t *testing.T) (*redistest.Sentinel, [2]*redistest.Server) {
+	t.Helper()
+
+	var servers [2]*redistest.Server
+	for i := range servers {
+		s, err := redistest.NewServer()
+		if err != nil {
+			t.Fatalf("failed to start server: %v", err)
+		}
+
+		servers[i] = s
+	}
+
+	sn, err := redistest.NewSentinel("mymaster", servers[0].Addr())
+	if err != nil {
+		t.Fatalf("failed to start sentinel: %v", err)
+	}
+
+	return sn, servers
+}
+
+func TestTrackingPool_sentinelFailover(t *testing.T) {
+	key := "sentinel:tracking"
+
+	sn, servers := newTestSentinel(t)
+	defer sn.Close()
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	pool := NewTrackingPool(PoolOptions{
+		SentinelAddresses: []string{sn.Addr()},
+		SentinelMaster:    "mymaster",
+		MaxEntries:        100,
+	})
+	defer pool.Close()
+
+	events := make(chan Event, 10)
+	pool.Subscribe(func(e Event) {
+		events <- e
+	})
+
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+
+	servers[0].Set(key, []byte("1"))
+	servers[1].Set(key, []byte("2"))
+	if v, err := c.Get(key); err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	// the clients tracking keys on the former master are closed
+	sn.Failover(servers[1].Addr())
+	waitEvent(t, events, EventOutOfSync)
+	waitEvent(t, events, EventInSync)
+
+	if _, err := c.Get(key); err != ErrClosed {
+		t.Fatalf("err: %v", err)
+	}
+
+	if n := c.Stats().NumEntries; n != 0 {
+		t.Fatalf("entries: %d", n)
+	}
+
+	c.Close()
+
+	c, err = pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c.Close()
+
+	if v, err := c.Get(key); err != nil || string(v) != "2" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	// tracking is re-established on the new master
+	servers[1].Set(key, []byte("3"))
+	waitInvalidated(c, key)
+	if v, err := c.Get(key); err != nil || string(v) != "3" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+}
+
+func TestTrackingPool_sentinelFailoverDialing(t *testing.T) {
+	key := "sentinel:dialing"
+
+	sn, servers := newTestSentinel(t)
+	defer sn.Close()
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	// the failover happens while a client is dialed, once tracking is enabled on it
+	var pool *TrackingPool
+	var failover uint32
+	wrap := func(conn redis.Conn, role ConnRole) redis.Conn {
+		if role == ConnClient && atomic.CompareAndSwapUint32(&failover, 1, 0) {
+			sn.Failover(servers[1].Addr())
+			for i := 0; i < 500; i++ {
+				if addr, _ := pool.address(); addr == servers[1].Addr() {
+					break
+				}
+
+				time.Sleep(time.Millisecond * 10)
+			}
+		}
+
+		return conn
+	}
+
+	pool = NewTrackingPool(PoolOptions{
+		SentinelAddresses: []string{sn.Addr()},
+		SentinelMaster:    "mymaster",
+		MaxEntries:        100,
+		RESP3:             true,
+		WrapConn:          wrap,
+	})
+	defer pool.Close()
+
+	servers[0].Set(key, []byte("1"))
+	servers[1].Set(key, []byte("2"))
+
+	// the client of the former master isn't returned
+	atomic.StoreUint32(&failover, 1)
+	if _, err := pool.Get(); err != errMasterSwitched {
+		t.Fatalf("err: %v", err)
+	}
+
+	if st := pool.Stats(); st.Active != 0 || st.Discarded != 1 {
+		t.Fatalf("stats: %+v", st)
+	}
+
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c.Close()
+
+	if v, err := c.Get(key); err != nil || string(v) != "2" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+}
+
+func TestBroadcastingPool_sentinelFailover(t *testing.T) {
+	key := "sentinel:broadcast"
+
+	sn, servers := newTestSentinel(t)
+	defer sn.Close()
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	pool, err := NewDefaultBroadcastingPool(PoolOptions{
+		SentinelAddresses: []string{sn.Addr()},
+		SentinelMaster:    "mymaster",
+		MaxEntries:        100,
+	})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer pool.Close()
+
+	events := make(chan Event, 10)
+	pool.Subscribe(func(e Event) {
+		events <- e
+	})
+
+	c, _ := pool.Get()
+	servers[0].Set(key, []byte("1"))
+	servers[1].Set(key, []byte("2"))
+	if v, err := c.Get(key); err != nil || string(v) != "1" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	// the cache is flushed and the pool reconnects to the new master without waiting for health checks to fail
+	start := time.Now()
+	sn.Failover(servers[1].Addr())
+	waitEvent(t, events, EventOutOfSync)
+	if n := pool.Stats().NumEntries; n != 0 {
+		t.Fatalf("entries: %d", n)
+	}
+
+	waitEvent(t, events, EventInSync)
+	if d := time.Since(start); d > time.Millisecond*500 {
+		t.Fatalf("reconnected after %s", d)
+	}
+
+	// the connection to the former master isn't reused
+	c.Close()
+	c, _ = pool.Get()
+	defer c.Close()
+
+	if v, err := c.Get(key); err != nil || string(v) != "2" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+
+	if e, err := c.GetEntry(key); err != nil || !e.LocalHit {
+		t.Fatalf("e: %+v, err: %v", e, err)
+	}
+
+	servers[1].Set(key, []byte("3"))
+	waitInvalidated(c, key)
+	if v, err := c.Get(key); err != nil || string(v) != "3" {
+		t.Fatalf("v: %s, err: %v", v, err)
+	}
+}
+
+func TestSentinel_missedSwitch(t *testing.T) {
+	sn, servers := newTestSentinel(t)
+	defer sn.Close()
+	defer servers[0].Close()
+	defer servers[1].Close()
+
+	s := newSentinel(&PoolOptions{SentinelAddresses: []string{"127.0.0.1:1", sn.Addr()}, SentinelMaster: "mymaster"})
+	if addr, err := s.masterAddr(); err != nil || addr != servers[0].Addr() {
+		t.Fatalf("addr: %s, err: %v", addr, err)
+	}
+
+	switched := make(chan string, 1)
+	s.watch(func(addr string) {
+		switched <- addr
+	})
+	defer s.close()
+
+	// the switch happens while the watcher is failing to connect to the first sentinel, it's noticed once it
+	// subscribed to the second one
+	sn.Failover(servers[1].Addr())
+
+	select {
+	case addr := <-switched:
+		if addr != servers[1].Addr() {
+			t.Fatalf("addr: %s", addr)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("switch not noticed")
+	}
+
+	other := newSentinel(&PoolOptions{SentinelAddresses: []string{sn.Addr()}, SentinelMaster: "other"})
+	if _, err := other.resolve(); err == nil {
+		t.Fatal("unknown master resolved")
+	}
+}
@@ -0,0 +1,264 @@
+package csc
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// setValue is a cached set, sets are always cached whole
+type setValue struct {
+	members map[string]struct{}
+}
+
+func (s *setValue) size() int {
+	n := 0
+	for m := range s.members {
+		n += len(m)
+	}
+
+	return n
+}
+
+// zsetValue is a cached sorted set, sorted sets are always cached whole
+type zsetValue struct {
+	// in order of score
+	members []string
+	scores  map[string]float64
+}
+
+func (z *zsetValue) size() int {
+	// a score takes 8 bytes
+	n := 0
+	for _, m := range z.members {
+		n += len(m) + 8
+	}
+
+	return n
+}
+
+// returns the members from start to stop, inclusive, negative indexes count from the end like in ZRANGE
+func (z *zsetValue) rank(start, stop int) []string {
+	n := len(z.members)
+	if start < 0 {
+		start += n
+	}
+
+	if stop < 0 {
+		stop += n
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	if stop >= n {
+		stop = n - 1
+	}
+
+	if start > stop {
+		return []string{}
+	}
+
+	return append([]string(nil), z.members[start:stop+1]...)
+}
+
+// reads the whole set at key into the cache if hint allows it, answer answers the read from it
+func (c *Client) readSet(ctx context.Context, key string, hint CacheHint, answer func(s *setValue) interface{}) (interface{}, error) {
+	return c.readObject(ctx, key, hint, objectRead{
+		local: func(v interface{}) (interface{}, bool) {
+			s, ok := v.(*setValue)
+			if !ok {
+				return nil, false
+			}
+
+			return answer(s), true
+		},
+		cmd: "SMEMBERS",
+		args: func() []interface{} {
+			return []interface{}{c.prefixKey(key)}
+		},
+		merge: func(_ interface{}, reply interface{}) (interface{}, int, error) {
+			members, err := redis.Strings(reply, nil)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			s := &setValue{members: make(map[string]struct{}, len(members))}
+			for _, m := range members {
+				s.members[m] = struct{}{}
+			}
+
+			return s, s.size(), nil
+		},
+	})
+}
+
+// SMembers gets the members of the set at key, it's empty if the set is missing. The set is cached whole and
+// invalidated when it changes
+func (c *Client) SMembers(key string) ([]string, error) {
+	return c.SMembersContext(context.Background(), key)
+}
+
+// SMembersContext is like SMembers but returns ctx's error if it's done before Redis replies
+func (c *Client) SMembersContext(ctx context.Context, key string) ([]string, error) {
+	return c.SMembersWithHint(ctx, key, CacheDefault)
+}
+
+// SMembersWithHint is like SMembersContext but hint selects whether the set is cached and, in OPTIN and OPTOUT
+// tracking modes, tracked by the server
+func (c *Client) SMembersWithHint(ctx context.Context, key string, hint CacheHint) ([]string, error) {
+	res, err := c.readSet(ctx, key, hint, func(s *setValue) interface{} {
+		members := make([]string, 0, len(s.members))
+		for m := range s.members {
+			members = append(members, m)
+		}
+
+		return members
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.([]string), nil
+}
+
+// SIsMember reports whether member is in the set at key. The whole set is read and cached on a miss, so that
+// following checks are answered locally
+func (c *Client) SIsMember(key, member string) (bool, error) {
+	return c.SIsMemberContext(context.Background(), key, member)
+}
+
+// SIsMemberContext is like SIsMember but returns ctx's error if it's done before Redis replies
+func (c *Client) SIsMemberContext(ctx context.Context, key, member string) (bool, error) {
+	return c.SIsMemberWithHint(ctx, key, member, CacheDefault)
+}
+
+// SIsMemberWithHint is like SIsMemberContext but hint selects whether the set is cached and, in OPTIN and OPTOUT
+// tracking modes, tracked by the server
+func (c *Client) SIsMemberWithHint(ctx context.Context, key, member string, hint CacheHint) (bool, error) {
+	res, err := c.readSet(ctx, key, hint, func(s *setValue) interface{} {
+		_, ok := s.members[member]
+		return ok
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return res.(bool), nil
+}
+
+// reads the whole sorted set at key into the cache if hint allows it, answer answers the read from it
+func (c *Client) readZSet(ctx context.Context, key string, hint CacheHint, answer func(z *zsetValue) interface{}) (interface{}, error) {
+	return c.readObject(ctx, key, hint, objectRead{
+		local: func(v interface{}) (interface{}, bool) {
+			z, ok := v.(*zsetValue)
+			if !ok {
+				return nil, false
+			}
+
+			return answer(z), true
+		},
+		cmd: "ZRANGE",
+		args: func() []interface{} {
+			return []interface{}{c.prefixKey(key), 0, -1, "WITHSCORES"}
+		},
+		merge: func(_ interface{}, reply interface{}) (interface{}, int, error) {
+			values, err := redis.Values(reply, nil)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			// RESP3 servers may reply with member and score pairs
+			var flat []interface{}
+			for _, v := range values {
+				if pair, ok := v.([]interface{}); ok {
+					flat = append(flat, pair...)
+					continue
+				}
+
+				flat = append(flat, v)
+			}
+
+			z := &zsetValue{members: make([]string, 0, len(flat)/2), scores: make(map[string]float64, len(flat)/2)}
+			for i := 0; i+1 < len(flat); i += 2 {
+				m, err := redis.String(flat[i], nil)
+				if err != nil {
+					return nil, 0, err
+				}
+
+				score, err := redis.String(flat[i+1], nil)
+				if err != nil {
+					return nil, 0, err
+				}
+
+				if z.scores[m], err = strconv.ParseFloat(score, 64); err != nil {
+					return nil, 0, err
+				}
+
+				z.members = append(z.members, m)
+			}
+
+			return z, z.size(), nil
+		},
+	})
+}
+
+// ZRange gets the members of the sorted set at key from start to stop, inclusive, in order of score. Negative
+// indexes count from the end like in ZRANGE. The sorted set is cached whole and invalidated when it changes, so it's
+// meant for small sorted sets
+func (c *Client) ZRange(key string, start, stop int) ([]string, error) {
+	return c.ZRangeContext(context.Background(), key, start, stop)
+}
+
+// ZRangeContext is like ZRange but returns ctx's error if it's done before Redis replies
+func (c *Client) ZRangeContext(ctx context.Context, key string, start, stop int) ([]string, error) {
+	return c.ZRangeWithHint(ctx, key, start, stop, CacheDefault)
+}
+
+// ZRangeWithHint is like ZRangeContext but hint selects whether the sorted set is cached and, in OPTIN and OPTOUT
+// tracking modes, tracked by the server
+func (c *Client) ZRangeWithHint(ctx context.Context, key string, start, stop int, hint CacheHint) ([]string, error) {
+	res, err := c.readZSet(ctx, key, hint, func(z *zsetValue) interface{} {
+		return z.rank(start, stop)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.([]string), nil
+}
+
+// ZScore gets the score of member in the sorted set at key, redis.ErrNil is returned if it's missing. Like ZRange the
+// whole sorted set is cached
+func (c *Client) ZScore(key, member string) (float64, error) {
+	return c.ZScoreContext(context.Background(), key, member)
+}
+
+// ZScoreContext is like ZScore but returns ctx's error if it's done before Redis replies
+func (c *Client) ZScoreContext(ctx context.Context, key, member string) (float64, error) {
+	return c.ZScoreWithHint(ctx, key, member, CacheDefault)
+}
+
+// ZScoreWithHint is like ZScoreContext but hint selects whether the sorted set is cached and, in OPTIN and OPTOUT
+// tracking modes, tracked by the server
+func (c *Client) ZScoreWithHint(ctx context.Context, key, member string, hint CacheHint) (float64, error) {
+	res, err := c.readZSet(ctx, key, hint, func(z *zsetValue) interface{} {
+		score, ok := z.scores[member]
+		if !ok {
+			return nil
+		}
+
+		return score
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if res == nil {
+		return 0, redis.ErrNil
+	}
+
+	return res.(float64), nil
+}
@@ -0,0 +1,137 @@
+package csc
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// waits for key to be invalidated in c's cache
+func waitInvalidated(c *Client, key string) {
+	for i := 0; i < 100; i++ {
+		if _, ok := c.cache.getEntry(key); !ok {
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestClient_set(t *testing.T) {
+	key := "flags"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100})
+	c1, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c1.Close()
+
+	c2, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c2.Close()
+
+	c2.Delete(key)
+	defer c2.Delete(key)
+
+	if _, err := c2.Conn().Do("SADD", key, "a", "b"); err != nil {
+		t.Fatalf("failed to sadd: %v", err)
+	}
+
+	if ok, err := c1.SIsMember(key, "a"); err != nil || !ok {
+		t.Fatalf("ok: %t, err: %v", ok, err)
+	}
+
+	// the set was read whole, so this is answered locally
+	misses := c1.Stats().Misses
+	if ok, err := c1.SIsMember(key, "c"); err != nil || ok {
+		t.Fatalf("ok: %t, err: %v", ok, err)
+	}
+
+	members, err := c1.SMembers(key)
+	sort.Strings(members)
+	if err != nil || !reflect.DeepEqual(members, []string{"a", "b"}) {
+		t.Fatalf("members: %v, err: %v", members, err)
+	}
+
+	if st := c1.Stats(); st.Misses != misses {
+		t.Fatalf("stats: %+v", st)
+	}
+
+	if _, err := c2.Conn().Do("SADD", key, "c"); err != nil {
+		t.Fatalf("failed to sadd: %v", err)
+	}
+
+	waitInvalidated(c1, key)
+	if ok, err := c1.SIsMember(key, "c"); err != nil || !ok {
+		t.Fatalf("ok: %t, err: %v", ok, err)
+	}
+}
+
+func TestClient_zset(t *testing.T) {
+	key := "allowlist"
+
+	pool := NewTrackingPool(PoolOptions{RedisAddress: redisAddress, MaxEntries: 100})
+	c1, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c1.Close()
+
+	c2, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get client from pool: %v", err)
+	}
+	defer c2.Close()
+
+	c2.Delete(key)
+	defer c2.Delete(key)
+
+	if _, err := c2.Conn().Do("ZADD", key, 1, "a", 2.5, "b", 3, "c"); err != nil {
+		t.Fatalf("failed to zadd: %v", err)
+	}
+
+	tests := []struct {
+		start, stop int
+		want        []string
+	}{
+		{0, -1, []string{"a", "b", "c"}},
+		{1, 1, []string{"b"}},
+		{-2, 10, []string{"b", "c"}},
+		{2, 1, []string{}},
+		{5, 10, []string{}},
+	}
+
+	for _, tt := range tests {
+		members, err := c1.ZRange(key, tt.start, tt.stop)
+		if err != nil || !reflect.DeepEqual(members, tt.want) {
+			t.Fatalf("%d %d: members: %v, err: %v", tt.start, tt.stop, members, err)
+		}
+	}
+
+	if score, err := c1.ZScore(key, "b"); err != nil || score != 2.5 {
+		t.Fatalf("score: %f, err: %v", score, err)
+	}
+
+	if _, err := c1.ZScore(key, "d"); err != redis.ErrNil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if st := c1.Stats(); st.Misses != 1 {
+		t.Fatalf("stats: %+v", st)
+	}
+
+	if _, err := c2.Conn().Do("ZADD", key, 0, "d"); err != nil {
+		t.Fatalf("failed to zadd: %v", err)
+	}
+
+	waitInvalidated(c1, key)
+	if members, err := c1.ZRange(key, 0, 0); err != nil || !reflect.DeepEqual(members, []string{"d"}) {
+		t.Fatalf("members: %v, err: %v", members, err)
+	}
+}